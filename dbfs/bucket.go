@@ -1,13 +1,20 @@
 package dbfs
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
 	"github.com/bioothod/elliptics-go/elliptics"
 	"github.com/bioothod/ebucket-go"
+	"github.com/bioothod/wd2/metrics"
+	"github.com/bioothod/wd2/reqlog"
+	"github.com/bioothod/wd2/tracing"
 	"github.com/golang/glog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"io"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,6 +30,10 @@ type EbucketCtl struct {
 type BucketProcessor struct {
 	node		*elliptics.Node
 	bp		*ebucket.BucketProcessor
+
+	// one reference is held by DbFS while the processor is current, every data operation holds another one,
+	// elliptics node is freed when the last reference is released
+	refs		int64
 }
 
 const RandomKeyLength = 128
@@ -58,29 +69,173 @@ func NewBucketProcessor (e *EbucketCtl) (*BucketProcessor, error) {
 
 	if err != nil {
 		node.Free()
+		return nil, err
 	}
 
 	return &BucketProcessor {
 		node:		node,
 		bp:		bp,
+		refs:		1,
 	}, nil
 }
 
-func (bp *BucketProcessor) Close() {
-	if bp != nil {
+func (bp *BucketProcessor) acquire() {
+	atomic.AddInt64(&bp.refs, 1)
+}
+
+// release drops the reference and closes the processor if it was the last one
+func (bp *BucketProcessor) release() {
+	if bp == nil {
+		return
+	}
+
+	if atomic.AddInt64(&bp.refs, -1) == 0 {
 		bp.bp.Close()
 		bp.node.Free()
 	}
 }
 
+// ctx_reader fails once @ctx is done, elliptics transfers do not accept context,
+// so the only way to abort streaming upload is to stop feeding it with data
+type ctx_reader struct {
+	ctx		context.Context
+	r		io.Reader
+}
+
+func (cr *ctx_reader) Read(p []byte) (int, error) {
+	err := cr.ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+
+	return cr.r.Read(p)
+}
+
+// get_bucket selects bucket for the new object of @size bytes
+func (bp *BucketProcessor) get_bucket(ctx context.Context, size uint64) (*ebucket.BucketMeta, error) {
+	_, span := tracing.Start(ctx, "ebucket.GetBucket", attribute.Int64("size", int64(size)))
+	meta, err := bp.bp.GetBucket(size)
+	if err == nil {
+		span.SetAttributes(attribute.String("bucket", meta.Name))
+	}
+	tracing.End(span, err)
+
+	return meta, err
+}
+
+func (bp *BucketProcessor) find_bucket(ctx context.Context, name string) (*ebucket.BucketMeta, error) {
+	_, span := tracing.Start(ctx, "ebucket.FindBucket", attribute.String("bucket", name))
+	meta, err := bp.bp.FindBucket(name)
+	tracing.End(span, err)
+
+	return meta, err
+}
+
+// start_span starts span of the data operation @op which is a child of the request span
+func (f *File) start_span(op string) (context.Context, trace.Span) {
+	return tracing.Start(f.User.context(), "dbfs." + op,
+		attribute.String("path", f.Info.Filename),
+		attribute.String("owner", f.Info.Username),
+		attribute.Int64("offset", f.remote_offset))
+}
+
+// start_blob_span starts span of the elliptics transfer of @size bytes
+func (f *File) start_blob_span(ctx context.Context, op string, meta *ebucket.BucketMeta, size int) trace.Span {
+	groups := make([]int, 0, len(meta.Groups))
+	for _, g := range meta.Groups {
+		groups = append(groups, int(g))
+	}
+
+	_, span := tracing.Start(ctx, "elliptics." + op,
+		attribute.String("bucket", meta.Name),
+		attribute.IntSlice("groups", groups),
+		attribute.String("key", f.Info.Key),
+		attribute.Int64("offset", f.remote_offset),
+		attribute.Int("size", size))
+	return span
+}
+
+// oplog writes structured record of the data operation which started at @offset and transferred @bytes
+func (f *File) oplog(op string, start time.Time, offset, bytes int64, err error) {
+	// end of file is the normal result of the sequential read
+	if err == io.EOF {
+		err = nil
+	}
+
+	f.User.oplog(op, start, reqlog.Fields {
+		"path": f.Info.Filename,
+		"owner": f.Info.Username,
+		"bucket": f.Info.Bucket,
+		"key": f.Info.Key,
+		"offset": offset,
+		"bytes": bytes,
+	}, err)
+}
+
+// PingBuckets checks that elliptics is reachable and there is at least one bucket which can accept data,
+// elliptics call itself can not be interrupted, context is only checked before it is started
+func (ctl *DbFS) PingBuckets(ctx context.Context) error {
+	bp := ctl.bucket_processor()
+	if bp == nil {
+		return fmt.Errorf("bucket processor is not initialized")
+	}
+	defer bp.release()
+
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	meta, err := bp.bp.GetBucket(1)
+	if err != nil {
+		return fmt.Errorf("could not get bucket: %v", err)
+	}
+	if meta == nil || len(meta.Groups) == 0 {
+		return fmt.Errorf("there are no available buckets")
+	}
+
+	return nil
+}
+
 func (f *File) ReadDataFrom(r io.Reader) (int64, error) {
-	bp := f.User.FS.bp
+	start := time.Now()
+	offset := f.remote_offset
+	ctx, span := f.start_span("ReadDataFrom")
+	n, err := f.read_data_from(ctx, r)
+	span.SetAttributes(attribute.Int64("bytes", n))
+	tracing.End(span, err)
+	f.oplog("write", start, offset, n, err)
+	return n, err
+}
+
+func (f *File) read_data_from(ctx context.Context, r io.Reader) (int64, error) {
+	bp := f.User.FS.bucket_processor()
 	if bp == nil {
 		return 0, fmt.Errorf("read_from: bucket processor is not initialized")
 	}
+	defer bp.release()
+
+	err := ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+
+	r = &ctx_reader {
+		ctx: ctx,
+		r: r,
+	}
 
 	if f.User.TotalSize == 0 {
-		return io.Copy(f, r)
+		// File implements io.ReaderFrom, copying into it directly would call ReadFrom again
+		return io.Copy(struct { io.Writer } { f }, r)
+	}
+
+	// the size of the upload is known in advance, overwritten data is released
+	if uint64(f.User.TotalSize) > f.Info.Fsize {
+		err := f.User.check_quota(f.Info.Username, uint64(f.User.TotalSize) - f.Info.Fsize, 0)
+		if err != nil {
+			return 0, err
+		}
 	}
 
 	session, err := elliptics.NewSession(bp.node)
@@ -92,8 +247,9 @@ func (f *File) ReadDataFrom(r io.Reader) (int64, error) {
 
 	var meta *ebucket.BucketMeta
 	if f.Info.Bucket == "" {
-		meta, err = bp.bp.GetBucket(uint64(f.User.TotalSize))
+		meta, err = bp.get_bucket(ctx, uint64(f.User.TotalSize))
 		if err != nil {
+			metrics.BlobError("get_bucket", "", nil)
 			return 0, fmt.Errorf("read_from: could not get bucket, username: %s, filename: %s, error: %v",
 				f.User.Username, f.Info.Filename, err)
 		}
@@ -102,7 +258,7 @@ func (f *File) ReadDataFrom(r io.Reader) (int64, error) {
 
 		f.Info.Bucket = meta.Name
 
-		f.Info.Key, err = GenerateRandomKey(f.User.Username)
+		f.Info.Key, err = GenerateRandomKey(f.Info.Username)
 		if err != nil {
 			return 0, fmt.Errorf("read_from: could not generate new key, " +
 				"bucket: %s, groups: %v, username: %s, filename: %s, error: %v",
@@ -110,8 +266,9 @@ func (f *File) ReadDataFrom(r io.Reader) (int64, error) {
 		}
 
 	} else {
-		meta, err = bp.bp.FindBucket(f.Info.Bucket)
+		meta, err = bp.find_bucket(ctx, f.Info.Bucket)
 		if err != nil {
+			metrics.BlobError("find_bucket", f.Info.Bucket, nil)
 			return 0, fmt.Errorf("read_from: could not find bucket: %s, username: %s, filename: %s, error: %v",
 				f.Info.Bucket, f.User.Username, f.Info.Filename, err)
 		}
@@ -122,8 +279,10 @@ func (f *File) ReadDataFrom(r io.Reader) (int64, error) {
 	var size uint64
 	write_error := fmt.Errorf("write error: empty result from session.WriteData()")
 
+	span := f.start_blob_span(ctx, "write", meta, int(f.User.TotalSize))
 	for ret := range session.WriteData(f.Info.Key, r, uint64(f.remote_offset), uint64(f.User.TotalSize)) {
 		if ret.Error() != nil {
+			metrics.BlobError("write", meta.Name, meta.Groups)
 			glog.Errorf("read_from: username: %s, bucket: %s, groups: %v, key: %s, filename: %s, " +
 				"remote_offset: %d, total_size: %d, write error: %v",
 				f.User.Username, f.Info.Bucket, meta.Groups, f.Info.Key, f.Info.Filename,
@@ -140,11 +299,8 @@ func (f *File) ReadDataFrom(r io.Reader) (int64, error) {
 		write_error = nil
 		size = ret.Info().Size
 
-		glog.Infof("read_from: username: %s, bucket: %s, groups: %v, key: %s, filename: %s, " +
-			"remote_offset: %d, size: %d/%d",
-			f.User.Username, f.Info.Bucket, meta.Groups, f.Info.Key, f.Info.Filename,
-			f.remote_offset, size, f.User.TotalSize)
 	}
+	tracing.End(span, write_error)
 
 	if write_error != nil {
 		return 0, fmt.Errorf("read_from: username: %s, bucket: %s, groups: %v, key: %s, filename: %s, " +
@@ -154,13 +310,14 @@ func (f *File) ReadDataFrom(r io.Reader) (int64, error) {
 	}
 
 	f.remote_offset += int64(size)
+	metrics.AddDataBytes("ReadDataFrom", int64(size))
 
 	if uint64(f.remote_offset) > f.Info.Fsize {
 		f.Info.Fsize = uint64(f.remote_offset)
 	}
 	f.Info.Modified = time.Now()
 
-	err = f.User.FS.UpdateEntry(f.Info)
+	err = f.User.FS.UpdateEntry(ctx, f.Info)
 	if err != nil {
 		return 0, fmt.Errorf("read_from: could not update dir entry: %s, error: %v", f.Info.String(), err)
 	}
@@ -169,10 +326,36 @@ func (f *File) ReadDataFrom(r io.Reader) (int64, error) {
 }
 
 func (f *File) WriteData(p []byte) (int, error) {
-	bp := f.User.FS.bp
+	start := time.Now()
+	offset := f.remote_offset
+	ctx, span := f.start_span("WriteData")
+	n, err := f.write_data(ctx, p)
+	span.SetAttributes(attribute.Int("bytes", n))
+	tracing.End(span, err)
+	f.oplog("write", start, offset, int64(n), err)
+	return n, err
+}
+
+func (f *File) write_data(ctx context.Context, p []byte) (int, error) {
+	bp := f.User.FS.bucket_processor()
 	if bp == nil {
 		return 0, fmt.Errorf("bucket processor is not initialized")
 	}
+	defer bp.release()
+
+	// every chunk of the upload is a separate write, nothing is sent once the request is cancelled
+	err := ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+
+	total_size := uint64(f.remote_offset) + uint64(len(p))
+	if total_size > f.Info.Fsize {
+		err = f.reserve_quota(total_size - f.Info.Fsize)
+		if err != nil {
+			return 0, err
+		}
+	}
 
 	session, err := elliptics.NewSession(bp.node)
 	if err != nil {
@@ -183,8 +366,9 @@ func (f *File) WriteData(p []byte) (int, error) {
 
 	var meta *ebucket.BucketMeta
 	if f.Info.Bucket == "" {
-		meta, err = bp.bp.GetBucket(uint64(len(p)))
+		meta, err = bp.get_bucket(ctx, uint64(len(p)))
 		if err != nil {
+			metrics.BlobError("get_bucket", "", nil)
 			return 0, fmt.Errorf("could not get bucket, username: %s, filename: %s, remote_offset: %d, size: %d, error: %v",
 				f.User.Username, f.Info.Filename, f.remote_offset, len(p), err)
 		}
@@ -193,7 +377,7 @@ func (f *File) WriteData(p []byte) (int, error) {
 
 		f.Info.Bucket = meta.Name
 
-		f.Info.Key, err = GenerateRandomKey(f.User.Username)
+		f.Info.Key, err = GenerateRandomKey(f.Info.Username)
 		if err != nil {
 			return 0, fmt.Errorf("could not generate new key, bucket: %s, groups: %v, username: %s, filename: %s, " +
 				"remote_offset: %d, size: %d, error: %v",
@@ -201,8 +385,9 @@ func (f *File) WriteData(p []byte) (int, error) {
 		}
 
 	} else {
-		meta, err = bp.bp.FindBucket(f.Info.Bucket)
+		meta, err = bp.find_bucket(ctx, f.Info.Bucket)
 		if err != nil {
+			metrics.BlobError("find_bucket", f.Info.Bucket, nil)
 			return 0, fmt.Errorf("could not find bucket: %s, username: %s, filename: %s, remote_offset: %d, size: %d, error: %v",
 				f.Info.Bucket, f.User.Username, f.Info.Filename, f.remote_offset, len(p), err)
 		}
@@ -210,17 +395,21 @@ func (f *File) WriteData(p []byte) (int, error) {
 		session.SetNamespace(meta.Name)
 	}
 
-	total_size := uint64(f.remote_offset) + uint64(len(p))
 	writer, err := elliptics.NewWriteSeeker(session, f.Info.Key, f.remote_offset, total_size, 0)
 	if err != nil {
+		metrics.BlobError("write", meta.Name, meta.Groups)
 		return 0, fmt.Errorf("could not create new writer, bucket: %s, key: %s, groups: %v, username: %s, filename: %s, " +
 			"remote_offset: %d, size: %d, error: %v",
 			meta.Name, f.Info.Key, meta.Groups, f.User.Username, f.Info.Filename, f.remote_offset, len(p), err)
 	}
 	defer writer.Free()
 
+	span := f.start_blob_span(ctx, "write", meta, len(p))
 	copied, err := writer.Write(p)
+	tracing.End(span, err)
+	metrics.AddDataBytes("WriteData", int64(copied))
 	if err != nil {
+		metrics.BlobError("write", meta.Name, meta.Groups)
 		return 0, fmt.Errorf("could not write data, bucket: %s, key: %s, groups: %v, username: %s, filename: %s, " +
 			"remote_offset: %d, size: %d, error: %v",
 			meta.Name, f.Info.Key, meta.Groups, f.User.Username, f.Info.Filename, f.remote_offset, len(p), err)
@@ -231,7 +420,7 @@ func (f *File) WriteData(p []byte) (int, error) {
 	}
 	f.Info.Modified = time.Now()
 
-	err = f.User.FS.UpdateEntry(f.Info)
+	err = f.User.FS.UpdateEntry(ctx, f.Info)
 	if err != nil {
 		return 0, fmt.Errorf("could not update dir entry, bucket: %s, key: %s, groups: %v, username: %s, filename: %s, " +
 			"remote_offset: %d, size: %d, error: %v",
@@ -244,10 +433,22 @@ func (f *File) WriteData(p []byte) (int, error) {
 }
 
 func (f *File) ReadData(p []byte) (int, error) {
-	bp := f.User.FS.bp
+	start := time.Now()
+	offset := f.remote_offset
+	ctx, span := f.start_span("ReadData")
+	n, err := f.read_data(ctx, p)
+	span.SetAttributes(attribute.Int("bytes", n))
+	tracing.End(span, err)
+	f.oplog("read", start, offset, int64(n), err)
+	return n, err
+}
+
+func (f *File) read_data(ctx context.Context, p []byte) (int, error) {
+	bp := f.User.FS.bucket_processor()
 	if bp == nil {
 		return 0, fmt.Errorf("bucket processor is not initialized")
 	}
+	defer bp.release()
 
 	if f.Info.Bucket == "" {
 		return 0, io.EOF
@@ -257,6 +458,11 @@ func (f *File) ReadData(p []byte) (int, error) {
 		return 0, io.EOF
 	}
 
+	err := ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+
 	session, err := elliptics.NewSession(bp.node)
 	if err != nil {
 		return 0, fmt.Errorf("could not create new session, username: %s, filename: %s, error: %v",
@@ -264,8 +470,9 @@ func (f *File) ReadData(p []byte) (int, error) {
 	}
 	defer session.Delete()
 
-	meta, err := bp.bp.FindBucket(f.Info.Bucket)
+	meta, err := bp.find_bucket(ctx, f.Info.Bucket)
 	if err != nil {
+		metrics.BlobError("find_bucket", f.Info.Bucket, nil)
 		return 0, fmt.Errorf("could not find bucket: %s, username: %s, filename: %s, remote_offset: %d, size: %d, error: %v",
 			f.Info.Bucket, f.User.Username, f.Info.Filename, f.remote_offset, len(p), err)
 	}
@@ -274,14 +481,19 @@ func (f *File) ReadData(p []byte) (int, error) {
 
 	reader, err := elliptics.NewReadSeekerOffsetSize(session, f.Info.Key, uint64(f.remote_offset), uint64(len(p)))
 	if err != nil {
+		metrics.BlobError("read", meta.Name, meta.Groups)
 		return 0, fmt.Errorf("could not create new reader, bucket: %s, key: %s, groups: %v, username: %s, filename: %s, " +
 			"remote_offset: %d, size: %d, error: %v",
 			meta.Name, f.Info.Key, meta.Groups, f.User.Username, f.Info.Filename, f.remote_offset, len(p), err)
 	}
 	defer reader.Free()
 
+	span := f.start_blob_span(ctx, "read", meta, len(p))
 	copied, err := reader.Read(p)
+	tracing.End(span, err)
+	metrics.AddDataBytes("ReadData", int64(copied))
 	if err != nil {
+		metrics.BlobError("read", meta.Name, meta.Groups)
 		return 0, fmt.Errorf("could not write data, bucket: %s, key: %s, groups: %v, username: %s, filename: %s, " +
 			"remote_offset: %d, size: %d, error: %v",
 			meta.Name, f.Info.Key, meta.Groups, f.User.Username, f.Info.Filename, f.remote_offset, len(p), err)
@@ -293,10 +505,25 @@ func (f *File) ReadData(p []byte) (int, error) {
 }
 
 func (f *File) RemoveData() error {
-	bp := f.User.FS.bp
+	start := time.Now()
+	ctx, span := f.start_span("RemoveData")
+	err := f.remove_data(ctx)
+	tracing.End(span, err)
+	f.oplog("remove_data", start, 0, 0, err)
+	return err
+}
+
+func (f *File) remove_data(ctx context.Context) error {
+	bp := f.User.FS.bucket_processor()
 	if bp == nil {
 		return fmt.Errorf("bucket processor is not initialized")
 	}
+	defer bp.release()
+
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
 
 	session, err := elliptics.NewSession(bp.node)
 	if err != nil {
@@ -305,21 +532,26 @@ func (f *File) RemoveData() error {
 	}
 	defer session.Delete()
 
-	meta, err := bp.bp.FindBucket(f.Info.Bucket)
+	meta, err := bp.find_bucket(ctx, f.Info.Bucket)
 	if err != nil {
+		metrics.BlobError("find_bucket", f.Info.Bucket, nil)
 		return fmt.Errorf("could not find bucket: %s, username: %s, filename: %s, error: %v",
 			f.Info.Bucket, f.User.Username, f.Info.Filename, err)
 	}
 	session.SetGroups(meta.Groups)
 	session.SetNamespace(meta.Name)
 
+	span := f.start_blob_span(ctx, "remove", meta, 0)
 	for ret := range session.Remove(f.Info.Key) {
 		if ret.Error() == nil {
-			return nil
+			err = nil
+			break
 		}
 
+		metrics.BlobError("remove", meta.Name, meta.Groups)
 		err = ret.Error()
 	}
+	tracing.End(span, err)
 
 	return err
 }
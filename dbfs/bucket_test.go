@@ -0,0 +1,32 @@
+package dbfs
+
+import (
+	"testing"
+)
+
+func TestBucketProcessorRefs(t *testing.T) {
+	ctl := &DbFS {
+		bp: &BucketProcessor { refs: 1 },
+	}
+
+	bp := ctl.bucket_processor()
+	other := ctl.bucket_processor()
+	if bp != other || bp.refs != 3 {
+		t.Fatalf("references: %d, want 3", bp.refs)
+	}
+
+	// processor has been replaced, in-flight operations still hold it
+	ctl.bp_lock.Lock()
+	ctl.bp = nil
+	ctl.bp_lock.Unlock()
+	bp.release()
+
+	other.release()
+	if bp.refs != 1 {
+		t.Errorf("references: %d after release, want 1", bp.refs)
+	}
+
+	if ctl.bucket_processor() != nil {
+		t.Errorf("processor has been returned after it was removed")
+	}
+}
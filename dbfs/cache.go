@@ -0,0 +1,295 @@
+package dbfs
+
+import (
+	"container/list"
+	"fmt"
+	"github.com/golang/glog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultCacheSize = 100000
+	DefaultCacheTTL = 60
+	cacheMaxDatagram = 8192
+	// message which drops all entries, unlike keys it does not contain zero byte
+	cacheFlushMessage = "flush"
+)
+
+type CacheCtl struct {
+	// maximum number of entries, negative value disables cache
+	Size		int			`json:"size"`
+	// entry lifetime in seconds
+	TTL		int			`json:"ttl"`
+	// udp address to receive invalidations from other instances,
+	// only messages sent from the addresses of the peers are accepted
+	Listen		string			`json:"listen"`
+	// udp addresses of other instances which must be notified about changes
+	Peers		[]string		`json:"peers"`
+}
+
+type cache_entry struct {
+	key		string
+	ent		DirEntry
+	expires		time.Time
+}
+
+type MetaCache struct {
+	sync.Mutex
+
+	entries		map[string]*list.Element
+	lru		*list.List
+	size		int
+	ttl		time.Duration
+
+	hits		uint64
+	misses		uint64
+
+	// incremented on every invalidation, entry read from the database is only stored
+	// if nothing has been invalidated since the read has started, otherwise it may be stale
+	gen		uint64
+
+	conn		*net.UDPConn
+	peers		[]*net.UDPAddr
+	// peers may send from any port, only their IP addresses are checked
+	peer_ips	map[string]bool
+}
+
+func cache_key(username, filename string) string {
+	return username + "\x00" + filename
+}
+
+func NewMetaCache(cc *CacheCtl) (*MetaCache, error) {
+	if cc == nil {
+		cc = &CacheCtl{}
+	}
+	if cc.Size < 0 {
+		return nil, nil
+	}
+
+	c := &MetaCache {
+		entries:	make(map[string]*list.Element),
+		lru:		list.New(),
+		size:		cc.Size,
+		ttl:		time.Duration(cc.TTL) * time.Second,
+		peer_ips:	make(map[string]bool),
+	}
+
+	if c.size == 0 {
+		c.size = DefaultCacheSize
+	}
+	if c.ttl == 0 {
+		c.ttl = DefaultCacheTTL * time.Second
+	}
+
+	for _, p := range cc.Peers {
+		addr, err := net.ResolveUDPAddr("udp", p)
+		if err != nil {
+			return nil, fmt.Errorf("could not resolve cache peer '%s': %v", p, err)
+		}
+
+		c.peers = append(c.peers, addr)
+		c.peer_ips[addr.IP.String()] = true
+	}
+
+	if cc.Listen != "" {
+		addr, err := net.ResolveUDPAddr("udp", cc.Listen)
+		if err != nil {
+			return nil, fmt.Errorf("could not resolve cache listen address '%s': %v", cc.Listen, err)
+		}
+
+		c.conn, err = net.ListenUDP("udp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("could not listen for cache invalidations on '%s': %v", cc.Listen, err)
+		}
+
+		go c.receive()
+	} else if len(c.peers) != 0 {
+		var err error
+		c.conn, err = net.ListenUDP("udp", nil)
+		if err != nil {
+			return nil, fmt.Errorf("could not create cache invalidation socket: %v", err)
+		}
+	}
+
+	return c, nil
+}
+
+func (c *MetaCache) Close() {
+	if c != nil && c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+func (c *MetaCache) Get(ent *DirEntry) bool {
+	if c == nil {
+		return false
+	}
+
+	key := cache_key(ent.Username, ent.Filename)
+
+	c.Lock()
+	defer c.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return false
+	}
+
+	ce := e.Value.(*cache_entry)
+	if time.Now().After(ce.expires) {
+		c.lru.Remove(e)
+		delete(c.entries, key)
+
+		atomic.AddUint64(&c.misses, 1)
+		return false
+	}
+
+	c.lru.MoveToFront(e)
+	*ent = ce.ent
+
+	atomic.AddUint64(&c.hits, 1)
+	return true
+}
+
+// Generation returns the value which must be passed to Put for the entry read from the database after this call
+func (c *MetaCache) Generation() uint64 {
+	if c == nil {
+		return 0
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	return c.gen
+}
+
+// Put stores the entry unless there were invalidations after the @gen has been obtained
+func (c *MetaCache) Put(ent *DirEntry, gen uint64) {
+	if c == nil {
+		return
+	}
+
+	key := cache_key(ent.Username, ent.Filename)
+
+	c.Lock()
+	defer c.Unlock()
+
+	if gen != c.gen {
+		return
+	}
+
+	if e, ok := c.entries[key]; ok {
+		ce := e.Value.(*cache_entry)
+		ce.ent = *ent
+		ce.expires = time.Now().Add(c.ttl)
+		c.lru.MoveToFront(e)
+		return
+	}
+
+	for c.lru.Len() >= c.size {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.entries, e.Value.(*cache_entry).key)
+	}
+
+	c.entries[key] = c.lru.PushFront(&cache_entry {
+		key:		key,
+		ent:		*ent,
+		expires:	time.Now().Add(c.ttl),
+	})
+}
+
+func (c *MetaCache) remove(key string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.gen++
+	if e, ok := c.entries[key]; ok {
+		c.lru.Remove(e)
+		delete(c.entries, key)
+	}
+}
+
+// Invalidate drops the entry from the local cache and notifies all configured peers
+func (c *MetaCache) Invalidate(username, filename string) {
+	if c == nil {
+		return
+	}
+
+	key := cache_key(username, filename)
+	c.remove(key)
+	c.notify(key, fmt.Sprintf("invalidation of username: %s, filename: %s", username, filename))
+}
+
+func (c *MetaCache) notify(msg, what string) {
+	for _, addr := range c.peers {
+		_, err := c.conn.WriteToUDP([]byte(msg), addr)
+		if err != nil {
+			glog.Errorf("cache: could not send %s to peer %s: %v", what, addr.String(), err)
+		}
+	}
+}
+
+func (c *MetaCache) flush() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.gen++
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+// Flush drops all entries from the local cache and tells all configured peers to do the same
+func (c *MetaCache) Flush() {
+	if c == nil {
+		return
+	}
+
+	c.flush()
+	c.notify(cacheFlushMessage, "flush")
+}
+
+func (c *MetaCache) Stats() (hits, misses uint64) {
+	if c == nil {
+		return 0, 0
+	}
+
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
+
+func (c *MetaCache) receive() {
+	buf := make([]byte, cacheMaxDatagram)
+	for {
+		n, addr, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			if strings.Contains(err.Error(), "use of closed network connection") {
+				return
+			}
+
+			glog.Errorf("cache: could not read invalidation: %v", err)
+			continue
+		}
+
+		if !c.peer_ips[addr.IP.String()] {
+			glog.Errorf("cache: dropping invalidation message from %s which is not a configured peer", addr.String())
+			continue
+		}
+
+		key := string(buf[:n])
+		if key == cacheFlushMessage {
+			c.flush()
+			continue
+		}
+		if !strings.Contains(key, "\x00") {
+			glog.Errorf("cache: invalid invalidation message from %s", addr.String())
+			continue
+		}
+
+		c.remove(key)
+	}
+}
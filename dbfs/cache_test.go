@@ -0,0 +1,168 @@
+package dbfs
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func new_test_cache(t *testing.T, size int) *MetaCache {
+	c, err := NewMetaCache(&CacheCtl { Size: size })
+	if err != nil {
+		t.Fatalf("could not create cache: %v", err)
+	}
+	return c
+}
+
+func TestCacheStalePut(t *testing.T) {
+	tests := []struct {
+		name		string
+		// called between reading the generation and storing the entry
+		between		func(c *MetaCache)
+		cached		bool
+	} {
+		{ "no invalidation", func(c *MetaCache) {}, true },
+		{ "same entry", func(c *MetaCache) { c.Invalidate("alice", "/file") }, false },
+		{ "other entry", func(c *MetaCache) { c.Invalidate("bob", "/other") }, false },
+		{ "flush", func(c *MetaCache) { c.Flush() }, false },
+	}
+
+	for _, test := range tests {
+		c := new_test_cache(t, 0)
+
+		gen := c.Generation()
+		test.between(c)
+		c.Put(&DirEntry { Username: "alice", Filename: "/file", Key: "key" }, gen)
+
+		ent := DirEntry { Username: "alice", Filename: "/file" }
+		if got := c.Get(&ent); got != test.cached {
+			t.Errorf("%s: entry cached: %v, want %v", test.name, got, test.cached)
+		}
+		if test.cached && ent.Key != "key" {
+			t.Errorf("%s: cached key is %q", test.name, ent.Key)
+		}
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	c := new_test_cache(t, 2)
+
+	for _, name := range []string { "/a", "/b" } {
+		c.Put(&DirEntry { Username: "alice", Filename: name }, c.Generation())
+	}
+
+	// /a becomes the most recently used entry, /b is evicted
+	if !c.Get(&DirEntry { Username: "alice", Filename: "/a" }) {
+		t.Fatalf("/a is not cached")
+	}
+	c.Put(&DirEntry { Username: "alice", Filename: "/c" }, c.Generation())
+
+	for name, cached := range map[string]bool { "/a": true, "/b": false, "/c": true } {
+		if got := c.Get(&DirEntry { Username: "alice", Filename: name }); got != cached {
+			t.Errorf("%s: cached: %v, want %v", name, got, cached)
+		}
+	}
+
+	hits, misses := c.Stats()
+	if hits != 3 || misses != 1 {
+		t.Errorf("hits: %d, misses: %d, want 3 and 1", hits, misses)
+	}
+}
+
+func TestCacheDisabled(t *testing.T) {
+	c := new_test_cache(t, -1)
+	if c != nil {
+		t.Fatalf("negative size must disable the cache")
+	}
+
+	c.Put(&DirEntry { Username: "alice", Filename: "/file" }, c.Generation())
+	if c.Get(&DirEntry { Username: "alice", Filename: "/file" }) {
+		t.Errorf("disabled cache returned an entry")
+	}
+}
+
+func wait_evicted(c *MetaCache, username, filename string) bool {
+	for i := 0; i < 200; i++ {
+		c.Lock()
+		_, ok := c.entries[cache_key(username, filename)]
+		c.Unlock()
+
+		if !ok {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return false
+}
+
+func send_from(t *testing.T, local string, to net.Addr, msg string) {
+	laddr, err := net.ResolveUDPAddr("udp", local)
+	if err != nil {
+		t.Fatalf("could not resolve %s: %v", local, err)
+	}
+
+	conn, err := net.DialUDP("udp", laddr, to.(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("could not connect from %s to %s: %v", local, to.String(), err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(msg))
+	if err != nil {
+		t.Fatalf("could not send message to %s: %v", to.String(), err)
+	}
+}
+
+func TestCachePeers(t *testing.T) {
+	c, err := NewMetaCache(&CacheCtl { Listen: "127.0.0.1:0", Peers: []string { "127.0.0.2:1" } })
+	if err != nil {
+		t.Fatalf("could not create cache: %v", err)
+	}
+	defer c.Close()
+
+	for _, name := range []string { "/a", "/b", "/c" } {
+		c.Put(&DirEntry { Username: "alice", Filename: name }, c.Generation())
+	}
+
+	// messages from unknown addresses are dropped, the message from the peer which follows them
+	// is used to find out when they have been processed
+	send_from(t, "127.0.0.1:0", c.conn.LocalAddr(), cacheFlushMessage)
+	send_from(t, "127.0.0.1:0", c.conn.LocalAddr(), cache_key("alice", "/a"))
+	send_from(t, "127.0.0.2:0", c.conn.LocalAddr(), cache_key("alice", "/b"))
+
+	if !wait_evicted(c, "alice", "/b") {
+		t.Fatalf("invalidation from the peer has not been applied")
+	}
+	for _, name := range []string { "/a", "/c" } {
+		if !c.Get(&DirEntry { Username: "alice", Filename: name }) {
+			t.Errorf("%s has been dropped by the message from unknown address", name)
+		}
+	}
+
+	send_from(t, "127.0.0.2:0", c.conn.LocalAddr(), cacheFlushMessage)
+	if !wait_evicted(c, "alice", "/a") || !wait_evicted(c, "alice", "/c") {
+		t.Errorf("flush from the peer has not been applied")
+	}
+}
+
+func TestCacheFlushBroadcast(t *testing.T) {
+	remote, err := NewMetaCache(&CacheCtl { Listen: "127.0.0.1:0", Peers: []string { "127.0.0.1:1" } })
+	if err != nil {
+		t.Fatalf("could not create remote cache: %v", err)
+	}
+	defer remote.Close()
+
+	local, err := NewMetaCache(&CacheCtl { Peers: []string { remote.conn.LocalAddr().String() } })
+	if err != nil {
+		t.Fatalf("could not create local cache: %v", err)
+	}
+	defer local.Close()
+
+	remote.Put(&DirEntry { Username: "alice", Filename: "/file" }, remote.Generation())
+	local.Flush()
+
+	if !wait_evicted(remote, "alice", "/file") {
+		t.Errorf("flush has not been sent to the peer")
+	}
+}
@@ -0,0 +1,66 @@
+package dbfs
+
+import (
+	"context"
+)
+
+// Identity describes the user on whose behalf the namespace is accessed
+type Identity struct {
+	Username string
+	// groups the user belongs to, folders shared with these groups are mounted under /Shared
+	Groups []string
+}
+
+type ctx_key int
+
+const (
+	identity_key ctx_key = iota
+	upload_size_key
+)
+
+// NewContext returns context which carries identity of the user,
+// filesystem methods called with this context serve the namespace of this user
+func NewContext(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identity_key, id)
+}
+
+func FromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(identity_key).(*Identity)
+	return id, ok
+}
+
+// NewUploadContext returns context which carries size of the data uploaded by the request,
+// when it is known in advance quota is checked once and the data is streamed into elliptics in one write,
+// negative size (like http.Request.ContentLength of the chunked upload) means it is not known
+func NewUploadContext(ctx context.Context, size int64) context.Context {
+	return context.WithValue(ctx, upload_size_key, size)
+}
+
+func upload_size(ctx context.Context) (int64, bool) {
+	size, ok := ctx.Value(upload_size_key).(int64)
+	return size, ok
+}
+
+// bind returns copy of the namespace which serves the request of @ctx,
+// identity stored in @ctx is only used if the namespace has been created neither for a particular user nor for a share,
+// upload size stored in @ctx overrides the one set in the namespace, unknown size is always stored as 0
+func (ctl *DbFSUser) bind(ctx context.Context) *DbFSUser {
+	u := *ctl
+	u.ctx = ctx
+
+	if u.Username == "" && u.Root == nil {
+		if id, ok := FromContext(ctx); ok {
+			u.Username = id.Username
+			u.Groups = id.Groups
+		}
+	}
+
+	if size, ok := upload_size(ctx); ok {
+		u.TotalSize = size
+	}
+	if u.TotalSize < 0 {
+		u.TotalSize = 0
+	}
+
+	return &u
+}
@@ -0,0 +1,50 @@
+package dbfs
+
+import (
+	"context"
+	"testing"
+)
+
+func TestBind(t *testing.T) {
+	id := &Identity {
+		Username: "alice",
+		Groups: []string { "staff" },
+	}
+	link := &Share {
+		Owner: "bob",
+		Path: "/pub",
+	}
+
+	tests := []struct {
+		name		string
+		ns		DbFSUser
+		ctx		context.Context
+		username	string
+		total_size	int64
+	} {
+		{ "identity from context", DbFSUser {}, NewContext(context.Background(), id), "alice", 0 },
+		{ "namespace of the user", DbFSUser { Username: "bob" }, NewContext(context.Background(), id), "bob", 0 },
+		{ "namespace of the link", DbFSUser { Root: link }, NewContext(context.Background(), id), "", 0 },
+		{ "known upload size", DbFSUser {}, NewUploadContext(context.Background(), 100), "", 100 },
+		{ "empty upload", DbFSUser { TotalSize: 100 }, NewUploadContext(context.Background(), 0), "", 0 },
+		{ "chunked upload", DbFSUser {}, NewUploadContext(context.Background(), -1), "", 0 },
+		{ "chunked upload without context", DbFSUser { TotalSize: -1 }, context.Background(), "", 0 },
+		{ "size of the namespace", DbFSUser { TotalSize: 100 }, context.Background(), "", 100 },
+	}
+
+	for _, test := range tests {
+		u := test.ns.bind(test.ctx)
+		if u.Username != test.username {
+			t.Errorf("%s: username: %q, want %q", test.name, u.Username, test.username)
+		}
+		if u.TotalSize != test.total_size {
+			t.Errorf("%s: total size: %d, want %d", test.name, u.TotalSize, test.total_size)
+		}
+		if u.context() != test.ctx {
+			t.Errorf("%s: namespace is not bound to the context", test.name)
+		}
+		if test.ns.ctx != nil {
+			t.Errorf("%s: original namespace has been modified", test.name)
+		}
+	}
+}
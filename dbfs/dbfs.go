@@ -3,25 +3,40 @@ package dbfs
 import (
 	_ "github.com/go-sql-driver/mysql"
 
+	"context"
 	"database/sql"
 	"fmt"
+	"github.com/bioothod/wd2/metrics"
+	"github.com/bioothod/wd2/tracing"
+	"go.opentelemetry.io/otel/attribute"
 	"os"
+	"sync"
 	"time"
 )
 
 type DbFS struct {
 	db		*sql.DB
+	// bucket processor is replaced when ebucket config is reloaded
+	bp_lock		sync.RWMutex
 	bp		*BucketProcessor
+	cache		*MetaCache
 }
 
-func NewDbFS(dbtype, dbparams string, e *EbucketCtl) (*DbFS, error) {
+func NewDbFS(dbtype, dbparams string, e *EbucketCtl, cc *CacheCtl) (*DbFS, error) {
 	db, err := sql.Open(dbtype, dbparams)
 	if err != nil {
 		return nil, fmt.Errorf("could not open db: %s, params: %s: %v", dbtype, dbparams, err)
 	}
 
+	cache, err := NewMetaCache(cc)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not create metadata cache: %v", err)
+	}
+
 	bp, err := NewBucketProcessor(e)
 	if err != nil {
+		cache.Close()
 		db.Close()
 		return nil, fmt.Errorf("could not create bucket processor: %v", err)
 	}
@@ -29,6 +44,7 @@ func NewDbFS(dbtype, dbparams string, e *EbucketCtl) (*DbFS, error) {
 	ctl := &DbFS {
 		db:		db,
 		bp:		bp,
+		cache:		cache,
 	}
 
 	return ctl, nil
@@ -48,13 +64,61 @@ func NewDbFSWithoutBucket(dbtype, dbparams string) (*DbFS, error) {
 }
 
 func (ctl *DbFS) Close() {
+	ctl.cache.Close()
 	ctl.db.Close()
-	ctl.bp.Close()
+
+	ctl.bp_lock.Lock()
+	bp := ctl.bp
+	ctl.bp = nil
+	ctl.bp_lock.Unlock()
+
+	bp.release()
+}
+
+// bucket_processor returns current bucket processor or nil if there is none,
+// returned processor must be released when the operation which uses it has completed
+func (ctl *DbFS) bucket_processor() *BucketProcessor {
+	ctl.bp_lock.RLock()
+	defer ctl.bp_lock.RUnlock()
+
+	if ctl.bp != nil {
+		ctl.bp.acquire()
+	}
+	return ctl.bp
+}
+
+// ReloadBuckets creates new bucket processor with the given config and replaces the current one,
+// old processor is closed when data operations which use it have completed
+func (ctl *DbFS) ReloadBuckets(e *EbucketCtl) error {
+	bp, err := NewBucketProcessor(e)
+	if err != nil {
+		return fmt.Errorf("could not create bucket processor: %v", err)
+	}
+
+	ctl.bp_lock.Lock()
+	old := ctl.bp
+	ctl.bp = bp
+	ctl.bp_lock.Unlock()
+
+	old.release()
+	return nil
+}
+
+// CacheStats returns number of metadata cache hits and misses, both are zero if the cache is disabled
+func (ctl *DbFS) CacheStats() (hits, misses uint64) {
+	return ctl.cache.Stats()
 }
 
+// maximum length of the single path component, matches `name` column size
+const MaxNameLength = 255
+
+// all columns of the `dirs` table in the order scan_entry() expects them
+const dirsColumns = "username,filename,name,parent,bucket,rkey,mode,size,created,modified,target"
+
 type DirEntry struct {
 	Username		string
 	Filename		string
+	Fname			string
 	Parent			string
 	Bucket			string
 	Key			string
@@ -62,19 +126,57 @@ type DirEntry struct {
 	Fsize			uint64
 	Created			time.Time
 	Modified		time.Time
+	// symbolic link target, empty for other entries
+	Target			string
 }
 
 func (ent *DirEntry) String() string {
-	return fmt.Sprintf("username: %s, filename: %s, parent: %s, bucket: %s, key: %s, mode: %o, size: %d, created: '%s', modified: '%s'",
-		ent.Username, ent.Filename, ent.Parent, ent.Bucket, ent.Key, ent.Fmode, ent.Fsize, ent.Created.String(), ent.Modified.String())
+	return fmt.Sprintf("username: %s, filename: %s, name: %s, parent: %s, bucket: %s, key: %s, mode: %o, size: %d, created: '%s', modified: '%s', target: '%s'",
+		ent.Username, ent.Filename, ent.Fname, ent.Parent, ent.Bucket, ent.Key, ent.Fmode, ent.Fsize, ent.Created.String(), ent.Modified.String(),
+		ent.Target)
+}
+
+// ChildrenKey returns the value stored in the `parent` column of every child of this directory
+func (ent *DirEntry) ChildrenKey() string {
+	if ent.Filename == "/" {
+		return "/"
+	}
+
+	return ent.Key
 }
 
-func (ctl *DbFS) InsertEntry(ent *DirEntry) error {
+type row_scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scan_entry(rows row_scanner, ent *DirEntry) error {
+	return rows.Scan(&ent.Username, &ent.Filename, &ent.Fname, &ent.Parent, &ent.Bucket, &ent.Key,
+		&ent.Fmode, &ent.Fsize, &ent.Created, &ent.Modified, &ent.Target)
+}
+
+// start_query starts span of the database query @method which is a child of the span in @ctx,
+// returned function ends the span and records query latency, it is supposed to be deferred
+func start_query(ctx context.Context, method string) func() {
+	start := time.Now()
+	_, span := tracing.Start(ctx, "dbfs." + method, attribute.String("db.system", "mysql"))
+
+	return func() {
+		span.End()
+		metrics.ObserveQuery(method, start)
+	}
+}
+
+func (ctl *DbFS) InsertEntry(ctx context.Context, ent *DirEntry) error {
+	end := start_query(ctx, "InsertEntry")
+	defer end()
+
 	ent.Created = time.Now()
 	ent.Modified = ent.Created
 
-	_, err := ctl.db.Exec("INSERT INTO dirs SET username=?,filename=?,parent=?,bucket=?,rkey=?,mode=?,size=?,created=?,modified=?",
-		ent.Username, ent.Filename, ent.Parent, ent.Bucket, ent.Key, ent.Fmode, ent.Fsize, ent.Created, ent.Modified)
+	_, err := ctl.db.ExecContext(ctx, "INSERT INTO dirs SET username=?,filename=?,name=?,parent=?,bucket=?,rkey=?,mode=?,size=?,created=?,modified=?,target=?",
+		ent.Username, ent.Filename, ent.Fname, ent.Parent, ent.Bucket, ent.Key, ent.Fmode, ent.Fsize, ent.Created, ent.Modified,
+		ent.Target)
+	ctl.cache.Invalidate(ent.Username, ent.Filename)
 	if err != nil {
 		return fmt.Errorf("could not insert new dir entry: %s: %v", ent.String(), err)
 	}
@@ -82,8 +184,12 @@ func (ctl *DbFS) InsertEntry(ent *DirEntry) error {
 	return nil
 }
 
-func (ctl *DbFS) DeleteEntry(ent *DirEntry) error {
-	_, err := ctl.db.Exec("DELETE FROM dirs WHERE username=? AND filename=?", ent.Username, ent.Filename)
+func (ctl *DbFS) DeleteEntry(ctx context.Context, ent *DirEntry) error {
+	end := start_query(ctx, "DeleteEntry")
+	defer end()
+
+	_, err := ctl.db.ExecContext(ctx, "DELETE FROM dirs WHERE username=? AND filename=?", ent.Username, ent.Filename)
+	ctl.cache.Invalidate(ent.Username, ent.Filename)
 	if err != nil {
 		return fmt.Errorf("could not delete dir entry: %s: %v", ent.String(), err)
 	}
@@ -91,21 +197,28 @@ func (ctl *DbFS) DeleteEntry(ent *DirEntry) error {
 	return nil
 }
 
-func (ctl *DbFS) StatEntry(ent *DirEntry) error {
-	rows, err := ctl.db.Query("SELECT * FROM dirs WHERE username=? AND filename=?", ent.Username, ent.Filename)
+func (ctl *DbFS) StatEntry(ctx context.Context, ent *DirEntry) error {
+	gen := ctl.cache.Generation()
+	if ctl.cache.Get(ent) {
+		return nil
+	}
+
+	end := start_query(ctx, "StatEntry")
+	defer end()
+
+	rows, err := ctl.db.QueryContext(ctx, "SELECT " + dirsColumns + " FROM dirs WHERE username=? AND filename=?", ent.Username, ent.Filename)
 	if err != nil {
 		return fmt.Errorf("could not read userinfo for user: %s: %v", ent.Username, err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var username, filename string
-
-		err = rows.Scan(&username, &filename, &ent.Parent, &ent.Bucket, &ent.Key, &ent.Fmode, &ent.Fsize, &ent.Created, &ent.Modified)
+		err = scan_entry(rows, ent)
 		if err != nil {
 			return fmt.Errorf("database schema mismatch: %v", err)
 		}
 
+		ctl.cache.Put(ent, gen)
 		return nil
 	}
 
@@ -117,19 +230,25 @@ func (ctl *DbFS) StatEntry(ent *DirEntry) error {
 	return fmt.Errorf("there is no entry %s", ent.String())
 }
 
-func (ctl *DbFS) ScanEntryPrefix(ent *DirEntry) ([]*DirEntry, error) {
-	rows, err := ctl.db.Query("SELECT * FROM dirs WHERE username=? AND parent=? AND filename like ?",
-		ent.Username, ent.Parent, ent.Filename)
+// ScanEntryChildren returns at most @limit children of directory @dir whose names are strictly greater than @after,
+// entries are sorted by name, so the last returned name can be used as @after for the next page
+func (ctl *DbFS) ScanEntryChildren(ctx context.Context, dir *DirEntry, after string, limit int) ([]*DirEntry, error) {
+	end := start_query(ctx, "ScanEntryChildren")
+	defer end()
+
+	rows, err := ctl.db.QueryContext(ctx, "SELECT " + dirsColumns + " FROM dirs WHERE username=? AND parent=? AND name > ? " +
+		"ORDER BY name LIMIT ?",
+		dir.Username, dir.ChildrenKey(), after, limit)
 	if err != nil {
-		return nil, fmt.Errorf("could not read userinfo for user: %s: %v", ent.Username, err)
+		return nil, fmt.Errorf("could not read children of %s: %v", dir.String(), err)
 	}
 	defer rows.Close()
 
-	entries := make([]*DirEntry, 0)
+	entries := make([]*DirEntry, 0, limit)
 	for rows.Next() {
 		var e DirEntry
 
-		err = rows.Scan(&e.Username, &e.Filename, &e.Parent, &e.Bucket, &e.Key, &e.Fmode, &e.Fsize, &e.Created, &e.Modified)
+		err = scan_entry(rows, &e)
 		if err != nil {
 			return nil, fmt.Errorf("database schema mismatch: %v", err)
 		}
@@ -145,10 +264,14 @@ func (ctl *DbFS) ScanEntryPrefix(ent *DirEntry) ([]*DirEntry, error) {
 	return entries, nil
 }
 
-func (ctl *DbFS) UpdateEntry(ent *DirEntry) error {
-	_, err := ctl.db.Exec("UPDATE dirs SET mode=?,size=?,modified=?,bucket=?,rkey=? WHERE username=? AND filename=?",
-		ent.Fmode, ent.Fsize, ent.Modified, ent.Bucket, ent.Key,
+func (ctl *DbFS) UpdateEntry(ctx context.Context, ent *DirEntry) error {
+	end := start_query(ctx, "UpdateEntry")
+	defer end()
+
+	_, err := ctl.db.ExecContext(ctx, "UPDATE dirs SET mode=?,size=?,modified=?,bucket=?,rkey=?,target=? WHERE username=? AND filename=?",
+		ent.Fmode, ent.Fsize, ent.Modified, ent.Bucket, ent.Key, ent.Target,
 		ent.Username, ent.Filename)
+	ctl.cache.Invalidate(ent.Username, ent.Filename)
 	if err != nil {
 		return fmt.Errorf("could not update entry: %s: %v", ent.String(), err)
 	}
@@ -156,6 +279,23 @@ func (ctl *DbFS) UpdateEntry(ent *DirEntry) error {
 	return nil
 }
 
-func (ctl *DbFS) Ping() error {
-	return ctl.db.Ping()
+// MoveEntry changes filename, name and parent key of the entry, everything else including key and creation time is preserved
+func (ctl *DbFS) MoveEntry(ctx context.Context, ent *DirEntry, filename, name, parent string) error {
+	end := start_query(ctx, "MoveEntry")
+	defer end()
+
+	_, err := ctl.db.ExecContext(ctx, "UPDATE dirs SET filename=?,name=?,parent=? WHERE username=? AND filename=?",
+		filename, name, parent,
+		ent.Username, ent.Filename)
+	ctl.cache.Invalidate(ent.Username, ent.Filename)
+	ctl.cache.Invalidate(ent.Username, filename)
+	if err != nil {
+		return fmt.Errorf("could not move entry: %s -> %s: %v", ent.String(), filename, err)
+	}
+
+	return nil
+}
+
+func (ctl *DbFS) Ping(ctx context.Context) error {
+	return ctl.db.PingContext(ctx)
 }
@@ -1,18 +1,35 @@
 package dbfs
 
 import (
-	"fmt"
 	"github.com/golang/glog"
 	"io"
 	"os"
-	"path"
 )
 
+const ReaddirBatch = 1024
+
 type File struct {
 	User *DbFSUser
 	Info *DirEntry
+	// symbolic link which has been followed to open this file
+	Link *DirEntry
+	// share which granted access to this file, nil if it belongs to the user
+	Share *Share
+
+	// /Shared directory or one of its owner subdirectories
+	virtual bool
+	virtual_listed bool
 
 	remote_offset int64
+
+	// last name returned by Readdir, next page starts right after it
+	dir_cursor string
+	dir_eof bool
+
+	// bytes the owner of the file may still write, only valid if the quota has been read and it limits data
+	quota_read bool
+	quota_limited bool
+	quota_left uint64
 }
 
 func (f *File) Close() error {
@@ -20,11 +37,15 @@ func (f *File) Close() error {
 }
 
 func (f *File) Read(p []byte) (n int, err error) {
-	glog.Infof("read: %v, data_size: %d", f.Info.String(), len(p))
 	if f.Info.IsDir() {
 		return 0, os.ErrInvalid
 	}
 
+	err = f.User.CheckAccess(f.Info, PermRead)
+	if err != nil {
+		return 0, err
+	}
+
 	return f.ReadData(p)
 }
 
@@ -46,26 +67,38 @@ func (f *File) Seek(offset int64, whence int) (int64, error) {
 
 	f.remote_offset = npos
 
+	if f.Info.IsDir() && npos == 0 {
+		f.dir_cursor = ""
+		f.dir_eof = false
+		f.virtual_listed = false
+	}
+
 	return f.remote_offset, nil
 }
 
 func (f *File) Write(p []byte) (n int, err error) {
-	glog.Infof("write: %v, data_size: %d", f.Info.String(), len(p))
-
 	if f.Info.IsDir() {
 		return 0, os.ErrInvalid
 	}
 
+	err = f.check_write()
+	if err != nil {
+		return 0, err
+	}
+
 	return f.WriteData(p)
 }
 
 func (f *File) ReadFrom(r io.Reader) (int64, error) {
-	glog.Infof("read_from: %v", f.Info.String())
-
 	if f.Info.IsDir() {
 		return 0, os.ErrInvalid
 	}
 
+	err := f.check_write()
+	if err != nil {
+		return 0, err
+	}
+
 	return f.ReadDataFrom(r)
 }
 
@@ -74,39 +107,98 @@ func (f *File) Readdir(count int) ([]os.FileInfo, error) {
 		return nil, os.ErrInvalid
 	}
 
-	ent, err := f.User.NewDirEntry(f.Info.Username, fmt.Sprintf("%s/%%", f.Info.Filename))
+	err := f.User.CheckAccess(f.Info, PermRead)
 	if err != nil {
-		glog.Errorf("readdir: username: %s, filename: %s: could not create new entry: %v", ent.Username, ent.Filename, err)
 		return nil, err
 	}
 
-	fi, err := f.User.FS.ScanEntryPrefix(ent)
-	if err != nil {
-		glog.Errorf("readdir: %s, error: %v", ent.String(), err)
-		return nil, err
+	return f.readdir(count)
+}
+
+func (f *File) readdir(count int) ([]os.FileInfo, error) {
+	if !f.Info.IsDir() {
+		return nil, os.ErrInvalid
+	}
+
+	if f.virtual {
+		return f.readdir_virtual(count)
+	}
+
+	ret := make([]os.FileInfo, 0)
+	for !f.dir_eof && (count <= 0 || len(ret) < count) {
+		limit := ReaddirBatch
+		if count > 0 && count - len(ret) < limit {
+			limit = count - len(ret)
+		}
+
+		fi, err := f.User.FS.ScanEntryChildren(f.User.context(), f.Info, f.dir_cursor, limit)
+		if err != nil {
+			glog.Errorf("readdir: %s, cursor: '%s', error: %v", f.Info.String(), f.dir_cursor, err)
+			return nil, err
+		}
+		glog.Infof("readdir: %s, cursor: '%s', limit: %d, entries: %d", f.Info.String(), f.dir_cursor, limit, len(fi))
+
+		if len(fi) < limit {
+			f.dir_eof = true
+		}
+
+		for _, e := range fi {
+			f.dir_cursor = e.Fname
+			ret = append(ret, e)
+		}
+	}
+
+	// /Shared is not stored in the database, it is listed after all real entries of the user's root directory,
+	// unless the user has real /Shared directory which has already been listed
+	if f.dir_eof && !f.virtual_listed && (count <= 0 || len(ret) < count) &&
+			f.Info.Filename == "/" && f.Info.Username == f.User.Username && f.Share == nil {
+		f.virtual_listed = true
+
+		if f.User.has_shares() && !f.User.real_shared() {
+			ret = append(ret, f.User.virtual_dir(SharedRoot))
+		}
 	}
-	glog.Infof("readdir: %s, entries: %d", ent.String(), len(fi))
 
-	if f.remote_offset > int64(len(fi)) {
+	if count > 0 && len(ret) == 0 {
 		return nil, io.EOF
 	}
 
+	return ret, nil
+}
+
+func (f *File) readdir_virtual(count int) ([]os.FileInfo, error) {
+	entries, err := f.User.virtual_entries(f.Info)
+	if err != nil {
+		glog.Errorf("readdir: %s, error: %v", f.Info.String(), err)
+		return nil, err
+	}
+
 	o := int(f.remote_offset)
-	lret := int(int64(len(fi)) - f.remote_offset)
-	if count > 0 && lret > count {
-		lret = count
+	if o > len(entries) {
+		o = len(entries)
 	}
+	entries = entries[o:]
+
+	if count > 0 {
+		if len(entries) == 0 {
+			return nil, io.EOF
+		}
+		if len(entries) > count {
+			entries = entries[:count]
+		}
+	}
+
+	f.remote_offset += int64(len(entries))
 
-	f.remote_offset += int64(lret)
-	ret := make([]os.FileInfo, 0, lret)
-	for i := 0; i < lret; i++ {
-		_, file := path.Split(fi[o + i].Filename)
-		fi[o + i].Filename = file
-		ret = append(ret, fi[o + i])
+	ret := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		ret = append(ret, e)
 	}
 	return ret, nil
 }
 
+// Stat returns entry this file has been opened for, its filename belongs to the owner's namespace,
+// which differs from the requested path when the file is shared
 func (f *File) Stat() (os.FileInfo, error) {
-	return f.User.Stat(f.Info.Filename)
+	return f.Info, nil
 }
@@ -0,0 +1,37 @@
+package dbfs
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+// empty uploads never reach elliptics or the database, whatever is the size announced by the client
+func TestReadFromEmpty(t *testing.T) {
+	fs := &DbFS {
+		bp: &BucketProcessor {},
+	}
+
+	for _, size := range []int64 { 0, -1 } {
+		u := (&DbFSUser {
+			FS: fs,
+			Username: "alice",
+		}).bind(NewUploadContext(context.Background(), size))
+
+		f := &File {
+			User: u,
+			Info: &DirEntry {
+				Username: "alice",
+				Filename: "/empty",
+				Fmode: 0644,
+			},
+		}
+
+		// reader without io.WriterTo, like the request body wrapped by the access log
+		n, err := f.ReadFrom(struct { io.Reader } { strings.NewReader("") })
+		if err != nil || n != 0 {
+			t.Errorf("size: %d: ReadFrom() = %d, %v, want 0, nil", size, n, err)
+		}
+	}
+}
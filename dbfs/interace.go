@@ -1,7 +1,9 @@
 package dbfs
 
 import (
+	"context"
 	"fmt"
+	"github.com/bioothod/wd2/reqlog"
 	"github.com/golang/glog"
 	"golang.org/x/net/webdav"
 	"os"
@@ -13,26 +15,59 @@ import (
 type DbFSUser struct {
 	FS *DbFS
 	Username string
+	// groups the user belongs to, folders shared with these groups are mounted under /Shared
+	Groups []string
+	// when set, the whole namespace is confined to this share, used to serve public links
+	Root *Share
+	// size of the upload if it is known in advance, 0 otherwise
 	TotalSize int64
+
+	// context passed to the filesystem method which has created this copy of the namespace,
+	// queries and blob transfers are aborted once it is done,
+	// operation logs carry its request id and spans are its children
+	ctx context.Context
+}
+
+func (ctl *DbFSUser) context() context.Context {
+	if ctl.ctx == nil {
+		return context.Background()
+	}
+	return ctl.ctx
+}
+
+// oplog writes structured record of the completed operation started at @start
+func (ctl *DbFSUser) oplog(op string, start time.Time, fields reqlog.Fields, err error) {
+	fields["op"] = op
+	fields["user"] = ctl.Username
+	fields["duration_ms"] = reqlog.Duration(start)
+	if err != nil {
+		fields["error"] = err.Error()
+	}
+
+	reqlog.Log(ctl.context(), "op", fields)
 }
 
 func NewDirEntryNil(username, filename string) *DirEntry {
-	name := path.Clean(filename)
-	parent_full := path.Clean(path.Dir(name))
+	name := path.Clean("/" + filename)
 
-	if parent_full == "" {
-		parent_full = "/"
+	// root directory has neither parent nor name, so it never shows up among its own children
+	if name == "/" {
+		return &DirEntry {
+			Filename: name,
+			Username: username,
+		}
 	}
 
 	return &DirEntry {
 		Filename: name,
-		Parent: parent_full,
+		Fname: path.Base(name),
+		Parent: path.Dir(name),
 		Username: username,
 	}
 }
 
 func (ctl *DbFSUser) ReadParentKey(username, parent string) (string, error) {
-	if parent == "/" {
+	if parent == "/" || parent == "" {
 		return parent, nil
 	}
 
@@ -40,7 +75,7 @@ func (ctl *DbFSUser) ReadParentKey(username, parent string) (string, error) {
 		Username: username,
 		Filename: parent,
 	}
-	err := ctl.FS.StatEntry(pent)
+	err := ctl.FS.StatEntry(ctl.context(), pent)
 	if err != nil {
 		return "", fmt.Errorf("ReadParentKey: username: %s, filename: %s: could not stat parent: %v",
 			pent.Username, pent.Filename, err)
@@ -52,6 +87,11 @@ func (ctl *DbFSUser) ReadParentKey(username, parent string) (string, error) {
 func (ctl *DbFSUser) NewDirEntry(username, filename string) (*DirEntry, error) {
 	ent := NewDirEntryNil(username, filename)
 
+	if len(ent.Fname) > MaxNameLength {
+		return nil, fmt.Errorf("NewDirEntry: username: %s, filename: %s: name is longer than %d bytes",
+			ent.Username, ent.Filename, MaxNameLength)
+	}
+
 	var err error
 	ent.Parent, err = ctl.ReadParentKey(ent.Username, ent.Parent)
 	if err != nil {
@@ -61,21 +101,53 @@ func (ctl *DbFSUser) NewDirEntry(username, filename string) (*DirEntry, error) {
 	return ent, nil
 }
 
-func (ctl *DbFSUser) Mkdir(name string, perm os.FileMode) error {
-	ent, err := ctl.NewDirEntry(ctl.Username, name)
+func (ctl *DbFSUser) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	ctl = ctl.bind(ctx)
+	start := time.Now()
+	err := ctl.mkdir(name, perm)
+	ctl.oplog("mkdir", start, reqlog.Fields { "path": name, "mode": perm.String() }, err)
+	return err
+}
+
+func (ctl *DbFSUser) mkdir(name string, perm os.FileMode) error {
+	t, err := ctl.resolve(name, false)
+	if err != nil {
+		glog.Errorf("mkdir: username: %s, filename: %s: could not resolve path: %v", ctl.Username, name, err)
+		return err
+	}
+
+	if !t.writable() {
+		return os.ErrPermission
+	}
+
+	ent, err := ctl.NewDirEntry(t.owner, t.name)
+	if err != nil {
+		glog.Errorf("mkdir: username: %s, filename: %s: could not create new entry: %v", ctl.Username, name, err)
+		return err
+	}
+
+	if t.share_root(ent) {
+		return os.ErrPermission
+	}
+
+	err = ctl.CheckParentAccess(ent, PermWrite | PermExec)
+	if err != nil {
+		return err
+	}
+
+	err = ctl.check_quota(t.owner, 0, 1)
 	if err != nil {
-		glog.Errorf("mkdir: %s: could not create new entry: %v", ent.String(), err)
 		return err
 	}
 
 	ent.Fmode = perm.Perm() | os.ModeDir
-	ent.Key, err = GenerateRandomKey(ctl.Username)
+	ent.Key, err = GenerateRandomKey(t.owner)
 	if err != nil {
 		glog.Errorf("mkdir: %s: could not generate key: %v", ent.String(), err)
 		return err
 	}
 
-	err = ctl.FS.InsertEntry(ent)
+	err = ctl.FS.InsertEntry(ctl.context(), ent)
 	if err != nil {
 		glog.Errorf("mkdir: %s: could not insert new entry: %v", ent.String(), err)
 		return err
@@ -83,7 +155,9 @@ func (ctl *DbFSUser) Mkdir(name string, perm os.FileMode) error {
 	return nil
 }
 
-func (ctl *DbFSUser) OpenFile(name string, flags int, perm os.FileMode) (webdav.File, error) {
+func (ctl *DbFSUser) OpenFile(ctx context.Context, name string, flags int, perm os.FileMode) (webdav.File, error) {
+	ctl = ctl.bind(ctx)
+	start := time.Now()
 	flags_array := make([]string, 0)
 	if (flags & os.O_CREATE) != 0 {
 		flags_array = append(flags_array, "create")
@@ -103,7 +177,41 @@ func (ctl *DbFSUser) OpenFile(name string, flags int, perm os.FileMode) (webdav.
 		flags_array = append(flags_array, "append")
 	}
 
-	ent, err := ctl.NewDirEntry(ctl.Username, name)
+	t, err := ctl.mount(name)
+	if err != nil {
+		glog.Errorf("openfile: username: %s, filename: %s: could not map path: %v", ctl.Username, name, err)
+		return nil, os.ErrNotExist
+	}
+
+	if t.virtual != nil {
+		if flags & (os.O_WRONLY | os.O_RDWR | os.O_CREATE | os.O_TRUNC) != 0 {
+			return nil, os.ErrPermission
+		}
+
+		f := &File {
+			User: ctl,
+			Info: t.virtual,
+			virtual: true,
+		}
+		return f, nil
+	}
+
+	real_name, link, err := ctl.lookup(t.owner, t.name)
+	if err != nil {
+		glog.Errorf("openfile: username: %s, filename: %s: could not resolve path: %v", ctl.Username, name, err)
+		if err == ErrSymlinkLoop {
+			return nil, err
+		}
+		return nil, os.ErrNotExist
+	}
+
+	if !t.inside(real_name) {
+		glog.Errorf("openfile: username: %s, filename: %s: resolved path %s is outside of the share: %s",
+			ctl.Username, name, real_name, t.share.String())
+		return nil, os.ErrPermission
+	}
+
+	ent, err := ctl.NewDirEntry(t.owner, real_name)
 	if err != nil {
 		glog.Errorf("openfile: could not create new entry: %v", err)
 		return nil, os.ErrNotExist
@@ -117,47 +225,107 @@ func (ctl *DbFSUser) OpenFile(name string, flags int, perm os.FileMode) (webdav.
 		}
 	}
 
-	err = ctl.FS.StatEntry(ent)
+	err = ctl.check_parent(t, ent, PermExec)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ctl.FS.StatEntry(ctl.context(), ent)
 	if err != nil {
 		if (flags & os.O_CREATE) != 0 {
-			err := ctl.FS.InsertEntry(ent)
+			if !t.writable() || t.share_root(ent) {
+				return nil, os.ErrPermission
+			}
+
+			err := ctl.CheckParentAccess(ent, PermWrite | PermExec)
+			if err != nil {
+				return nil, err
+			}
+
+			err = ctl.check_quota(t.owner, uint64(ctl.TotalSize), 1)
+			if err != nil {
+				return nil, err
+			}
+
+			err = ctl.FS.InsertEntry(ctl.context(), ent)
 			if err != nil {
 				glog.Errorf("openfile: username: %s, filename: %s, flags: %x %v, perm: %s: could not insert new entry: %v",
 					ctl.Username, name, flags, flags_array, perm.String(), err)
 				return nil, os.ErrNotExist
 			}
 
-			glog.Infof("openfile: username: %s, filename: %s, flags: %x %v, perm: %s: created new file",
-				ctl.Username, name, flags, flags_array, perm.String())
+			ctl.oplog("create", start, reqlog.Fields {
+				"path": name,
+				"owner": ent.Username,
+				"flags": flags_array,
+				"mode": perm.String(),
+			}, nil)
 		} else {
 			glog.Errorf("openfile: could not stat file: %v", err)
 			return nil, os.ErrNotExist
 		}
 	}
 
+	// O_RDWR is allowed without write permission, webdav opens files this way to patch properties,
+	// writes are checked later, truncation and write-only access are checked here
+	if (flags & os.O_WRONLY != 0) || ((flags & os.O_RDWR != 0) && (flags & os.O_TRUNC != 0)) {
+		if !t.writable() {
+			return nil, os.ErrPermission
+		}
+
+		err = ctl.CheckAccess(ent, PermWrite)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// truncate
 	if (flags & (os.O_WRONLY | os.O_RDWR) != 0) && (flags & os.O_TRUNC != 0) && (ent.Size() != 0) {
 		ent.Fsize = 0
-		err := ctl.FS.UpdateEntry(ent)
+		err := ctl.FS.UpdateEntry(ctl.context(), ent)
 		if err != nil {
 			return nil, fmt.Errorf("openfile: truncation failed: %v", err)
 		}
 
-		glog.Infof("openfile: username: %s, filename: %s, flags: %x %v, perm: %s: updated entry: %s",
-			ctl.Username, name, flags, flags_array, perm.String(), ent.String())
+		ctl.oplog("truncate", start, reqlog.Fields {
+			"path": name,
+			"owner": ent.Username,
+			"flags": flags_array,
+			"bucket": ent.Bucket,
+			"key": ent.Key,
+		}, nil)
 	}
 
 	f := &File {
 		User: ctl,
 		Info: ent,
+		Link: link,
+		Share: t.share,
 	}
 
 	return f, nil
 }
 
-func (ctl *DbFSUser) RemoveAll(name string) error {
-	glog.Infof("remove: username: %s, filename: %s", ctl.Username, name)
-	ent, err := ctl.NewDirEntry(ctl.Username, name)
+func (ctl *DbFSUser) RemoveAll(ctx context.Context, name string) error {
+	ctl = ctl.bind(ctx)
+	start := time.Now()
+	err := ctl.remove_all(name)
+	ctl.oplog("remove", start, reqlog.Fields { "path": name }, err)
+	return err
+}
+
+func (ctl *DbFSUser) remove_all(name string) error {
+	t, err := ctl.resolve(name, false)
+	if err != nil {
+		glog.Errorf("remove: username: %s, filename: %s: could not resolve path: %v", ctl.Username, name, err)
+		return err
+	}
+
+	if !t.writable() {
+		return os.ErrPermission
+	}
+
+	ent, err := ctl.NewDirEntry(t.owner, t.name)
 	if err != nil {
 		glog.Errorf("remove: username: %s, filename: %s: could not create new entry: %v", ctl.Username, name, err)
 		return err
@@ -167,19 +335,39 @@ func (ctl *DbFSUser) RemoveAll(name string) error {
 		return os.ErrInvalid
 	}
 
-	err = ctl.FS.StatEntry(ent)
+	if t.share_root(ent) {
+		return os.ErrPermission
+	}
+
+	err = ctl.FS.StatEntry(ctl.context(), ent)
 	if err != nil {
 		glog.Errorf("remove: username: %s, filename: %s: there is no directory entry: %v", ctl.Username, name, err)
 		return err
 	}
 
-	err = ctl.FS.DeleteEntry(ent)
+	err = ctl.CheckParentAccess(ent, PermWrite | PermExec)
 	if err != nil {
-		glog.Errorf("remove: %s: could not delete entry: %v", ent.String(), err)
 		return err
 	}
 
-	glog.Infof("remove: %s: entry deleted", ent.String())
+	// children are removed first, otherwise they become unreachable, but still count against the quota
+	if ent.IsDir() {
+		failed, err := ctl.remove_children(ent)
+		if err != nil {
+			glog.Errorf("remove: %s: could not remove children: %v", ent.String(), err)
+			return err
+		}
+		if failed != 0 {
+			return fmt.Errorf("remove: %s: could not remove data of %d entries, metadata has been kept, restart removal",
+				ent.String(), failed)
+		}
+	}
+
+	err = ctl.FS.DeleteEntry(ctl.context(), ent)
+	if err != nil {
+		glog.Errorf("remove: %s: could not delete entry: %v", ent.String(), err)
+		return err
+	}
 
 	if ent.IsDir() {
 		return nil
@@ -196,16 +384,98 @@ func (ctl *DbFSUser) RemoveAll(name string) error {
 			glog.Errorf("remove: %s: could not remove data from elliptics: %v", ent.String(), err)
 			return err
 		}
-
-		glog.Infof("remove: %s: entry deleted from elliptics", ent.String())
 	}
 
 	return nil
 }
 
-func (ctl *DbFSUser) Rename(oldName, newName string) error {
-	glog.Infof("rename: username: %s, filename: %s -> %s", ctl.Username, oldName, newName)
-	oent, err := ctl.NewDirEntry(ctl.Username, oldName)
+// remove_children deletes everything below directory @dir depth first and returns number of entries which have been kept.
+// Data is removed from elliptics before the entry is deleted, entries whose data could not be removed are kept
+// together with their parent directories, so that removal can be restarted.
+func (ctl *DbFSUser) remove_children(dir *DirEntry) (int, error) {
+	err := ctl.CheckAccess(dir, PermWrite | PermExec)
+	if err != nil {
+		return 0, err
+	}
+
+	failed := 0
+	after := ""
+	for {
+		entries, err := ctl.FS.ScanEntryChildren(ctl.context(), dir, after, ReaddirBatch)
+		if err != nil {
+			return failed, err
+		}
+
+		for _, ent := range entries {
+			after = ent.Fname
+
+			if ent.IsDir() {
+				n, err := ctl.remove_children(ent)
+				failed += n
+				if err != nil {
+					return failed, err
+				}
+				if n != 0 {
+					continue
+				}
+			} else if ent.Bucket != "" {
+				f := &File {
+					User: ctl,
+					Info: ent,
+				}
+
+				err = f.RemoveData()
+				if err != nil {
+					glog.Errorf("remove: %s: could not remove data from elliptics: %v", ent.String(), err)
+					failed++
+					continue
+				}
+			}
+
+			err = ctl.FS.DeleteEntry(ctl.context(), ent)
+			if err != nil {
+				return failed, err
+			}
+		}
+
+		if len(entries) < ReaddirBatch {
+			return failed, nil
+		}
+	}
+}
+
+func (ctl *DbFSUser) Rename(ctx context.Context, oldName, newName string) error {
+	ctl = ctl.bind(ctx)
+	start := time.Now()
+	err := ctl.rename(oldName, newName)
+	ctl.oplog("rename", start, reqlog.Fields { "path": oldName, "new_path": newName }, err)
+	return err
+}
+
+func (ctl *DbFSUser) rename(oldName, newName string) error {
+	ot, err := ctl.resolve(oldName, false)
+	if err != nil {
+		glog.Errorf("rename: username: %s, filename: %s: could not resolve old path: %v", ctl.Username, oldName, err)
+		return os.ErrInvalid
+	}
+	nt, err := ctl.resolve(newName, false)
+	if err != nil {
+		glog.Errorf("rename: username: %s, filename: %s: could not resolve new path: %v", ctl.Username, newName, err)
+		return os.ErrInvalid
+	}
+
+	if !ot.writable() || !nt.writable() {
+		return os.ErrPermission
+	}
+
+	// entries can not be moved between namespaces of different users
+	if ot.owner != nt.owner {
+		glog.Errorf("rename: username: %s, filename: %s -> %s: source and destination belong to different users: %s -> %s",
+			ctl.Username, oldName, newName, ot.owner, nt.owner)
+		return os.ErrInvalid
+	}
+
+	oent, err := ctl.NewDirEntry(ot.owner, ot.name)
 	if err != nil {
 		glog.Errorf("rename: username: %s, filename: %s: could not create new entry for old name: %v",
 			ctl.Username, oldName, err)
@@ -215,7 +485,7 @@ func (ctl *DbFSUser) Rename(oldName, newName string) error {
 		return os.ErrInvalid
 	}
 
-	nent, err := ctl.NewDirEntry(ctl.Username, newName)
+	nent, err := ctl.NewDirEntry(nt.owner, nt.name)
 	if err != nil {
 		glog.Errorf("rename: username: %s, filename: %s: could not create new entry for new name %v",
 			ctl.Username, newName, err)
@@ -225,6 +495,10 @@ func (ctl *DbFSUser) Rename(oldName, newName string) error {
 		return os.ErrInvalid
 	}
 
+	if ot.share_root(oent) || nt.share_root(nent) {
+		return os.ErrPermission
+	}
+
 	if oent.Filename == nent.Filename {
 		return nil
 	}
@@ -235,94 +509,117 @@ func (ctl *DbFSUser) Rename(oldName, newName string) error {
 	}
 
 	// check whether src object exists
-	err = ctl.FS.StatEntry(oent)
+	err = ctl.FS.StatEntry(ctl.context(), oent)
 	if err != nil {
 		glog.Errorf("rename: username: %s, filename: %s -> %s: there is no old directory entry: %v",
 			ctl.Username, oldName, newName, err)
 		return err
 	}
 
+	err = ctl.CheckParentAccess(oent, PermWrite | PermExec)
+	if err != nil {
+		return err
+	}
+	err = ctl.CheckParentAccess(nent, PermWrite | PermExec)
+	if err != nil {
+		return err
+	}
+
 	if oent.IsDir() {
 		// if we are moving a directory, check whether destination path already exists, in this case it should be a directory
-		err := ctl.FS.StatEntry(nent)
+		dent := *nent
+		err := ctl.FS.StatEntry(ctl.context(), &dent)
 		if err == nil {
-			if !nent.IsDir() {
-				glog.Errorf("rename: %s -> %s: destination is not a directory", oent.String(), nent.String())
-				return fmt.Errorf("rename: %s -> %s: destination is not a directory", oent.Filename, nent.Filename)
+			if !dent.IsDir() {
+				glog.Errorf("rename: %s -> %s: destination is not a directory", oent.String(), dent.String())
+				return fmt.Errorf("rename: %s -> %s: destination is not a directory", oent.Filename, dent.Filename)
 			}
 
 			nf := &File {
 				User: ctl,
-				Info: nent,
+				Info: &dent,
 			}
 
-			fi, err := nf.Readdir(0)
+			fi, err := nf.readdir(0)
 			if err != nil {
-				glog.Errorf("rename: %s -> %s: src readdir failed: %v", oent.String(), nent.String(), err)
+				glog.Errorf("rename: %s -> %s: src readdir failed: %v", oent.String(), dent.String(), err)
 				return err
 			}
 
 			if len(fi) != 0 {
 				glog.Errorf("rename: %s -> %s: destination directory is not empty (%d entries)",
-					oent.String(), nent.String(), len(fi))
+					oent.String(), dent.String(), len(fi))
 
 				return fmt.Errorf("rename: %s -> %s: destination directory is not empty (%d entries)",
-					oent.Filename, nent.Filename, len(fi))
+					oent.Filename, dent.Filename, len(fi))
+			}
+
+			// empty destination directory is replaced by the source one
+			err = ctl.FS.DeleteEntry(ctl.context(), &dent)
+			if err != nil {
+				glog.Errorf("rename: %s -> %s: could not delete destination: %v", oent.String(), dent.String(), err)
+				return err
 			}
 		}
 	}
 
-	err = ctl.FS.DeleteEntry(oent)
+	err = ctl.FS.MoveEntry(ctl.context(), oent, nent.Filename, nent.Fname, nent.Parent)
 	if err != nil {
-		glog.Errorf("rename: %s -> %s: could not delete old entry: %v", oent.String(), nent.String(), err)
+		glog.Errorf("rename: %s -> %s: could not move entry: %v", oent.String(), nent.String(), err)
 		return err
 	}
 
-	nfilename := nent.Filename
-	nparent := nent.Parent
-
-	nent = oent
-	nent.Filename = nfilename
-	nent.Parent = nparent
+	if !oent.IsDir() {
+		return nil
+	}
 
-	err = ctl.FS.InsertEntry(nent)
+	err = ctl.move_children(oent, nent.Filename)
 	if err != nil {
-		glog.Errorf("rename: %s -> %s: could not insert new entry: %v", oent.String(), nent.String(), err)
+		glog.Errorf("rename: %s -> %s: could not move children: %v", oent.String(), nent.String(), err)
 		return err
 	}
 
-	if !oent.IsDir() {
-		return nil
-	}
+	return nil
+}
 
-	of := &File {
+// move_children updates filenames of all entries below @dir to start with @prefix instead of @dir filename,
+// moved directory keeps its key, so parent keys of the children do not change
+func (ctl *DbFSUser) move_children(dir *DirEntry, prefix string) error {
+	f := &File {
 		User: ctl,
-		Info: oent,
+		Info: dir,
 	}
 
-	fi, err := of.Readdir(0)
+	fi, err := f.readdir(0)
 	if err != nil {
-		glog.Errorf("rename: %s -> %s: dst readdir failed: %v", oent.String(), nent.String(), err)
 		return err
 	}
 
-	for _, se := range fi {
-		src := oent.Filename + "/" + se.Name()
-		dst := nent.Filename + "/" + se.Name()
+	for _, fe := range fi {
+		e := fe.(*DirEntry)
+		filename := prefix + "/" + e.Fname
 
-		err = ctl.Rename(src, dst)
+		err = ctl.FS.MoveEntry(ctl.context(), e, filename, e.Fname, e.Parent)
 		if err != nil {
-			glog.Errorf("rename: %s -> %s: recursive rename failed: %s -> %s, error: %v",
-				oent.String(), nent.String(), src, dst, err)
 			return err
 		}
+
+		if e.IsDir() {
+			err = ctl.move_children(e, filename)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
 }
 
 func (ent *DirEntry) Name() string {
-	return ent.Filename
+	if ent.Filename == "/" {
+		return ent.Filename
+	}
+	return ent.Fname
 }
 func (ent *DirEntry) Size() int64 {
 	return int64(ent.Fsize)
@@ -340,15 +637,32 @@ func (ent *DirEntry) Sys() interface{} {
 	return nil
 }
 
-func (ctl *DbFSUser) Stat(name string) (os.FileInfo, error) {
-	ent := NewDirEntryNil(ctl.Username, name)
+func (ctl *DbFSUser) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	ctl = ctl.bind(ctx)
+
+	t, err := ctl.resolve(name, true)
+	if err != nil {
+		glog.Errorf("stat: username: %s, filename: %s: could not resolve path: %v", ctl.Username, name, err)
+		return nil, os.ErrNotExist
+	}
+
+	if t.virtual != nil {
+		return t.virtual, nil
+	}
 
-	err := ctl.FS.StatEntry(ent)
+	ent := NewDirEntryNil(t.owner, t.name)
+
+	err = ctl.FS.StatEntry(ctl.context(), ent)
 	if err != nil {
 		glog.Errorf("stat: username: %s, filename: %s, error: %v", ent.Username, ent.Filename, err)
 		return nil, os.ErrNotExist
 	}
 
+	err = ctl.check_parent(t, ent, PermExec)
+	if err != nil {
+		return nil, err
+	}
+
 	glog.Infof("stat: %s", ent.String())
 	return ent, nil
 }
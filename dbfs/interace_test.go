@@ -0,0 +1,38 @@
+package dbfs
+
+import (
+	"os"
+	"testing"
+)
+
+func TestRemoveAll(t *testing.T) {
+	ro := test_dir("alice", "/ro")
+	ro.Fmode = os.ModeDir | 0555
+
+	tests := []struct {
+		name		string
+		err		error
+	} {
+		{ "/d", nil },
+		{ "/file", nil },
+		{ "/ro", os.ErrPermission },
+		{ "/", os.ErrInvalid },
+	}
+
+	for _, test := range tests {
+		u := &DbFSUser {
+			FS: new_test_fs(t, []*DirEntry {
+				test_dir("alice", "/"),
+				test_dir("alice", "/d"),
+				test_file("alice", "/file"),
+				ro,
+			}),
+			Username: "alice",
+		}
+
+		err := u.remove_all(test.name)
+		if err != test.err {
+			t.Errorf("%s: error: %v, want %v", test.name, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package dbfs
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"golang.org/x/crypto/bcrypt"
+	"path"
+	"time"
+)
+
+const (
+	// link allows to download linked file or files from the linked directory
+	LinkRead = "read"
+	// link allows to upload new files into the linked directory, nothing can be downloaded
+	LinkUpload = "upload"
+
+	LinkTokenLength = 32
+)
+
+var (
+	ErrLinkNotFound = errors.New("link not found")
+	ErrLinkExhausted = errors.New("link download limit has been reached")
+)
+
+type Link struct {
+	Token			string		`json:"token"`
+	Owner			string		`json:"owner"`
+	Path			string		`json:"path"`
+	Mode			string		`json:"mode"`
+	// bcrypt hash of the link password, empty if link is not protected
+	Password		string		`json:"-"`
+	Protected		bool		`json:"protected"`
+	// zero time means link never expires
+	Expires			time.Time	`json:"expires"`
+	// zero means unlimited number of downloads
+	MaxDownloads		int64		`json:"max_downloads"`
+	Downloads		int64		`json:"downloads"`
+	Created			time.Time	`json:"created"`
+}
+
+// LinkID returns short identifier of the link which can be written to logs, token itself grants access to the link
+func LinkID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:6])
+}
+
+func (l *Link) String() string {
+	return fmt.Sprintf("id: %s, owner: %s, path: %s, mode: %s, protected: %v, expires: '%s', downloads: %d/%d, created: '%s'",
+		LinkID(l.Token), l.Owner, l.Path, l.Mode, l.Password != "", l.Expires.String(), l.Downloads, l.MaxDownloads, l.Created.String())
+}
+
+func GenerateLinkToken() (string, error) {
+	b := make([]byte, LinkTokenLength)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (l *Link) SetPassword(password string) error {
+	if password == "" {
+		l.Password = ""
+		l.Protected = false
+		return nil
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("could not hash link password: %v", err)
+	}
+
+	l.Password = string(hash)
+	l.Protected = true
+	return nil
+}
+
+func (l *Link) CheckPassword(password string) bool {
+	if l.Password == "" {
+		return true
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(l.Password), []byte(password)) == nil
+}
+
+func (l *Link) Expired() bool {
+	return !l.Expires.IsZero() && time.Now().After(l.Expires)
+}
+
+func (l *Link) Exhausted() bool {
+	return l.MaxDownloads != 0 && l.Downloads >= l.MaxDownloads
+}
+
+// Root returns share which confines link users to the linked path of the owner's namespace
+func (l *Link) Root() *Share {
+	access := AccessRead
+	if l.Mode == LinkUpload {
+		access = AccessReadWrite
+	}
+
+	return &Share {
+		Owner: l.Owner,
+		Path: l.Path,
+		Access: access,
+		Created: l.Created,
+	}
+}
+
+const linksColumns = "token,owner,path,mode,password,expires,max_downloads,downloads,created"
+
+func scan_link(rows row_scanner, l *Link) error {
+	var expires mysql.NullTime
+
+	err := rows.Scan(&l.Token, &l.Owner, &l.Path, &l.Mode, &l.Password, &expires, &l.MaxDownloads, &l.Downloads, &l.Created)
+	if err != nil {
+		return err
+	}
+
+	l.Protected = l.Password != ""
+	l.Expires = time.Time{}
+	if expires.Valid {
+		l.Expires = expires.Time
+	}
+
+	return nil
+}
+
+func (ctl *DbFS) InsertLink(ctx context.Context, l *Link) error {
+	end := start_query(ctx, "InsertLink")
+	defer end()
+
+	if l.Mode != LinkRead && l.Mode != LinkUpload {
+		return fmt.Errorf("could not insert link: %s: invalid mode", l.String())
+	}
+
+	var err error
+	l.Token, err = GenerateLinkToken()
+	if err != nil {
+		return fmt.Errorf("could not generate link token: %v", err)
+	}
+
+	l.Path = path.Clean("/" + l.Path)
+	l.Created = time.Now()
+	l.Downloads = 0
+
+	expires := mysql.NullTime {
+		Time: l.Expires,
+		Valid: !l.Expires.IsZero(),
+	}
+
+	_, err = ctl.db.ExecContext(ctx, "INSERT INTO links SET token=?,owner=?,path=?,mode=?,password=?,expires=?,max_downloads=?,downloads=?,created=?",
+		l.Token, l.Owner, l.Path, l.Mode, l.Password, expires, l.MaxDownloads, l.Downloads, l.Created)
+	if err != nil {
+		return fmt.Errorf("could not insert link: %s: %v", l.String(), err)
+	}
+
+	return nil
+}
+
+func (ctl *DbFS) GetLink(ctx context.Context, token string) (*Link, error) {
+	end := start_query(ctx, "GetLink")
+	defer end()
+
+	rows, err := ctl.db.QueryContext(ctx, "SELECT " + linksColumns + " FROM links WHERE token=?", token)
+	if err != nil {
+		return nil, fmt.Errorf("could not read link: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var l Link
+
+		err = scan_link(rows, &l)
+		if err != nil {
+			return nil, fmt.Errorf("database schema mismatch: %v", err)
+		}
+
+		return &l, nil
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not scan database: %v", err)
+	}
+
+	return nil, ErrLinkNotFound
+}
+
+func (ctl *DbFS) ListLinks(ctx context.Context, owner string) ([]*Link, error) {
+	end := start_query(ctx, "ListLinks")
+	defer end()
+
+	rows, err := ctl.db.QueryContext(ctx, "SELECT " + linksColumns + " FROM links WHERE owner=? ORDER BY created", owner)
+	if err != nil {
+		return nil, fmt.Errorf("could not read links of user %s: %v", owner, err)
+	}
+	defer rows.Close()
+
+	links := make([]*Link, 0)
+	for rows.Next() {
+		var l Link
+
+		err = scan_link(rows, &l)
+		if err != nil {
+			return nil, fmt.Errorf("database schema mismatch: %v", err)
+		}
+
+		links = append(links, &l)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not scan database: %v", err)
+	}
+
+	return links, nil
+}
+
+func (ctl *DbFS) DeleteLink(ctx context.Context, owner, token string) error {
+	end := start_query(ctx, "DeleteLink")
+	defer end()
+
+	res, err := ctl.db.ExecContext(ctx, "DELETE FROM links WHERE owner=? AND token=?", owner, token)
+	if err != nil {
+		return fmt.Errorf("could not delete link: owner: %s, id: %s: %v", owner, LinkID(token), err)
+	}
+
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		return ErrLinkNotFound
+	}
+
+	return nil
+}
+
+// CountLinkDownload atomically increments download counter unless the limit has already been reached
+func (ctl *DbFS) CountLinkDownload(ctx context.Context, l *Link) error {
+	end := start_query(ctx, "CountLinkDownload")
+	defer end()
+
+	res, err := ctl.db.ExecContext(ctx, "UPDATE links SET downloads=downloads+1 WHERE token=? AND (max_downloads=0 OR downloads<max_downloads)",
+		l.Token)
+	if err != nil {
+		return fmt.Errorf("could not update link download counter: %s: %v", l.String(), err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("could not update link download counter: %s: %v", l.String(), err)
+	}
+	if n == 0 {
+		return ErrLinkExhausted
+	}
+
+	l.Downloads++
+	return nil
+}
@@ -0,0 +1,32 @@
+package dbfs
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLinkID(t *testing.T) {
+	token, err := GenerateLinkToken()
+	if err != nil {
+		t.Fatalf("could not generate token: %v", err)
+	}
+	other, err := GenerateLinkToken()
+	if err != nil {
+		t.Fatalf("could not generate token: %v", err)
+	}
+
+	id := LinkID(token)
+	if len(id) != 12 || id != LinkID(token) || id == LinkID(other) {
+		t.Errorf("ids of the tokens: %q, %q", id, LinkID(other))
+	}
+
+	l := &Link {
+		Token: token,
+		Owner: "alice",
+		Path: "/file",
+		Mode: LinkRead,
+	}
+	if s := l.String(); strings.Contains(s, token) || !strings.Contains(s, id) {
+		t.Errorf("link string %q must contain id %q and must not contain the token", s, id)
+	}
+}
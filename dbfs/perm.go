@@ -0,0 +1,114 @@
+package dbfs
+
+import (
+	"context"
+	"fmt"
+	"github.com/bioothod/wd2/reqlog"
+	"github.com/golang/glog"
+	"os"
+	"path"
+	"time"
+)
+
+const (
+	PermRead os.FileMode = 4
+	PermWrite os.FileMode = 2
+	PermExec os.FileMode = 1
+)
+
+// access_bits returns rwx bits of @ent which apply to the current user:
+// owner bits for the owner of the entry, group bits for the users the entry is shared with
+func (ctl *DbFSUser) access_bits(ent *DirEntry) os.FileMode {
+	mode := ent.Mode().Perm()
+	if ent.Username == ctl.Username {
+		return (mode >> 6) & 7
+	}
+
+	return (mode >> 3) & 7
+}
+
+func (ctl *DbFSUser) CheckAccess(ent *DirEntry, want os.FileMode) error {
+	if ctl.access_bits(ent) & want != want {
+		glog.Errorf("access: username: %s, %s: requested: %o, permission denied", ctl.Username, ent.String(), want)
+		return os.ErrPermission
+	}
+
+	return nil
+}
+
+// check_write verifies that both the share (if any) and permission bits allow to modify the file
+func (f *File) check_write() error {
+	if f.virtual || (f.Share != nil && !f.Share.Writable()) {
+		return os.ErrPermission
+	}
+
+	return f.User.CheckAccess(f.Info, PermWrite)
+}
+
+// CheckParentAccess verifies that the directory which contains @ent grants @want to the current user
+func (ctl *DbFSUser) CheckParentAccess(ent *DirEntry, want os.FileMode) error {
+	if ent.Filename == "/" {
+		return nil
+	}
+
+	pent := NewDirEntryNil(ent.Username, path.Dir(ent.Filename))
+	err := ctl.FS.StatEntry(ctl.context(), pent)
+	if err != nil {
+		return fmt.Errorf("access: username: %s, filename: %s: could not stat parent: %v", ctl.Username, ent.Filename, err)
+	}
+
+	return ctl.CheckAccess(pent, want)
+}
+
+func (ctl *DbFSUser) chmod_entry(ent *DirEntry, mode os.FileMode) error {
+	start := time.Now()
+
+	// only owner can change permissions, no matter which bits are currently set
+	if ent.Username != ctl.Username {
+		return os.ErrPermission
+	}
+
+	if ent.IsSymlink() {
+		return os.ErrInvalid
+	}
+
+	ent.Fmode = (ent.Fmode &^ os.ModePerm) | mode.Perm()
+
+	err := ctl.FS.UpdateEntry(ctl.context(), ent)
+	if err != nil {
+		glog.Errorf("chmod: %s: could not update entry: %v", ent.String(), err)
+		return err
+	}
+
+	ctl.oplog("chmod", start, reqlog.Fields { "path": ent.Filename, "owner": ent.Username, "mode": mode.Perm().String() }, nil)
+	return nil
+}
+
+// Chmod changes permission bits of @name, symbolic links are followed
+func (ctl *DbFSUser) Chmod(ctx context.Context, name string, mode os.FileMode) error {
+	ctl = ctl.bind(ctx)
+
+	t, err := ctl.resolve(name, true)
+	if err != nil {
+		glog.Errorf("chmod: username: %s, filename: %s: could not resolve path: %v", ctl.Username, name, err)
+		return err
+	}
+
+	if t.virtual != nil {
+		return os.ErrPermission
+	}
+
+	ent := NewDirEntryNil(t.owner, t.name)
+	err = ctl.FS.StatEntry(ctl.context(), ent)
+	if err != nil {
+		glog.Errorf("chmod: username: %s, filename: %s: could not stat entry: %v", ctl.Username, name, err)
+		return os.ErrNotExist
+	}
+
+	err = ctl.check_parent(t, ent, PermExec)
+	if err != nil {
+		return err
+	}
+
+	return ctl.chmod_entry(ent, mode)
+}
@@ -0,0 +1,99 @@
+package dbfs
+
+import (
+	"os"
+	"testing"
+)
+
+func TestAccessBits(t *testing.T) {
+	tests := []struct {
+		user		string
+		mode		os.FileMode
+		bits		os.FileMode
+	} {
+		{ "alice", 0750, 7 },
+		{ "bob", 0750, 5 },
+		{ "alice", 0640, 6 },
+		{ "bob", 0640, 4 },
+		{ "bob", 0604, 0 },
+		{ "alice", 0077, 0 },
+		{ "bob", 0077, 7 },
+		{ "alice", os.ModeDir | 0700, 7 },
+		{ "bob", os.ModeDir | 0700, 0 },
+		// type bits do not leak into the permissions
+		{ "alice", os.ModeSymlink | 0777, 7 },
+	}
+
+	for _, test := range tests {
+		u := &DbFSUser { Username: test.user }
+		ent := &DirEntry { Username: "alice", Filename: "/file", Fmode: test.mode }
+
+		if got := u.access_bits(ent); got != test.bits {
+			t.Errorf("%s: access_bits(%v) = %o, want %o", test.user, test.mode, got, test.bits)
+		}
+	}
+}
+
+func TestCheckAccess(t *testing.T) {
+	tests := []struct {
+		user		string
+		mode		os.FileMode
+		want		os.FileMode
+		ok		bool
+	} {
+		{ "alice", 0600, PermRead, true },
+		{ "alice", 0600, PermWrite, true },
+		{ "alice", 0600, PermRead | PermWrite, true },
+		{ "alice", 0600, PermExec, false },
+		{ "alice", 0400, PermRead | PermWrite, false },
+		{ "bob", 0640, PermRead, true },
+		{ "bob", 0640, PermWrite, false },
+		{ "bob", 0750, PermRead | PermExec, true },
+		{ "bob", 0700, PermRead, false },
+		{ "alice", 0000, 0, true },
+	}
+
+	for _, test := range tests {
+		u := &DbFSUser { Username: test.user }
+		ent := &DirEntry { Username: "alice", Filename: "/file", Fmode: test.mode }
+
+		err := u.CheckAccess(ent, test.want)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: CheckAccess(%v, %o): error: %v, want success: %v", test.user, test.mode, test.want, err, test.ok)
+		}
+		if err != nil && err != os.ErrPermission {
+			t.Errorf("%s: CheckAccess(%v, %o): unexpected error: %v", test.user, test.mode, test.want, err)
+		}
+	}
+}
+
+func TestCheckWrite(t *testing.T) {
+	tests := []struct {
+		name		string
+		user		string
+		mode		os.FileMode
+		share		*Share
+		virtual		bool
+		ok		bool
+	} {
+		{ "owner", "alice", 0644, nil, false, true },
+		{ "read-only file", "alice", 0444, nil, false, false },
+		{ "virtual", "alice", 0755, nil, true, false },
+		{ "writable share", "bob", 0664, &Share { Access: AccessReadWrite }, false, true },
+		{ "writable share, read-only file", "bob", 0644, &Share { Access: AccessReadWrite }, false, false },
+		{ "read-only share", "bob", 0666, &Share { Access: AccessRead }, false, false },
+	}
+
+	for _, test := range tests {
+		f := &File {
+			User: &DbFSUser { Username: test.user },
+			Info: &DirEntry { Username: "alice", Filename: "/file", Fmode: test.mode },
+			Share: test.share,
+			virtual: test.virtual,
+		}
+
+		if err := f.check_write(); (err == nil) != test.ok {
+			t.Errorf("%s: check_write: error: %v, want success: %v", test.name, err, test.ok)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package dbfs
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"github.com/golang/glog"
+	"golang.org/x/net/webdav"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// XML namespace of the wd2-specific WebDAV properties
+const PropNamespace = "urn:wd2"
+
+var (
+	PropSymlink = xml.Name { Space: PropNamespace, Local: "symlink" }
+	// octal permission bits, i.e. 0644
+	PropMode = xml.Name { Space: PropNamespace, Local: "mode" }
+)
+
+func (f *File) DeadProps() (map[xml.Name]webdav.Property, error) {
+	props := make(map[xml.Name]webdav.Property)
+
+	if f.virtual {
+		return props, nil
+	}
+
+	props[PropMode] = webdav.Property {
+		XMLName: PropMode,
+		InnerXML: []byte(fmt.Sprintf("%04o", f.Info.Mode().Perm())),
+	}
+
+	if f.Link != nil {
+		props[PropSymlink] = webdav.Property {
+			XMLName: PropSymlink,
+			InnerXML: []byte(xml_escape(f.Link.Target)),
+		}
+	}
+
+	return props, nil
+}
+
+func (f *File) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	stats := make(map[int]*webdav.Propstat)
+	add_status := func(name xml.Name, status int) {
+		st, ok := stats[status]
+		if !ok {
+			st = &webdav.Propstat {
+				Status: status,
+			}
+			stats[status] = st
+		}
+		st.Props = append(st.Props, webdav.Property { XMLName: name })
+	}
+
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			status := http.StatusForbidden
+
+			switch p.XMLName {
+			case PropSymlink:
+				if patch.Remove {
+					break
+				}
+
+				target, err := xml_text(p.InnerXML)
+				if err != nil || target == "" {
+					status = http.StatusBadRequest
+					break
+				}
+
+				err = f.check_write()
+				if err != nil {
+					status = http.StatusForbidden
+					break
+				}
+
+				err = f.set_link_target(target)
+				if err != nil {
+					glog.Errorf("proppatch: %s: could not set symlink target '%s': %v", f.Info.String(), target, err)
+					status = http.StatusConflict
+					break
+				}
+
+				status = http.StatusOK
+
+			case PropMode:
+				if patch.Remove {
+					break
+				}
+
+				text, err := xml_text(p.InnerXML)
+				if err != nil {
+					status = http.StatusBadRequest
+					break
+				}
+
+				// virtual directories are owned by the user in the entry, but they are not stored anywhere
+				if f.virtual {
+					break
+				}
+
+				mode, err := strconv.ParseUint(strings.TrimSpace(text), 8, 32)
+				if err != nil || mode > uint64(os.ModePerm) {
+					status = http.StatusBadRequest
+					break
+				}
+
+				err = f.User.chmod_entry(f.Info, os.FileMode(mode))
+				if err != nil {
+					status = http.StatusForbidden
+					break
+				}
+
+				status = http.StatusOK
+			}
+
+			add_status(p.XMLName, status)
+		}
+	}
+
+	ret := make([]webdav.Propstat, 0, len(stats))
+	for _, st := range stats {
+		ret = append(ret, *st)
+	}
+
+	return ret, nil
+}
+
+func xml_escape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// xml_text returns character data of the property value, nested elements are ignored
+func xml_text(inner []byte) (string, error) {
+	var v struct {
+		Text string `xml:",chardata"`
+	}
+
+	err := xml.Unmarshal(append(append([]byte("<v>"), inner...), []byte("</v>")...), &v)
+	if err != nil {
+		return "", err
+	}
+
+	return v.Text, nil
+}
@@ -0,0 +1,155 @@
+package dbfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"os"
+)
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Quota limits amount of data and number of entries in the user's namespace, zero means unlimited
+type Quota struct {
+	Username		string		`json:"username"`
+	MaxBytes		uint64		`json:"max_bytes"`
+	MaxFiles		int64		`json:"max_files"`
+}
+
+func (q *Quota) String() string {
+	return fmt.Sprintf("username: %s, max_bytes: %d, max_files: %d", q.Username, q.MaxBytes, q.MaxFiles)
+}
+
+func (q *Quota) Unlimited() bool {
+	return q.MaxBytes == 0 && q.MaxFiles == 0
+}
+
+// GetQuota returns quota of the user, users without quota get unlimited one
+func (ctl *DbFS) GetQuota(ctx context.Context, username string) (*Quota, error) {
+	end := start_query(ctx, "GetQuota")
+	defer end()
+
+	q := &Quota {
+		Username: username,
+	}
+
+	rows, err := ctl.db.QueryContext(ctx, "SELECT max_bytes,max_files FROM quotas WHERE username=?", username)
+	if err != nil {
+		return nil, fmt.Errorf("could not read quota of user %s: %v", username, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		err = rows.Scan(&q.MaxBytes, &q.MaxFiles)
+		if err != nil {
+			return nil, fmt.Errorf("database schema mismatch: %v", err)
+		}
+		break
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not scan database: %v", err)
+	}
+
+	return q, nil
+}
+
+func (ctl *DbFS) SetQuota(ctx context.Context, q *Quota) error {
+	end := start_query(ctx, "SetQuota")
+	defer end()
+
+	if q.MaxFiles < 0 {
+		return fmt.Errorf("could not set quota: %s: limits must not be negative", q.String())
+	}
+
+	_, err := ctl.db.ExecContext(ctx, "REPLACE INTO quotas SET username=?,max_bytes=?,max_files=?", q.Username, q.MaxBytes, q.MaxFiles)
+	if err != nil {
+		return fmt.Errorf("could not set quota: %s: %v", q.String(), err)
+	}
+
+	return nil
+}
+
+func (ctl *DbFS) DeleteQuota(ctx context.Context, username string) error {
+	end := start_query(ctx, "DeleteQuota")
+	defer end()
+
+	_, err := ctl.db.ExecContext(ctx, "DELETE FROM quotas WHERE username=?", username)
+	if err != nil {
+		return fmt.Errorf("could not delete quota of user %s: %v", username, err)
+	}
+
+	return nil
+}
+
+// quota_usage returns quota of @owner and amount of data and number of entries in its namespace,
+// usage is not read for the users without quota
+func (ctl *DbFSUser) quota_usage(owner string) (q *Quota, used_bytes uint64, used_files int64, err error) {
+	end := start_query(ctl.context(), "quota_usage")
+	defer end()
+
+	q, err = ctl.FS.GetQuota(ctl.context(), owner)
+	if err != nil || q.Unlimited() {
+		return
+	}
+
+	err = ctl.FS.db.QueryRowContext(ctl.context(), "SELECT COUNT(*), COALESCE(SUM(IF((mode & ?) = 0, size, 0)), 0) FROM dirs WHERE username=?",
+		uint32(os.ModeDir | os.ModeSymlink), owner).Scan(&used_files, &used_bytes)
+	if err != nil {
+		err = fmt.Errorf("could not read usage of user %s: %v", owner, err)
+	}
+	return
+}
+
+// check_quota returns ErrQuotaExceeded if adding @bytes and @files to the namespace of @owner exceeds its quota,
+// data written into shared folders is accounted to the owner of the folder
+func (ctl *DbFSUser) check_quota(owner string, bytes uint64, files int64) error {
+	q, used_bytes, used_files, err := ctl.quota_usage(owner)
+	if err != nil {
+		return err
+	}
+
+	if q.Unlimited() {
+		return nil
+	}
+
+	if (q.MaxBytes != 0 && used_bytes + bytes > q.MaxBytes) || (q.MaxFiles != 0 && used_files + files > q.MaxFiles) {
+		glog.Errorf("quota: username: %s, owner: %s: used: %d bytes, %d files, requested: %d bytes, %d files: %v, %s",
+			ctl.Username, owner, used_bytes, used_files, bytes, files, ErrQuotaExceeded, q.String())
+		return ErrQuotaExceeded
+	}
+
+	return nil
+}
+
+// reserve_quota accounts @bytes written past the end of the file against the quota of its owner,
+// quota is read once per opened file and then tracked locally, since data of unknown size is written in small chunks
+func (f *File) reserve_quota(bytes uint64) error {
+	if !f.quota_read {
+		q, used_bytes, _, err := f.User.quota_usage(f.Info.Username)
+		if err != nil {
+			return err
+		}
+
+		f.quota_read = true
+		f.quota_limited = q.MaxBytes != 0
+		if used_bytes < q.MaxBytes {
+			f.quota_left = q.MaxBytes - used_bytes
+		}
+	}
+
+	if !f.quota_limited {
+		return nil
+	}
+
+	if bytes > f.quota_left {
+		glog.Errorf("quota: username: %s, %s: requested: %d bytes, left: %d bytes: %v",
+			f.User.Username, f.Info.String(), bytes, f.quota_left, ErrQuotaExceeded)
+		return ErrQuotaExceeded
+	}
+
+	f.quota_left -= bytes
+	return nil
+}
@@ -0,0 +1,53 @@
+package dbfs
+
+import (
+	"testing"
+)
+
+func TestReserveQuota(t *testing.T) {
+	tests := []struct {
+		name		string
+		limited		bool
+		left		uint64
+		writes		[]uint64
+		// index of the first write which must fail, -1 if all of them succeed
+		fail		int
+	} {
+		{ "unlimited", false, 0, []uint64 { 1 << 40, 1 << 40 }, -1 },
+		{ "fits", true, 100, []uint64 { 40, 60 }, -1 },
+		{ "exceeds", true, 100, []uint64 { 40, 40, 40 }, 2 },
+		{ "nothing left", true, 0, []uint64 { 1 }, 0 },
+		{ "empty write", true, 0, []uint64 { 0 }, -1 },
+	}
+
+	for _, test := range tests {
+		f := &File {
+			User: &DbFSUser {
+				Username: "alice",
+			},
+			Info: &DirEntry {
+				Username: "alice",
+				Filename: "/file",
+			},
+			quota_read: true,
+			quota_limited: test.limited,
+			quota_left: test.left,
+		}
+
+		fail := -1
+		for i, bytes := range test.writes {
+			err := f.reserve_quota(bytes)
+			if err != nil {
+				if err != ErrQuotaExceeded {
+					t.Fatalf("%s: write %d: unexpected error: %v", test.name, i, err)
+				}
+				fail = i
+				break
+			}
+		}
+
+		if fail != test.fail {
+			t.Errorf("%s: first failed write: %d, want %d", test.name, fail, test.fail)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package dbfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// directory in every user's namespace which contains folders shared with this user,
+// shares are mounted as /Shared/<owner>/<share name>
+const SharedRoot = "/Shared"
+
+const (
+	GranteeUser = "user"
+	GranteeGroup = "group"
+
+	AccessRead = "read"
+	AccessReadWrite = "read-write"
+)
+
+type Share struct {
+	Owner			string
+	Path			string
+	Name			string
+	Grantee			string
+	GranteeType		string
+	Access			string
+	Created			time.Time
+}
+
+func (s *Share) String() string {
+	return fmt.Sprintf("owner: %s, path: %s, name: %s, grantee: %s %s, access: %s, created: '%s'",
+		s.Owner, s.Path, s.Name, s.GranteeType, s.Grantee, s.Access, s.Created.String())
+}
+
+func (s *Share) Writable() bool {
+	return s.Access == AccessReadWrite
+}
+
+const sharesColumns = "owner,path,name,grantee,grantee_type,access,created"
+
+func scan_share(rows row_scanner, s *Share) error {
+	return rows.Scan(&s.Owner, &s.Path, &s.Name, &s.Grantee, &s.GranteeType, &s.Access, &s.Created)
+}
+
+func (ctl *DbFS) InsertShare(ctx context.Context, s *Share) error {
+	end := start_query(ctx, "InsertShare")
+	defer end()
+
+	if s.GranteeType != GranteeUser && s.GranteeType != GranteeGroup {
+		return fmt.Errorf("could not insert share: %s: invalid grantee type", s.String())
+	}
+	if s.Access != AccessRead && s.Access != AccessReadWrite {
+		return fmt.Errorf("could not insert share: %s: invalid access", s.String())
+	}
+	if s.Name == "" || strings.Contains(s.Name, "/") || len(s.Name) > MaxNameLength {
+		return fmt.Errorf("could not insert share: %s: invalid name", s.String())
+	}
+
+	s.Path = path.Clean("/" + s.Path)
+	s.Created = time.Now()
+
+	_, err := ctl.db.ExecContext(ctx, "INSERT INTO shares SET owner=?,path=?,name=?,grantee=?,grantee_type=?,access=?,created=?",
+		s.Owner, s.Path, s.Name, s.Grantee, s.GranteeType, s.Access, s.Created)
+	if err != nil {
+		return fmt.Errorf("could not insert share: %s: %v", s.String(), err)
+	}
+
+	return nil
+}
+
+func (ctl *DbFS) DeleteShare(ctx context.Context, s *Share) error {
+	end := start_query(ctx, "DeleteShare")
+	defer end()
+
+	_, err := ctl.db.ExecContext(ctx, "DELETE FROM shares WHERE owner=? AND name=? AND grantee=? AND grantee_type=?",
+		s.Owner, s.Name, s.Grantee, s.GranteeType)
+	if err != nil {
+		return fmt.Errorf("could not delete share: %s: %v", s.String(), err)
+	}
+
+	return nil
+}
+
+func (ctl *DbFS) scan_shares(ctx context.Context, query string, args ...interface{}) ([]*Share, error) {
+	rows, err := ctl.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("could not read shares: %v", err)
+	}
+	defer rows.Close()
+
+	shares := make([]*Share, 0)
+	for rows.Next() {
+		var s Share
+
+		err = scan_share(rows, &s)
+		if err != nil {
+			return nil, fmt.Errorf("database schema mismatch: %v", err)
+		}
+
+		shares = append(shares, &s)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not scan database: %v", err)
+	}
+
+	return shares, nil
+}
+
+func (ctl *DbFS) ListSharesOwner(ctx context.Context, owner string) ([]*Share, error) {
+	end := start_query(ctx, "ListSharesOwner")
+	defer end()
+
+	return ctl.scan_shares(ctx, "SELECT " + sharesColumns + " FROM shares WHERE owner=? ORDER BY name", owner)
+}
+
+// ListSharesGrantee returns all shares granted either to @username directly or to any of the @groups
+func (ctl *DbFS) ListSharesGrantee(ctx context.Context, username string, groups []string) ([]*Share, error) {
+	end := start_query(ctx, "ListSharesGrantee")
+	defer end()
+
+	query := "SELECT " + sharesColumns + " FROM shares WHERE (grantee_type=? AND grantee=?)"
+	args := []interface{} { GranteeUser, username }
+
+	if len(groups) != 0 {
+		query += " OR (grantee_type=? AND grantee IN (?" + strings.Repeat(",?", len(groups) - 1) + "))"
+		args = append(args, GranteeGroup)
+		for _, g := range groups {
+			args = append(args, g)
+		}
+	}
+
+	return ctl.scan_shares(ctx, query + " ORDER BY owner, name", args...)
+}
+
+// target describes where requested path lives after mapping user's view into the owner's namespace
+type target struct {
+	// user whose namespace contains the entry
+	owner string
+	// filename in the owner's namespace
+	name string
+	// share which grants access to the entry, nil for the user's own namespace
+	share *Share
+	// synthesized directory for /Shared and /Shared/<owner>
+	virtual *DirEntry
+}
+
+func (t *target) writable() bool {
+	return t.virtual == nil && (t.share == nil || t.share.Writable())
+}
+
+// inside returns false if @name escapes the shared directory, for instance via symbolic link
+func (t *target) inside(name string) bool {
+	if t.share == nil || t.share.Path == "/" {
+		return true
+	}
+
+	return name == t.share.Path || strings.HasPrefix(name, t.share.Path + "/")
+}
+
+// share_root returns true if @ent is the shared directory itself, its parent is not accessible to the grantee
+func (t *target) share_root(ent *DirEntry) bool {
+	return t.share != nil && ent.Filename == t.share.Path
+}
+
+func (ctl *DbFSUser) virtual_dir(name string) *DirEntry {
+	return &DirEntry {
+		Username: ctl.Username,
+		Filename: name,
+		Fname: path.Base(name),
+		Fmode: os.ModeDir | 0555,
+	}
+}
+
+// real_shared returns true if the user has real /Shared entry which has been created before shares were introduced,
+// it takes precedence over the virtual directory, so its content stays accessible
+func (ctl *DbFSUser) real_shared() bool {
+	ent := NewDirEntryNil(ctl.Username, SharedRoot)
+	return ctl.FS.StatEntry(ctl.context(), ent) == nil
+}
+
+// mount maps @name from the user's view into the namespace of the user who owns it
+func (ctl *DbFSUser) mount(name string) (*target, error) {
+	name = path.Clean("/" + name)
+
+	if ctl.Root != nil {
+		return &target {
+			owner: ctl.Root.Owner,
+			name: path.Join(ctl.Root.Path, name),
+			share: ctl.Root,
+		}, nil
+	}
+
+	if (name != SharedRoot && !strings.HasPrefix(name, SharedRoot + "/")) || ctl.real_shared() {
+		return &target {
+			owner: ctl.Username,
+			name: name,
+		}, nil
+	}
+
+	if name == SharedRoot {
+		return &target {
+			owner: ctl.Username,
+			name: name,
+			virtual: ctl.virtual_dir(name),
+		}, nil
+	}
+
+	shares, err := ctl.FS.ListSharesGrantee(ctl.context(), ctl.Username, ctl.Groups)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(name, SharedRoot + "/"), "/", 3)
+	owner := parts[0]
+
+	var share *Share
+	for _, s := range shares {
+		if s.Owner != owner {
+			continue
+		}
+
+		if len(parts) == 1 {
+			return &target {
+				owner: ctl.Username,
+				name: name,
+				virtual: ctl.virtual_dir(name),
+			}, nil
+		}
+
+		// the same folder can be granted both to the user and to the group, the strongest grant wins
+		if s.Name == parts[1] && (share == nil || s.Writable()) {
+			share = s
+		}
+	}
+
+	if share == nil {
+		return nil, os.ErrNotExist
+	}
+
+	real_name := share.Path
+	if len(parts) == 3 {
+		real_name = path.Join(share.Path, parts[2])
+	}
+
+	return &target {
+		owner: owner,
+		name: real_name,
+		share: share,
+	}, nil
+}
+
+// resolve maps @name into the owner's namespace and follows symbolic links the same way ResolvePath() does
+func (ctl *DbFSUser) resolve(name string, follow bool) (*target, error) {
+	t, err := ctl.mount(name)
+	if err != nil || t.virtual != nil {
+		return t, err
+	}
+
+	t.name, err = ctl.ResolvePath(ctl.context(), t.owner, t.name, follow)
+	if err != nil {
+		return nil, err
+	}
+
+	if !t.inside(t.name) {
+		return nil, os.ErrPermission
+	}
+
+	return t, nil
+}
+
+func (ctl *DbFSUser) check_parent(t *target, ent *DirEntry, want os.FileMode) error {
+	if t.share_root(ent) {
+		return nil
+	}
+
+	return ctl.CheckParentAccess(ent, want)
+}
+
+// virtual_entries returns content of /Shared (owners) or /Shared/<owner> (share names) sorted by name
+func (ctl *DbFSUser) virtual_entries(dir *DirEntry) ([]*DirEntry, error) {
+	shares, err := ctl.FS.ListSharesGrantee(ctl.context(), ctl.Username, ctl.Groups)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for _, s := range shares {
+		if dir.Filename == SharedRoot {
+			names[s.Owner] = true
+		} else if path.Join(SharedRoot, s.Owner) == dir.Filename {
+			names[s.Name] = true
+		}
+	}
+
+	sorted := make([]string, 0, len(names))
+	for n := range names {
+		sorted = append(sorted, n)
+	}
+	sort.Strings(sorted)
+
+	ret := make([]*DirEntry, 0, len(sorted))
+	for _, n := range sorted {
+		ret = append(ret, ctl.virtual_dir(path.Join(dir.Filename, n)))
+	}
+
+	return ret, nil
+}
+
+// has_shares returns true if there is at least one folder shared with the user, /Shared is listed in the root directory only in this case
+func (ctl *DbFSUser) has_shares() bool {
+	shares, err := ctl.FS.ListSharesGrantee(ctl.context(), ctl.Username, ctl.Groups)
+	return err == nil && len(shares) != 0
+}
@@ -0,0 +1,88 @@
+package dbfs
+
+import (
+	"os"
+	"testing"
+)
+
+func TestTargetInside(t *testing.T) {
+	tests := []struct {
+		share		*Share
+		name		string
+		inside		bool
+	} {
+		{ nil, "/anything", true },
+		{ &Share { Path: "/" }, "/anything", true },
+		{ &Share { Path: "/pub" }, "/pub", true },
+		{ &Share { Path: "/pub" }, "/pub/file", true },
+		{ &Share { Path: "/pub" }, "/pub/dir/file", true },
+		{ &Share { Path: "/pub" }, "/public", false },
+		{ &Share { Path: "/pub" }, "/pu", false },
+		{ &Share { Path: "/pub" }, "/", false },
+		{ &Share { Path: "/pub" }, "/secret", false },
+	}
+
+	for _, test := range tests {
+		tg := &target { share: test.share }
+		if got := tg.inside(test.name); got != test.inside {
+			t.Errorf("share: %+v, name: %s: inside: %v, want %v", test.share, test.name, got, test.inside)
+		}
+	}
+}
+
+// symbolic links inside of the shared directory must not give access to the rest of the owner's namespace
+func TestResolveShare(t *testing.T) {
+	fs := new_test_fs(t, []*DirEntry {
+		test_dir("alice", "/"),
+		test_dir("alice", "/pub"),
+		test_file("alice", "/pub/file"),
+		test_dir("alice", "/secret"),
+		test_file("alice", "/secret/file"),
+		test_link("alice", "/pub/abs", "/pub/file"),
+		test_link("alice", "/pub/rel", "file"),
+		test_link("alice", "/pub/out", "/secret/file"),
+		test_link("alice", "/pub/up", "../secret/file"),
+		test_link("alice", "/pub/outdir", "/secret"),
+		test_link("alice", "/pub/sibling", "/public"),
+	})
+
+	u := &DbFSUser {
+		FS: fs,
+		Root: &Share { Owner: "alice", Path: "/pub", Access: AccessReadWrite },
+	}
+
+	tests := []struct {
+		name		string
+		follow		bool
+		want		string
+		err		error
+	} {
+		{ "/", true, "/pub", nil },
+		{ "/file", true, "/pub/file", nil },
+		{ "/../secret/file", true, "/pub/secret/file", nil },
+		{ "/abs", true, "/pub/file", nil },
+		{ "/rel", true, "/pub/file", nil },
+		{ "/out", false, "/pub/out", nil },
+		{ "/out", true, "", os.ErrPermission },
+		{ "/up", true, "", os.ErrPermission },
+		{ "/outdir", true, "", os.ErrPermission },
+		{ "/outdir/file", false, "", os.ErrPermission },
+		{ "/outdir/new", false, "", os.ErrPermission },
+		{ "/sibling", true, "", os.ErrPermission },
+	}
+
+	for _, test := range tests {
+		tg, err := u.resolve(test.name, test.follow)
+		if err != test.err {
+			t.Errorf("%s: follow: %v: error: %v, want %v", test.name, test.follow, err, test.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		if tg.owner != "alice" || tg.name != test.want {
+			t.Errorf("%s: follow: %v: resolved to %s:%s, want alice:%s", test.name, test.follow, tg.owner, tg.name, test.want)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package dbfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/bioothod/wd2/reqlog"
+	"github.com/golang/glog"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// maximum number of symbolic links followed while resolving single path, the same as linux MAXSYMLINKS
+const MaxSymlinkHops = 40
+
+var ErrSymlinkLoop = errors.New("too many levels of symbolic links")
+
+func (ent *DirEntry) IsSymlink() bool {
+	return ent.Mode() & os.ModeSymlink != 0
+}
+
+// LinkTarget returns absolute path the symbolic link points to,
+// relative targets are resolved against the directory of the link,
+// targets which escape user's root directory are not allowed
+func (ent *DirEntry) LinkTarget() (string, error) {
+	target := ent.Target
+	if !strings.HasPrefix(target, "/") {
+		target = path.Dir(ent.Filename) + "/" + target
+	}
+
+	parts := make([]string, 0)
+	for _, c := range strings.Split(target, "/") {
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			if len(parts) == 0 {
+				return "", os.ErrPermission
+			}
+			parts = parts[:len(parts) - 1]
+		default:
+			parts = append(parts, c)
+		}
+	}
+
+	return "/" + strings.Join(parts, "/"), nil
+}
+
+// resolve_parents walks @name from the root directory and replaces the first symbolic link among its parents
+// with the link target, returns false if there are no symbolic links in the parent directories
+func (ctl *DbFSUser) resolve_parents(username, name string) (string, bool, error) {
+	parts := strings.Split(strings.TrimPrefix(name, "/"), "/")
+
+	prefix := ""
+	for i := 0; i < len(parts) - 1; i++ {
+		prefix += "/" + parts[i]
+
+		ent := NewDirEntryNil(username, prefix)
+		err := ctl.FS.StatEntry(ctl.context(), ent)
+		if err != nil {
+			return name, false, nil
+		}
+
+		if ent.IsSymlink() {
+			target, err := ent.LinkTarget()
+			if err != nil {
+				return "", false, err
+			}
+
+			return path.Join(target, strings.Join(parts[i + 1:], "/")), true, nil
+		}
+
+		if !ent.IsDir() {
+			return name, false, nil
+		}
+	}
+
+	return name, false, nil
+}
+
+// ResolvePath returns real filename of @name in the user's namespace.
+// Symbolic links in the parent directories are always followed, the last component is followed only if @follow is set,
+// it does not have to exist, so returned path can be used to create new entries.
+func (ctl *DbFSUser) ResolvePath(ctx context.Context, username, name string, follow bool) (string, error) {
+	ctl = ctl.bind(ctx)
+
+	name = path.Clean("/" + name)
+	orig := name
+
+	for hops := 0; ; hops++ {
+		if hops > MaxSymlinkHops {
+			glog.Errorf("resolve: username: %s, filename: %s: %v", username, orig, ErrSymlinkLoop)
+			return "", ErrSymlinkLoop
+		}
+
+		ent := NewDirEntryNil(username, name)
+		err := ctl.FS.StatEntry(ctl.context(), ent)
+		if err == nil {
+			if !follow || !ent.IsSymlink() {
+				return name, nil
+			}
+
+			name, err = ent.LinkTarget()
+			if err != nil {
+				return "", fmt.Errorf("resolve: username: %s, filename: %s: link %s points outside of the root directory",
+					username, orig, ent.Filename)
+			}
+			continue
+		}
+
+		resolved, changed, err := ctl.resolve_parents(username, name)
+		if err != nil {
+			return "", fmt.Errorf("resolve: username: %s, filename: %s: link in %s points outside of the root directory",
+				username, orig, name)
+		}
+		if !changed {
+			return name, nil
+		}
+
+		name = resolved
+	}
+}
+
+// lookup resolves @name and returns its real filename and the symbolic link which has been followed
+// if the last component of @name is a link
+func (ctl *DbFSUser) lookup(username, name string) (string, *DirEntry, error) {
+	lname, err := ctl.ResolvePath(ctl.context(), username, name, false)
+	if err != nil {
+		return "", nil, err
+	}
+
+	link := NewDirEntryNil(username, lname)
+	err = ctl.FS.StatEntry(ctl.context(), link)
+	if err != nil || !link.IsSymlink() {
+		return lname, nil, nil
+	}
+
+	real_name, err := ctl.ResolvePath(ctl.context(), username, lname, true)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return real_name, link, nil
+}
+
+// Symlink creates symbolic link @name pointing to @target, target does not have to exist
+func (ctl *DbFSUser) Symlink(ctx context.Context, target, name string) error {
+	ctl = ctl.bind(ctx)
+	start := time.Now()
+	err := ctl.symlink(target, name)
+	ctl.oplog("symlink", start, reqlog.Fields { "path": name, "target": target }, err)
+	return err
+}
+
+func (ctl *DbFSUser) symlink(target, name string) error {
+	if target == "" {
+		return os.ErrInvalid
+	}
+
+	t, err := ctl.resolve(name, false)
+	if err != nil {
+		return err
+	}
+
+	if !t.writable() {
+		return os.ErrPermission
+	}
+
+	ent, err := ctl.NewDirEntry(t.owner, t.name)
+	if err != nil {
+		glog.Errorf("symlink: username: %s, filename: %s: could not create new entry: %v", ctl.Username, name, err)
+		return err
+	}
+
+	if ent.Filename == "/" {
+		return os.ErrInvalid
+	}
+
+	if t.share_root(ent) {
+		return os.ErrPermission
+	}
+
+	err = ctl.CheckParentAccess(ent, PermWrite | PermExec)
+	if err != nil {
+		return err
+	}
+
+	ent.Fmode = os.ModeSymlink | 0777
+	ent.Target = target
+	ent.Fsize = uint64(len(target))
+
+	err = ctl.FS.InsertEntry(ctl.context(), ent)
+	if err != nil {
+		glog.Errorf("symlink: %s: could not insert new entry: %v", ent.String(), err)
+		return err
+	}
+
+	return nil
+}
+
+// set_link_target turns an empty regular file into a symbolic link or updates target of the existing link
+func (f *File) set_link_target(target string) error {
+	ent := f.Link
+	if ent == nil {
+		if f.Info.IsDir() || f.Info.Size() != 0 || f.Info.Bucket != "" {
+			return os.ErrInvalid
+		}
+
+		ent = f.Info
+	}
+
+	ent.Fmode = os.ModeSymlink | 0777
+	ent.Target = target
+	ent.Fsize = uint64(len(target))
+
+	err := f.User.FS.UpdateEntry(f.User.context(), ent)
+	if err != nil {
+		return err
+	}
+
+	f.Link = ent
+	return nil
+}
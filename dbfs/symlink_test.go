@@ -0,0 +1,186 @@
+package dbfs
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+)
+
+// empty_driver is the database which has no rows, entries only exist in the metadata cache of the test filesystem
+type empty_driver struct {}
+type empty_conn struct {}
+type empty_stmt struct {}
+type empty_rows struct {}
+
+func (d empty_driver) Open(name string) (driver.Conn, error) { return empty_conn {}, nil }
+
+func (c empty_conn) Prepare(query string) (driver.Stmt, error) { return empty_stmt {}, nil }
+func (c empty_conn) Close() error { return nil }
+func (c empty_conn) Begin() (driver.Tx, error) { return nil, errors.New("transactions are not supported") }
+
+func (s empty_stmt) Close() error { return nil }
+func (s empty_stmt) NumInput() int { return -1 }
+func (s empty_stmt) Exec(args []driver.Value) (driver.Result, error) { return driver.RowsAffected(0), nil }
+func (s empty_stmt) Query(args []driver.Value) (driver.Rows, error) { return empty_rows {}, nil }
+
+func (r empty_rows) Columns() []string { return []string {} }
+func (r empty_rows) Close() error { return nil }
+func (r empty_rows) Next(dest []driver.Value) error { return io.EOF }
+
+func init() {
+	sql.Register("wd2_empty", empty_driver {})
+}
+
+// new_test_fs returns filesystem which contains only @ents
+func new_test_fs(t *testing.T, ents []*DirEntry) *DbFS {
+	db, err := sql.Open("wd2_empty", "")
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	cache, err := NewMetaCache(&CacheCtl { Size: len(ents) + 1 })
+	if err != nil {
+		t.Fatalf("could not create cache: %v", err)
+	}
+
+	for _, ent := range ents {
+		cache.Put(ent, cache.Generation())
+	}
+
+	return &DbFS {
+		db: db,
+		cache: cache,
+	}
+}
+
+func test_dir(username, filename string) *DirEntry {
+	ent := NewDirEntryNil(username, filename)
+	ent.Fmode = os.ModeDir | 0755
+	return ent
+}
+
+func test_file(username, filename string) *DirEntry {
+	ent := NewDirEntryNil(username, filename)
+	ent.Fmode = 0644
+	return ent
+}
+
+func test_link(username, filename, target string) *DirEntry {
+	ent := NewDirEntryNil(username, filename)
+	ent.Fmode = os.ModeSymlink | 0777
+	ent.Target = target
+	return ent
+}
+
+func TestLinkTarget(t *testing.T) {
+	tests := []struct {
+		filename	string
+		target		string
+		want		string
+		err		error
+	} {
+		{ "/a/link", "b", "/a/b", nil },
+		{ "/a/link", "./b/./c/", "/a/b/c", nil },
+		{ "/a/link", "../b", "/b", nil },
+		{ "/a/link", "/x/y", "/x/y", nil },
+		{ "/a/link", "/x/../y", "/y", nil },
+		{ "/link", "/", "/", nil },
+		{ "/a/link", "../../b", "", os.ErrPermission },
+		{ "/link", "..", "", os.ErrPermission },
+		{ "/a/link", "/../b", "", os.ErrPermission },
+	}
+
+	for _, test := range tests {
+		got, err := test_link("alice", test.filename, test.target).LinkTarget()
+		if err != test.err || got != test.want {
+			t.Errorf("%s -> %s: LinkTarget() = %q, %v, want %q, %v", test.filename, test.target, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestResolvePath(t *testing.T) {
+	ents := []*DirEntry {
+		test_dir("alice", "/"),
+		test_dir("alice", "/d"),
+		test_file("alice", "/d/file"),
+		test_link("alice", "/abs", "/d/file"),
+		test_link("alice", "/rel", "d/file"),
+		test_link("alice", "/dir", "/d"),
+		test_link("alice", "/d/up", "../d/file"),
+		test_link("alice", "/escape", "../secret"),
+		test_link("alice", "/d/escape", "../../secret"),
+		test_link("alice", "/loop1", "/loop2"),
+		test_link("alice", "/loop2", "loop1"),
+		test_link("alice", "/self", "self"),
+		test_link("alice", "/dangling", "/d/missing"),
+	}
+
+	// chain of exactly MaxSymlinkHops links is followed, one more link is a loop
+	for i := 0; i < MaxSymlinkHops; i++ {
+		target := fmt.Sprintf("/a%d", i + 1)
+		if i == MaxSymlinkHops - 1 {
+			target = "/d/file"
+		}
+		ents = append(ents, test_link("alice", fmt.Sprintf("/a%d", i), target))
+	}
+	for i := 0; i <= MaxSymlinkHops; i++ {
+		target := fmt.Sprintf("/b%d", i + 1)
+		if i == MaxSymlinkHops {
+			target = "/d/file"
+		}
+		ents = append(ents, test_link("alice", fmt.Sprintf("/b%d", i), target))
+	}
+
+	u := &DbFSUser {
+		FS: new_test_fs(t, ents),
+		Username: "alice",
+	}
+
+	tests := []struct {
+		name		string
+		follow		bool
+		want		string
+		// ErrSymlinkLoop or any other error if it is not nil
+		err		error
+	} {
+		{ "/d/file", true, "/d/file", nil },
+		{ "/d/../d/./file", true, "/d/file", nil },
+		{ "/new", true, "/new", nil },
+		{ "/abs", true, "/d/file", nil },
+		{ "/abs", false, "/abs", nil },
+		{ "/rel", true, "/d/file", nil },
+		{ "/d/up", true, "/d/file", nil },
+		{ "/dir/file", false, "/d/file", nil },
+		{ "/dir/new", false, "/d/new", nil },
+		{ "/dir/up", true, "/d/file", nil },
+		{ "/dangling", true, "/d/missing", nil },
+		{ "/escape", false, "/escape", nil },
+		{ "/escape", true, "", os.ErrPermission },
+		{ "/d/escape", true, "", os.ErrPermission },
+		{ "/escape/file", false, "", os.ErrPermission },
+		{ "/loop1", true, "", ErrSymlinkLoop },
+		{ "/loop1", false, "/loop1", nil },
+		{ "/loop1/file", false, "", ErrSymlinkLoop },
+		{ "/self", true, "", ErrSymlinkLoop },
+		{ "/a0", true, "/d/file", nil },
+		{ "/b0", true, "", ErrSymlinkLoop },
+	}
+
+	for _, test := range tests {
+		got, err := u.ResolvePath(context.Background(), "alice", test.name, test.follow)
+		if (err != nil) != (test.err != nil) || (test.err == ErrSymlinkLoop && err != ErrSymlinkLoop) {
+			t.Errorf("%s: follow: %v: error: %v, want %v", test.name, test.follow, err, test.err)
+			continue
+		}
+
+		if got != test.want {
+			t.Errorf("%s: follow: %v: resolved to %q, want %q", test.name, test.follow, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package dbfs
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	"os"
+	"time"
+)
+
+type Usage struct {
+	Files			int64		`json:"files"`
+	Dirs			int64		`json:"dirs"`
+	Symlinks		int64		`json:"symlinks"`
+	Bytes			uint64		`json:"bytes"`
+	Shares			int64		`json:"shares"`
+	Links			int64		`json:"links"`
+}
+
+func (u *Usage) String() string {
+	return fmt.Sprintf("files: %d, dirs: %d, symlinks: %d, bytes: %d, shares: %d, links: %d",
+		u.Files, u.Dirs, u.Symlinks, u.Bytes, u.Shares, u.Links)
+}
+
+// Usage returns number of entries and amount of data stored by the user
+func (ctl *DbFS) Usage(ctx context.Context, username string) (*Usage, error) {
+	end := start_query(ctx, "Usage")
+	defer end()
+
+	var u Usage
+
+	err := ctl.db.QueryRowContext(ctx, "SELECT " +
+			"COALESCE(SUM((mode & ?) != 0), 0), COALESCE(SUM((mode & ?) != 0), 0), COUNT(*), " +
+			"COALESCE(SUM(IF((mode & ?) = 0, size, 0)), 0) " +
+			"FROM dirs WHERE username=?",
+		uint32(os.ModeDir), uint32(os.ModeSymlink), uint32(os.ModeDir | os.ModeSymlink), username).
+		Scan(&u.Dirs, &u.Symlinks, &u.Files, &u.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not read usage of user %s: %v", username, err)
+	}
+	u.Files -= u.Dirs + u.Symlinks
+
+	err = ctl.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM shares WHERE owner=?", username).Scan(&u.Shares)
+	if err != nil {
+		return nil, fmt.Errorf("could not read shares of user %s: %v", username, err)
+	}
+
+	err = ctl.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM links WHERE owner=?", username).Scan(&u.Links)
+	if err != nil {
+		return nil, fmt.Errorf("could not read links of user %s: %v", username, err)
+	}
+
+	return &u, nil
+}
+
+// scan_data_entries returns at most @limit entries of the user which have data in elliptics,
+// sorted by filename which is strictly greater than @after
+func (ctl *DbFS) scan_data_entries(ctx context.Context, username, after string, limit int) ([]*DirEntry, error) {
+	end := start_query(ctx, "scan_data_entries")
+	defer end()
+
+	rows, err := ctl.db.QueryContext(ctx, "SELECT " + dirsColumns + " FROM dirs WHERE username=? AND bucket != '' AND filename > ? " +
+		"ORDER BY filename LIMIT ?",
+		username, after, limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not read entries of user %s: %v", username, err)
+	}
+	defer rows.Close()
+
+	entries := make([]*DirEntry, 0, limit)
+	for rows.Next() {
+		var e DirEntry
+
+		err = scan_entry(rows, &e)
+		if err != nil {
+			return nil, fmt.Errorf("database schema mismatch: %v", err)
+		}
+
+		entries = append(entries, &e)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not scan database: %v", err)
+	}
+
+	return entries, nil
+}
+
+// PurgeUser removes all data, directory entries, shares and links of the user.
+// Entries are deleted one by one after their data has been removed from elliptics,
+// so if some removals fail, purge can be restarted and it will only process what is left.
+func (ctl *DbFS) PurgeUser(ctx context.Context, username string) error {
+	// purge may run for a long time, processor is kept alive until it completes even if it is replaced
+	bp := ctl.bucket_processor()
+	if bp == nil {
+		return fmt.Errorf("purge: username: %s: bucket processor is not initialized", username)
+	}
+	defer bp.release()
+
+	u := (&DbFSUser {
+		FS: ctl,
+		Username: username,
+	}).bind(ctx)
+
+	failed := 0
+	after := ""
+	for {
+		entries, err := ctl.scan_data_entries(ctx, username, after, ReaddirBatch)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			break
+		}
+
+		for _, ent := range entries {
+			after = ent.Filename
+
+			f := &File {
+				User: u,
+				Info: ent,
+			}
+
+			err = f.RemoveData()
+			if err != nil {
+				glog.Errorf("purge: %s: could not remove data from elliptics: %v", ent.String(), err)
+				failed++
+				continue
+			}
+
+			err = ctl.DeleteEntry(ctx, ent)
+			if err != nil {
+				return fmt.Errorf("purge: %v", err)
+			}
+		}
+	}
+
+	if failed != 0 {
+		return fmt.Errorf("purge: username: %s: could not remove data of %d entries, metadata has been kept, restart purge", username, failed)
+	}
+
+	for _, q := range []string {
+		"DELETE FROM dirs WHERE username=?",
+		"DELETE FROM links WHERE owner=?",
+		"DELETE FROM shares WHERE owner=?",
+	} {
+		_, err := ctl.db.ExecContext(ctx, q, username)
+		if err != nil {
+			return fmt.Errorf("purge: username: %s: %v", username, err)
+		}
+	}
+
+	_, err := ctl.db.ExecContext(ctx, "DELETE FROM shares WHERE grantee=? AND grantee_type=?", username, GranteeUser)
+	if err != nil {
+		return fmt.Errorf("purge: username: %s: could not delete shares granted to the user: %v", username, err)
+	}
+
+	ctl.cache.Flush()
+
+	glog.Infof("purge: username: %s: all data has been removed", username)
+	return nil
+}
+
+// RenameUser moves the whole namespace, shares, links and quota of the user to the new name,
+// keys of the data in elliptics are stored in the entries and do not change
+func (ctl *DbFS) RenameUser(ctx context.Context, username, new_username string) error {
+	end := start_query(ctx, "RenameUser")
+	defer end()
+
+	for _, q := range []string {
+		"UPDATE dirs SET username=? WHERE username=?",
+		"UPDATE links SET owner=? WHERE owner=?",
+		"UPDATE shares SET owner=? WHERE owner=?",
+		"UPDATE quotas SET username=? WHERE username=?",
+	} {
+		_, err := ctl.db.ExecContext(ctx, q, new_username, username)
+		if err != nil {
+			return fmt.Errorf("rename: username: %s -> %s: %v", username, new_username, err)
+		}
+	}
+
+	_, err := ctl.db.ExecContext(ctx, "UPDATE shares SET grantee=? WHERE grantee=? AND grantee_type=?", new_username, username, GranteeUser)
+	if err != nil {
+		return fmt.Errorf("rename: username: %s -> %s: could not update shares granted to the user: %v", username, new_username, err)
+	}
+
+	ctl.cache.Flush()
+
+	glog.Infof("rename: username: %s -> %s: namespace has been renamed", username, new_username)
+	return nil
+}
+
+type UserUsage struct {
+	Username		string		`json:"username"`
+	Entries			int64		`json:"entries"`
+	Bytes			uint64		`json:"bytes"`
+}
+
+type BucketUsage struct {
+	Bucket			string		`json:"bucket"`
+	Objects			int64		`json:"objects"`
+	Bytes			uint64		`json:"bytes"`
+}
+
+// UsageByUser returns number of entries and amount of data of every user sorted by username
+func (ctl *DbFS) UsageByUser(ctx context.Context) ([]*UserUsage, error) {
+	end := start_query(ctx, "UsageByUser")
+	defer end()
+
+	rows, err := ctl.db.QueryContext(ctx, "SELECT username, COUNT(*), COALESCE(SUM(IF((mode & ?) = 0, size, 0)), 0) FROM dirs " +
+		"GROUP BY username ORDER BY username", uint32(os.ModeDir | os.ModeSymlink))
+	if err != nil {
+		return nil, fmt.Errorf("could not read usage: %v", err)
+	}
+	defer rows.Close()
+
+	ret := make([]*UserUsage, 0)
+	for rows.Next() {
+		var u UserUsage
+
+		err = rows.Scan(&u.Username, &u.Entries, &u.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("database schema mismatch: %v", err)
+		}
+
+		ret = append(ret, &u)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not scan database: %v", err)
+	}
+
+	return ret, nil
+}
+
+// UsageByBucket returns number of objects and amount of data stored in every elliptics bucket
+func (ctl *DbFS) UsageByBucket(ctx context.Context) ([]*BucketUsage, error) {
+	end := start_query(ctx, "UsageByBucket")
+	defer end()
+
+	rows, err := ctl.db.QueryContext(ctx, "SELECT bucket, COUNT(*), COALESCE(SUM(size), 0) FROM dirs WHERE bucket != '' " +
+		"GROUP BY bucket ORDER BY bucket")
+	if err != nil {
+		return nil, fmt.Errorf("could not read bucket usage: %v", err)
+	}
+	defer rows.Close()
+
+	ret := make([]*BucketUsage, 0)
+	for rows.Next() {
+		var b BucketUsage
+
+		err = rows.Scan(&b.Bucket, &b.Objects, &b.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("database schema mismatch: %v", err)
+		}
+
+		ret = append(ret, &b)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not scan database: %v", err)
+	}
+
+	return ret, nil
+}
+
+// DeleteExpiredLinks removes links which have expired or reached their download limit
+func (ctl *DbFS) DeleteExpiredLinks(ctx context.Context) (int64, error) {
+	end := start_query(ctx, "DeleteExpiredLinks")
+	defer end()
+
+	res, err := ctl.db.ExecContext(ctx, "DELETE FROM links WHERE (expires IS NOT NULL AND expires < ?) OR " +
+		"(max_downloads != 0 AND downloads >= max_downloads)", time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("could not delete expired links: %v", err)
+	}
+
+	n, _ := res.RowsAffected()
+	return n, nil
+}
+
+// FlushCache drops all cached metadata of this instance
+func (ctl *DbFS) FlushCache() {
+	ctl.cache.Flush()
+}
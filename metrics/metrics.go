@@ -0,0 +1,130 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const Namespace = "wd2"
+
+const (
+	AuthSuccess = "success"
+	AuthFailure = "failure"
+	// request has been rejected by the lockout before credentials were checked
+	AuthLocked = "locked"
+)
+
+var (
+	WebdavRequests = prometheus.NewCounterVec(prometheus.CounterOpts {
+		Namespace: Namespace,
+		Subsystem: "webdav",
+		Name: "requests_total",
+		Help: "Number of webdav requests by method and response status.",
+	}, []string { "method", "status" })
+
+	WebdavDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts {
+		Namespace: Namespace,
+		Subsystem: "webdav",
+		Name: "request_duration_seconds",
+		Help: "Latency of webdav requests by method.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string { "method" })
+
+	DataBytes = prometheus.NewCounterVec(prometheus.CounterOpts {
+		Namespace: Namespace,
+		Subsystem: "dbfs",
+		Name: "data_bytes_total",
+		Help: "Number of bytes read from and written to the blob store by method.",
+	}, []string { "method" })
+
+	BlobErrors = prometheus.NewCounterVec(prometheus.CounterOpts {
+		Namespace: Namespace,
+		Subsystem: "dbfs",
+		Name: "blob_errors_total",
+		Help: "Number of failed blob store operations by operation, bucket and its groups.",
+	}, []string { "operation", "bucket", "groups" })
+
+	QueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts {
+		Namespace: Namespace,
+		Subsystem: "dbfs",
+		Name: "query_duration_seconds",
+		Help: "Latency of the metadata database queries by DbFS method.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 4, 9),
+	}, []string { "method" })
+
+	AuthAttempts = prometheus.NewCounterVec(prometheus.CounterOpts {
+		Namespace: Namespace,
+		Subsystem: "auth",
+		Name: "attempts_total",
+		Help: "Number of authentication attempts by method and result.",
+	}, []string { "method", "result" })
+)
+
+func init() {
+	prometheus.MustRegister(WebdavRequests, WebdavDuration, DataBytes, BlobErrors, QueryDuration, AuthAttempts)
+}
+
+// RegisterActiveLocks exports number of active webdav locks returned by @count
+func RegisterActiveLocks(count func() float64) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts {
+		Namespace: Namespace,
+		Subsystem: "webdav",
+		Name: "active_locks",
+		Help: "Number of webdav locks which have not been released and have not expired.",
+	}, count))
+}
+
+// RegisterCache exports hit and miss counters of the metadata cache returned by @stats
+func RegisterCache(stats func() (hits, misses uint64)) {
+	prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts {
+		Namespace: Namespace,
+		Subsystem: "cache",
+		Name: "hits_total",
+		Help: "Number of directory entry lookups served by the metadata cache.",
+	}, func() float64 {
+		hits, _ := stats()
+		return float64(hits)
+	}))
+
+	prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts {
+		Namespace: Namespace,
+		Subsystem: "cache",
+		Name: "misses_total",
+		Help: "Number of directory entry lookups which missed the metadata cache and went to the database.",
+	}, func() float64 {
+		_, misses := stats()
+		return float64(misses)
+	}))
+}
+
+// ObserveQuery records latency of the database query started at @start, it is supposed to be deferred
+func ObserveQuery(method string, start time.Time) {
+	QueryDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+func AddDataBytes(method string, n int64) {
+	if n > 0 {
+		DataBytes.WithLabelValues(method).Add(float64(n))
+	}
+}
+
+func BlobError(op, bucket string, groups []uint32) {
+	g := make([]string, 0, len(groups))
+	for _, group := range groups {
+		g = append(g, strconv.FormatUint(uint64(group), 10))
+	}
+
+	BlobErrors.WithLabelValues(op, bucket, strings.Join(g, ",")).Inc()
+}
+
+func Auth(method, result string) {
+	AuthAttempts.WithLabelValues(method, result).Inc()
+}
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -3,18 +3,63 @@ package auth
 import (
 	_ "github.com/go-sql-driver/mysql"
 
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"github.com/bioothod/wd2/metrics"
 	"github.com/golang/glog"
 	"github.com/zenazn/goji/web"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 )
 
-const AuthUsernameString = "Username"
+const (
+	AuthUsernameString = "Username"
+	AuthRoleString = "Role"
+	AuthGroupsString = "Groups"
+	// identifier of the application password or api token used to authenticate request, empty for the primary password
+	AuthTokenString = "Token"
+)
+
+const (
+	RoleAdmin = "admin"
+	RoleUser = "user"
+	RoleReadOnly = "read-only"
+)
+
+var ErrUserDisabled = errors.New("user is disabled")
+var ErrUserNotFound = errors.New("user not found")
+
+func ValidRole(role string) bool {
+	return role == RoleAdmin || role == RoleUser || role == RoleReadOnly
+}
+
+// Authenticator verifies username and password of the user and fills its role and groups
+type Authenticator interface {
+	Authenticate(mbox *Mailbox) error
+	Close()
+}
+
+// reload_notifier is implemented by authenticators which reload their users on their own,
+// cached credentials are flushed every time they do it
+type reload_notifier interface {
+	OnReload(fn func())
+}
 
 type AuthCtl struct {
 	db		*sql.DB
+
+	// authenticator, lockout and credential cache can be replaced while requests are served
+	lock		sync.RWMutex
+	backend		Authenticator
+	lockout		*lockout_guard
+	creds		*cred_cache
+
+	// last use times of the tokens served from the credential cache which are being written
+	touches		sync.WaitGroup
 }
 
 func NewAuthCtl(dbtype, dbparams string) (*AuthCtl, error) {
@@ -26,29 +71,149 @@ func NewAuthCtl(dbtype, dbparams string) (*AuthCtl, error) {
 	ctl := &AuthCtl {
 		db:		db,
 	}
+	ctl.backend = &sql_authenticator { ctl: ctl }
 
 	return ctl, nil
 }
 
+// NewAuthCtlWithoutDatabase creates controller which only checks primary passwords with @a,
+// application passwords, tokens, groups and user management are not available
+func NewAuthCtlWithoutDatabase(a Authenticator) *AuthCtl {
+	ctl := &AuthCtl {
+		backend:	a,
+	}
+	ctl.notify_reload(a)
+
+	return ctl
+}
+
+func (ctl *AuthCtl) notify_reload(a Authenticator) {
+	if n, ok := a.(reload_notifier); ok {
+		n.OnReload(func() {
+			ctl.cache().flush()
+		})
+	}
+}
+
+// HasDatabase returns false if controller has been created without auth database
+func (ctl *AuthCtl) HasDatabase() bool {
+	return ctl.db != nil
+}
+
+// SetAuthenticator replaces the users table with another source of primary passwords,
+// application passwords and tokens are always checked against the auth database.
+// Nil @a switches back to the users table, it is not allowed for controller without database.
+func (ctl *AuthCtl) SetAuthenticator(a Authenticator) {
+	if a == nil {
+		a = &sql_authenticator { ctl: ctl }
+	}
+
+	ctl.notify_reload(a)
+
+	ctl.lock.Lock()
+	old := ctl.backend
+	ctl.backend = a
+	ctl.lock.Unlock()
+
+	// credentials verified by the old backend may not be valid anymore
+	ctl.cache().flush()
+	old.Close()
+}
+
+func (ctl *AuthCtl) authenticator() Authenticator {
+	ctl.lock.RLock()
+	defer ctl.lock.RUnlock()
+
+	return ctl.backend
+}
+
+func (ctl *AuthCtl) guard() *lockout_guard {
+	ctl.lock.RLock()
+	defer ctl.lock.RUnlock()
+
+	return ctl.lockout
+}
+
+func (ctl *AuthCtl) cache() *cred_cache {
+	ctl.lock.RLock()
+	defer ctl.lock.RUnlock()
+
+	return ctl.creds
+}
+
 func (ctl *AuthCtl) Close() {
-	ctl.db.Close()
+	ctl.lock.Lock()
+	lockout := ctl.lockout
+	ctl.lockout = nil
+	ctl.lock.Unlock()
+
+	if lockout != nil {
+		lockout.close()
+	}
+	ctl.authenticator().Close()
+	if ctl.db != nil {
+		ctl.touches.Wait()
+		ctl.db.Close()
+	}
+}
+
+// touch_token writes last use time of the token served from the credential cache,
+// it is done in background and at most once per LastUsedInterval for every cached token
+func (ctl *AuthCtl) touch_token(creds *cred_cache, key, id string) {
+	now := time.Now()
+	if !creds.touch(key, now) {
+		return
+	}
+
+	ctl.touches.Add(1)
+	go func() {
+		defer ctl.touches.Done()
+
+		_, err := ctl.db.Exec("UPDATE tokens SET last_used=? WHERE id=?", now, id)
+		if err != nil {
+			glog.Errorf("could not update last use time of token %s: %v", id, err)
+		}
+	}()
+}
+
+// sql_authenticator checks passwords stored in the users table
+type sql_authenticator struct {
+	ctl		*AuthCtl
+}
+
+func (a *sql_authenticator) Authenticate(mbox *Mailbox) error {
+	return a.ctl.GetUser(mbox)
+}
+
+func (a *sql_authenticator) Close() {
 }
 
 type Mailbox struct {
 	Username		string		`json:"username"`
 	Password		string		`json:"password"`
+	Role			string		`json:"role"`
+	Groups			[]string	`json:"groups"`
+	// disabled users can not authenticate, their data is kept
+	Disabled		bool		`json:"disabled"`
 	Created			time.Time	`json:"-"`
 }
 
 func (mbox *Mailbox) String() string {
-	return fmt.Sprintf("username: %s, created: '%s'", mbox.Username, mbox.Created.String())
+	return fmt.Sprintf("username: %s, role: %s, groups: %v, disabled: %v, created: '%s'",
+		mbox.Username, mbox.Role, mbox.Groups, mbox.Disabled, mbox.Created.String())
 }
 
 func (ctl *AuthCtl) NewUser(mbox *Mailbox) error {
 	mbox.Created = time.Now()
+	if mbox.Role == "" {
+		mbox.Role = RoleUser
+	}
+	if !ValidRole(mbox.Role) {
+		return fmt.Errorf("could not insert new user: %s: invalid role", mbox.String())
+	}
 
-	_, err := ctl.db.Exec("INSERT INTO users SET username=?,password=?,created=?",
-		mbox.Username, mbox.Password, mbox.Created)
+	_, err := ctl.db.Exec("INSERT INTO users SET username=?,password=?,role=?,created=?",
+		mbox.Username, mbox.Password, mbox.Role, mbox.Created)
 	if err != nil {
 		return fmt.Errorf("could not insert new user: %s: %v", mbox.String(), err)
 	}
@@ -57,45 +222,213 @@ func (ctl *AuthCtl) NewUser(mbox *Mailbox) error {
 }
 
 func (ctl *AuthCtl) DeleteUser(mbox *Mailbox) error {
+	defer ctl.cache().invalidate(mbox.Username)
+
 	_, err := ctl.db.Exec("DELETE FROM users WHERE username=?", mbox.Username)
 	if err != nil {
 		return fmt.Errorf("could not delete user: %s: %v", mbox.String(), err)
 	}
 
-	return nil
+	_, err = ctl.db.Exec("DELETE FROM group_members WHERE username=?", mbox.Username)
+	if err != nil {
+		return fmt.Errorf("could not delete group membership of user: %s: %v", mbox.String(), err)
+	}
+
+	return ctl.DeleteUserTokens(mbox.Username)
 }
 
-func (ctl *AuthCtl) GetUser(mbox *Mailbox) error {
-	rows, err := ctl.db.Query("SELECT * FROM users WHERE username=?", mbox.Username)
+// load_user fills role, groups, state and creation time of the user and returns stored password
+func (ctl *AuthCtl) load_user(mbox *Mailbox) (string, error) {
+	rows, err := ctl.db.Query("SELECT username,password,role,disabled,created FROM users WHERE username=?", mbox.Username)
 	if err != nil {
-		return fmt.Errorf("could not read userinfo for user: %s: %v", mbox.Username, err)
+		return "", fmt.Errorf("could not read userinfo for user: %s: %v", mbox.Username, err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var username, password string
 
-		err = rows.Scan(&username, &password, &mbox.Created)
+		err = rows.Scan(&username, &password, &mbox.Role, &mbox.Disabled, &mbox.Created)
 		if err != nil {
-			return fmt.Errorf("database schema mismatch: %v", err)
+			return "", fmt.Errorf("database schema mismatch: %v", err)
 		}
 
-		if password != mbox.Password || username != mbox.Username {
-			return fmt.Errorf("username or password mismatch");
-		} else {
-			return nil
+		if username != mbox.Username {
+			return "", fmt.Errorf("username mismatch")
 		}
+
+		mbox.Groups, err = ctl.GetUserGroups(mbox.Username)
+		return password, err
 	}
 
 	err = rows.Err()
 	if err != nil {
-		return fmt.Errorf("could not scan database: %v", err)
+		return "", fmt.Errorf("could not scan database: %v", err)
+	}
+
+	return "", ErrUserNotFound
+}
+
+// read_user is the same as load_user, but it returns ErrUserDisabled for disabled users
+func (ctl *AuthCtl) read_user(mbox *Mailbox) (string, error) {
+	password, err := ctl.load_user(mbox)
+	if err != nil {
+		return "", err
+	}
+
+	if mbox.Disabled {
+		return "", ErrUserDisabled
+	}
+
+	return password, nil
+}
+
+// check_disabled returns ErrUserDisabled if the user authenticated by LDAP or htpasswd backend
+// has been disabled in the auth database, users which do not exist in the database are allowed
+func (ctl *AuthCtl) check_disabled(username string) error {
+	if ctl.db == nil {
+		return nil
+	}
+
+	_, err := ctl.read_user(&Mailbox { Username: username })
+	if err == ErrUserNotFound {
+		return nil
+	}
+
+	return err
+}
+
+// UserInfo returns user without password, disabled users are returned too
+func (ctl *AuthCtl) UserInfo(username string) (*Mailbox, error) {
+	mbox := &Mailbox {
+		Username: username,
+	}
+
+	_, err := ctl.load_user(mbox)
+	if err != nil {
+		return nil, err
+	}
+
+	return mbox, nil
+}
+
+func (ctl *AuthCtl) ListUsers() ([]*Mailbox, error) {
+	rows, err := ctl.db.Query("SELECT username,role,disabled,created FROM users ORDER BY username")
+	if err != nil {
+		return nil, fmt.Errorf("could not read users: %v", err)
+	}
+	defer rows.Close()
+
+	users := make([]*Mailbox, 0)
+	for rows.Next() {
+		var mbox Mailbox
+
+		err = rows.Scan(&mbox.Username, &mbox.Role, &mbox.Disabled, &mbox.Created)
+		if err != nil {
+			return nil, fmt.Errorf("database schema mismatch: %v", err)
+		}
+
+		users = append(users, &mbox)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not scan database: %v", err)
+	}
+
+	return users, nil
+}
+
+func (ctl *AuthCtl) SetDisabled(username string, disabled bool) error {
+	defer ctl.cache().invalidate(username)
+
+	res, err := ctl.db.Exec("UPDATE users SET disabled=? WHERE username=?", disabled, username)
+	if err != nil {
+		return fmt.Errorf("could not update user: %s: %v", username, err)
+	}
+
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
+
+// RenameUser changes username in the users table, group membership and tokens,
+// data of the user has to be renamed separately
+func (ctl *AuthCtl) RenameUser(username, new_username string) error {
+	defer ctl.cache().invalidate(username)
+
+	res, err := ctl.db.Exec("UPDATE users SET username=? WHERE username=?", new_username, username)
+	if err != nil {
+		return fmt.Errorf("could not rename user: %s -> %s: %v", username, new_username, err)
+	}
+
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		return ErrUserNotFound
+	}
+
+	for _, q := range []string {
+		"UPDATE group_members SET username=? WHERE username=?",
+		"UPDATE tokens SET username=? WHERE username=?",
+	} {
+		_, err = ctl.db.Exec(q, new_username, username)
+		if err != nil {
+			return fmt.Errorf("could not rename user: %s -> %s: %v", username, new_username, err)
+		}
+	}
+
+	return ctl.ClearLockout(LockoutUser, username)
+}
+
+func (ctl *AuthCtl) GetUser(mbox *Mailbox) error {
+	password, err := ctl.read_user(mbox)
+	if err != nil {
+		return err
+	}
+
+	if password != mbox.Password {
+		return fmt.Errorf("username or password mismatch");
+	}
+
+	return nil
+}
+
+// token_role returns role granted by the token of @scope to the user with @role,
+// tokens never grant administrative access, since they are stored in clients and scripts
+func token_role(role, scope string) string {
+	if scope != ScopeReadWrite {
+		return RoleReadOnly
+	}
+	if role == RoleAdmin {
+		return RoleUser
+	}
+	return role
+}
+
+// GetUserToken authenticates user with application password and restricts role to the token scope
+func (ctl *AuthCtl) GetUserToken(mbox *Mailbox, kind string) (*Token, error) {
+	t, err := ctl.CheckToken(mbox.Username, kind, mbox.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	mbox.Username = t.Username
+	_, err = ctl.read_user(mbox)
+	if err != nil {
+		return nil, err
 	}
 
-	return fmt.Errorf("there is no user %s", mbox.Username)
+	mbox.Role = token_role(mbox.Role, t.Scope)
+
+	return t, nil
 }
 
 func (ctl *AuthCtl) UpdateUser(mbox *Mailbox) error {
+	defer ctl.cache().invalidate(mbox.Username)
+
 	_, err := ctl.db.Exec("UPDATE users SET password=? WHERE username=?", mbox.Password, mbox.Username)
 	if err != nil {
 		return fmt.Errorf("could not update user: %s: %v", mbox.String(), err)
@@ -104,37 +437,165 @@ func (ctl *AuthCtl) UpdateUser(mbox *Mailbox) error {
 	return nil
 }
 
-func (ctl *AuthCtl) Ping() error {
-	return ctl.db.Ping()
+func (ctl *AuthCtl) SetRole(mbox *Mailbox) error {
+	if !ValidRole(mbox.Role) {
+		return fmt.Errorf("could not set role: %s: invalid role", mbox.String())
+	}
+
+	defer ctl.cache().invalidate(mbox.Username)
+
+	res, err := ctl.db.Exec("UPDATE users SET role=? WHERE username=?", mbox.Role, mbox.Username)
+	if err != nil {
+		return fmt.Errorf("could not set role: %s: %v", mbox.String(), err)
+	}
+
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
+
+func (ctl *AuthCtl) Ping(ctx context.Context) error {
+	if ctl.db == nil {
+		return nil
+	}
+	return ctl.db.PingContext(ctx)
+}
+
+// authenticate checks either api token from the 'Authorization: Bearer' header
+// or basic auth username with primary or application password
+func (ctl *AuthCtl) authenticate(r *http.Request) (*Mailbox, *Token, error) {
+	creds := ctl.cache()
+
+	if hdr := r.Header.Get("Authorization"); ctl.db != nil && strings.HasPrefix(hdr, "Bearer ") {
+		secret := strings.TrimSpace(strings.TrimPrefix(hdr, "Bearer "))
+		key := bearer_cache_key(creds, secret)
+
+		if mbox, id, ok := creds.get(key, secret); ok {
+			ctl.touch_token(creds, key, id)
+			return mbox, &Token { ID: id, Username: mbox.Username }, nil
+		}
+
+		mbox := &Mailbox {
+			Password: secret,
+		}
+
+		t, err := ctl.GetUserToken(mbox, TokenAPI)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid bearer token: %v", err)
+		}
+
+		creds.put(key, secret, mbox, t.ID)
+		return mbox, t, nil
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil, fmt.Errorf("basic auth '%s' has failed", r.Header.Get("Authorization"))
+	}
+
+	key := cred_basic + username
+	if mbox, id, ok := creds.get(key, password); ok && mbox.Username == username {
+		var t *Token
+		if id != "" {
+			ctl.touch_token(creds, key, id)
+			t = &Token { ID: id, Username: username }
+		}
+		return mbox, t, nil
+	}
+
+	mbox := &Mailbox {
+		Username: username,
+		Password: password,
+	}
+
+	backend := ctl.authenticator()
+	err := backend.Authenticate(mbox)
+	if err == nil {
+		if _, local := backend.(*sql_authenticator); !local {
+			err = ctl.check_disabled(mbox.Username)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid user '%s': %v", mbox.Username, err)
+			}
+		}
+
+		creds.put(key, password, mbox, "")
+		return mbox, nil, nil
+	}
+	if ctl.db == nil {
+		return nil, nil, fmt.Errorf("invalid user '%s': %v", mbox.Username, err)
+	}
+
+	t, terr := ctl.GetUserToken(mbox, TokenAppPassword)
+	if terr != nil {
+		return nil, nil, fmt.Errorf("invalid user '%s': %v", mbox.Username, err)
+	}
+
+	creds.put(key, password, mbox, t.ID)
+	return mbox, t, nil
 }
 
 func (ctl *AuthCtl) BasicAuth(c *web.C, h http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		username, password, ok := r.BasicAuth()
-		if !ok {
-			estr := fmt.Sprintf("basic auth '%s' has failed", r.Header.Get("Authorization"))
-			glog.Errorf("%s", estr)
-			pleaseAuth(w, estr)
+		// request has already been authenticated by the previous middleware, for example JWTAuth
+		if GetAuthUsername(*c) != "" {
+			h.ServeHTTP(w, r)
 			return
 		}
 
-		mbox := Mailbox {
-			Username: username,
-			Password: password,
+		// attempts are throttled before credentials are checked, so that locked out clients do not reach the database
+		username, _, _ := r.BasicAuth()
+		addr := client_address(r)
+		method := "basic"
+		if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+			method = "bearer"
 		}
 
-		err := ctl.GetUser(&mbox)
+		lockout := ctl.guard()
+		if lockout != nil {
+			if wait := lockout.check(username, addr); wait > 0 {
+				metrics.Auth(method, metrics.AuthLocked)
+				glog.Errorf("%s: %s: username: '%s', address: %s: too many failed attempts, retry in %s",
+					r.Method, r.URL.Path, username, addr, wait.String())
+				TooManyRequests(w, wait)
+				return
+			}
+		}
+
+		mbox, t, err := ctl.authenticate(r)
 		if err != nil {
-			estr := fmt.Sprintf("invalid user '%s': %v", mbox.Username, err)
+			estr := err.Error()
 			glog.Errorf("%s", estr)
+
+			// requests without credentials are the normal first step of the basic auth and are not counted
+			if r.Header.Get("Authorization") != "" {
+				metrics.Auth(method, metrics.AuthFailure)
+
+				if lockout != nil {
+					lockout.failure(username, addr)
+				}
+			}
+
 			pleaseAuth(w, estr)
 			return
 		}
 
+		metrics.Auth(method, metrics.AuthSuccess)
+		if lockout != nil {
+			lockout.success(username)
+		}
+
 		if c.Env == nil {
 			c.Env = make(map[interface{}]interface{})
 		}
 		c.Env[AuthUsernameString] = mbox.Username
+		c.Env[AuthRoleString] = mbox.Role
+		c.Env[AuthGroupsString] = mbox.Groups
+		if t != nil {
+			c.Env[AuthTokenString] = t.ID
+		}
 
 		h.ServeHTTP(w, r)
 	}
@@ -147,16 +608,65 @@ func pleaseAuth(w http.ResponseWriter, msg string) {
 	w.Write([]byte(msg))
 }
 
-func GetAuthUsername(c web.C) string {
+func get_env_string(c web.C, key string) string {
 	if c.Env == nil {
 		return ""
 	}
-	v, ok := c.Env[AuthUsernameString]
+	v, ok := c.Env[key]
 	if !ok {
 		return ""
 	}
-	if username, ok := v.(string); ok {
-		return username
+	if s, ok := v.(string); ok {
+		return s
 	}
 	return ""
 }
+
+func GetAuthUsername(c web.C) string {
+	return get_env_string(c, AuthUsernameString)
+}
+
+func GetAuthRole(c web.C) string {
+	return get_env_string(c, AuthRoleString)
+}
+
+// GetAuthToken returns identifier of the token used to authenticate request, empty string for the primary password
+func GetAuthToken(c web.C) string {
+	return get_env_string(c, AuthTokenString)
+}
+
+func GetAuthGroups(c web.C) []string {
+	if c.Env == nil {
+		return nil
+	}
+	if groups, ok := c.Env[AuthGroupsString].([]string); ok {
+		return groups
+	}
+	return nil
+}
+
+// CanWrite returns false for users which are only allowed to read data
+func CanWrite(c web.C) bool {
+	return GetAuthRole(c) != RoleReadOnly
+}
+
+// RequireRole returns middleware which rejects requests of authenticated users who do not have any of the @roles
+func RequireRole(roles ...string) func(*web.C, http.Handler) http.Handler {
+	return func(c *web.C, h http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			role := GetAuthRole(*c)
+			for _, want := range roles {
+				if role == want {
+					h.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			glog.Errorf("%s: %s: username: %s, role: '%s': access denied, required roles: %v",
+				r.Method, r.URL.Path, GetAuthUsername(*c), role, roles)
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("access denied"))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
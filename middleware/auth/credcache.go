@@ -0,0 +1,209 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+type CredCacheCtl struct {
+	// verified credentials are cached for this number of seconds, negative value disables the cache,
+	// changes made by other processes (auth_ctl, other instances) are picked up after this interval
+	TTL			int		`json:"ttl"`
+	// maximum number of cached credentials
+	Size			int		`json:"size"`
+}
+
+const (
+	DefaultCredCacheTTL = 30
+	DefaultCredCacheSize = 10000
+
+	// last use time of the token served from the cache is written to the database at most this often
+	LastUsedInterval = time.Minute
+)
+
+const (
+	cred_basic = "basic:"
+	cred_bearer = "bearer:"
+)
+
+type cred_entry struct {
+	username		string
+	// keyed hash of the password or token, plain secrets are never stored
+	hash			[]byte
+	role			string
+	groups			[]string
+	// identifier of the application password or api token, empty for the primary password
+	token			string
+	expires			time.Time
+	// last time when the last use time of the token has been written to the database
+	touched			time.Time
+}
+
+type cred_cache struct {
+	ttl			time.Duration
+	size			int
+	// random per-process key of the secret hashes
+	key			[]byte
+
+	sync.Mutex
+	entries			map[string]*cred_entry
+}
+
+// SetCredentialCache enables cache of the verified credentials in BasicAuth,
+// if the cache is already enabled it is replaced with the new empty one
+func (ctl *AuthCtl) SetCredentialCache(conf *CredCacheCtl) error {
+	if conf.TTL < 0 {
+		ctl.lock.Lock()
+		ctl.creds = nil
+		ctl.lock.Unlock()
+		return nil
+	}
+
+	cc := &cred_cache {
+		ttl: time.Duration(or_default(conf.TTL, DefaultCredCacheTTL)) * time.Second,
+		size: or_default(conf.Size, DefaultCredCacheSize),
+		key: make([]byte, sha256.Size),
+		entries: make(map[string]*cred_entry),
+	}
+
+	_, err := rand.Read(cc.key)
+	if err != nil {
+		return err
+	}
+
+	ctl.lock.Lock()
+	ctl.creds = cc
+	ctl.lock.Unlock()
+	return nil
+}
+
+func (cc *cred_cache) hash(secret string) []byte {
+	h := hmac.New(sha256.New, cc.key)
+	h.Write([]byte(secret))
+	return h.Sum(nil)
+}
+
+// get returns cached user if @secret matches, bearer tokens are keyed by the token hash and username is taken from the entry
+func (cc *cred_cache) get(key, secret string) (*Mailbox, string, bool) {
+	if cc == nil {
+		return nil, "", false
+	}
+
+	hash := cc.hash(secret)
+
+	cc.Lock()
+	defer cc.Unlock()
+
+	e, ok := cc.entries[key]
+	if !ok {
+		return nil, "", false
+	}
+
+	if time.Now().After(e.expires) {
+		delete(cc.entries, key)
+		return nil, "", false
+	}
+
+	if !hmac.Equal(e.hash, hash) {
+		return nil, "", false
+	}
+
+	mbox := &Mailbox {
+		Username: e.username,
+		Role: e.role,
+		Groups: e.groups,
+	}
+	return mbox, e.token, true
+}
+
+func (cc *cred_cache) put(key, secret string, mbox *Mailbox, token string) {
+	if cc == nil {
+		return
+	}
+
+	e := &cred_entry {
+		username: mbox.Username,
+		hash: cc.hash(secret),
+		role: mbox.Role,
+		groups: mbox.Groups,
+		token: token,
+		expires: time.Now().Add(cc.ttl),
+		touched: time.Now(),
+	}
+
+	cc.Lock()
+	defer cc.Unlock()
+
+	if len(cc.entries) >= cc.size {
+		now := time.Now()
+		for k, old := range cc.entries {
+			if now.After(old.expires) {
+				delete(cc.entries, k)
+			}
+		}
+
+		// map iteration order is random, so this evicts random entries
+		for k := range cc.entries {
+			if len(cc.entries) < cc.size {
+				break
+			}
+			delete(cc.entries, k)
+		}
+	}
+
+	cc.entries[key] = e
+}
+
+// touch returns true if last use time of the token cached under @key has to be written to the database
+func (cc *cred_cache) touch(key string, now time.Time) bool {
+	if cc == nil {
+		return false
+	}
+
+	cc.Lock()
+	defer cc.Unlock()
+
+	e, ok := cc.entries[key]
+	if !ok || e.token == "" || now.Sub(e.touched) < LastUsedInterval {
+		return false
+	}
+
+	e.touched = now
+	return true
+}
+
+// invalidate removes all cached credentials of the user, including application passwords and tokens
+func (cc *cred_cache) invalidate(username string) {
+	if cc == nil {
+		return
+	}
+
+	cc.Lock()
+	defer cc.Unlock()
+
+	for k, e := range cc.entries {
+		if e.username == username {
+			delete(cc.entries, k)
+		}
+	}
+}
+
+func (cc *cred_cache) flush() {
+	if cc == nil {
+		return
+	}
+
+	cc.Lock()
+	cc.entries = make(map[string]*cred_entry)
+	cc.Unlock()
+}
+
+func bearer_cache_key(cc *cred_cache, secret string) string {
+	if cc == nil {
+		return ""
+	}
+	return cred_bearer + string(cc.hash(secret))
+}
@@ -0,0 +1,209 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func new_test_creds(t *testing.T, conf *CredCacheCtl) *cred_cache {
+	ctl := &AuthCtl{}
+	err := ctl.SetCredentialCache(conf)
+	if err != nil {
+		t.Fatalf("could not set up credential cache: %v", err)
+	}
+	return ctl.cache()
+}
+
+func TestSetCredentialCache(t *testing.T) {
+	tests := []struct {
+		conf		CredCacheCtl
+		enabled		bool
+		ttl		time.Duration
+		size		int
+	} {
+		{ CredCacheCtl {}, true, DefaultCredCacheTTL * time.Second, DefaultCredCacheSize },
+		{ CredCacheCtl { TTL: 5, Size: 10 }, true, 5 * time.Second, 10 },
+		{ CredCacheCtl { TTL: -1 }, false, 0, 0 },
+	}
+
+	for _, test := range tests {
+		cc := new_test_creds(t, &test.conf)
+		if (cc != nil) != test.enabled {
+			t.Errorf("%+v: enabled: %v, want %v", test.conf, cc != nil, test.enabled)
+			continue
+		}
+		if cc == nil {
+			continue
+		}
+
+		if cc.ttl != test.ttl || cc.size != test.size {
+			t.Errorf("%+v: ttl: %v, size: %d, want %v and %d", test.conf, cc.ttl, cc.size, test.ttl, test.size)
+		}
+	}
+}
+
+func TestBearerCacheKey(t *testing.T) {
+	cc := new_test_creds(t, &CredCacheCtl{})
+	other := new_test_creds(t, &CredCacheCtl{})
+
+	secret := "0123456789abcdef"
+	key := bearer_cache_key(cc, secret)
+
+	if !strings.HasPrefix(key, cred_bearer) {
+		t.Errorf("key %q does not start with %q", key, cred_bearer)
+	}
+	if strings.Contains(key, secret) {
+		t.Errorf("key contains plain token")
+	}
+	if key != bearer_cache_key(cc, secret) {
+		t.Errorf("key of the same token has changed")
+	}
+	if key == bearer_cache_key(cc, secret + "0") {
+		t.Errorf("different tokens have the same key")
+	}
+	if key == bearer_cache_key(other, secret) {
+		t.Errorf("caches with different hash keys produced the same key")
+	}
+	if bearer_cache_key(nil, secret) != "" {
+		t.Errorf("disabled cache produced non-empty key")
+	}
+}
+
+func TestCredCacheGet(t *testing.T) {
+	mbox := &Mailbox {
+		Username: "alice",
+		Role: RoleUser,
+		Groups: []string { "staff" },
+	}
+
+	tests := []struct {
+		name		string
+		secret		string
+		// shifts expiration time of the stored entry
+		age		time.Duration
+		found		bool
+	} {
+		{ "match", "secret", 0, true },
+		{ "wrong secret", "guess", 0, false },
+		{ "expired", "secret", time.Minute, false },
+	}
+
+	for _, test := range tests {
+		cc := new_test_creds(t, &CredCacheCtl { TTL: 30 })
+
+		cc.put(cred_basic + "alice", "secret", mbox, "token-id")
+		cc.entries[cred_basic + "alice"].expires = cc.entries[cred_basic + "alice"].expires.Add(-test.age)
+
+		got, id, ok := cc.get(cred_basic + "alice", test.secret)
+		if ok != test.found {
+			t.Errorf("%s: found: %v, want %v", test.name, ok, test.found)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		if got.Username != mbox.Username || got.Role != mbox.Role || len(got.Groups) != 1 || id != "token-id" {
+			t.Errorf("%s: got user %+v with token '%s'", test.name, got, id)
+		}
+	}
+
+	cc := new_test_creds(t, &CredCacheCtl { TTL: 30 })
+	cc.put(cred_basic + "alice", "secret", mbox, "")
+	cc.entries[cred_basic + "alice"].expires = time.Now().Add(-time.Second)
+	cc.get(cred_basic + "alice", "secret")
+	if _, ok := cc.entries[cred_basic + "alice"]; ok {
+		t.Errorf("expired entry has not been removed")
+	}
+}
+
+func TestCredCacheInvalidate(t *testing.T) {
+	cc := new_test_creds(t, &CredCacheCtl{})
+
+	alice := &Mailbox { Username: "alice" }
+	bob := &Mailbox { Username: "bob" }
+
+	cc.put(cred_basic + "alice", "secret", alice, "")
+	cc.put(bearer_cache_key(cc, "token"), "token", alice, "token-id")
+	cc.put(cred_basic + "bob", "secret", bob, "")
+
+	cc.invalidate("alice")
+
+	if _, _, ok := cc.get(cred_basic + "alice", "secret"); ok {
+		t.Errorf("password of the invalidated user is still cached")
+	}
+	if _, _, ok := cc.get(bearer_cache_key(cc, "token"), "token"); ok {
+		t.Errorf("token of the invalidated user is still cached")
+	}
+	if _, _, ok := cc.get(cred_basic + "bob", "secret"); !ok {
+		t.Errorf("password of the other user has been dropped")
+	}
+}
+
+func TestCredCacheSize(t *testing.T) {
+	cc := new_test_creds(t, &CredCacheCtl { Size: 3 })
+
+	for _, name := range []string { "a", "b", "c", "d", "e" } {
+		cc.put(cred_basic + name, "secret", &Mailbox { Username: name }, "")
+
+		if len(cc.entries) > 3 {
+			t.Fatalf("cache holds %d entries, limit is 3", len(cc.entries))
+		}
+		if _, _, ok := cc.get(cred_basic + name, "secret"); !ok {
+			t.Errorf("just stored entry '%s' has been evicted", name)
+		}
+	}
+}
+
+func TestCredCacheTouch(t *testing.T) {
+	cc := new_test_creds(t, &CredCacheCtl {})
+	mbox := &Mailbox { Username: "alice" }
+	cc.put(cred_basic + "alice", "secret", mbox, "")
+	cc.put(cred_bearer + "token", "token", mbox, "token-id")
+
+	now := time.Now()
+	tests := []struct {
+		key		string
+		now		time.Time
+		touch		bool
+	} {
+		{ cred_bearer + "token", now, false },
+		{ cred_bearer + "token", now.Add(LastUsedInterval + time.Second), true },
+		{ cred_bearer + "token", now.Add(LastUsedInterval + 2 * time.Second), false },
+		{ cred_bearer + "token", now.Add(2 * LastUsedInterval + 2 * time.Second), true },
+		{ cred_basic + "alice", now.Add(LastUsedInterval + time.Second), false },
+		{ cred_basic + "bob", now.Add(LastUsedInterval + time.Second), false },
+	}
+
+	for _, test := range tests {
+		if got := cc.touch(test.key, test.now); got != test.touch {
+			t.Errorf("touch(%s, %v): %v, want %v", test.key, test.now.Sub(now), got, test.touch)
+		}
+	}
+}
+
+func TestSetAuthenticatorFlush(t *testing.T) {
+	ctl := NewAuthCtlWithoutDatabase(&test_authenticator {})
+	err := ctl.SetCredentialCache(&CredCacheCtl {})
+	if err != nil {
+		t.Fatalf("could not set up credential cache: %v", err)
+	}
+
+	ctl.cache().put(cred_basic + "alice", "secret", &Mailbox { Username: "alice" }, "")
+	ctl.SetAuthenticator(&test_authenticator {})
+
+	if _, _, ok := ctl.cache().get(cred_basic + "alice", "secret"); ok {
+		t.Errorf("credentials verified by the old authenticator are still cached")
+	}
+}
+
+type test_authenticator struct {
+}
+
+func (a *test_authenticator) Authenticate(mbox *Mailbox) error {
+	return ErrUserNotFound
+}
+
+func (a *test_authenticator) Close() {
+}
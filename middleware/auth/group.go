@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"fmt"
+	"time"
+)
+
+type Group struct {
+	Name			string		`json:"name"`
+	Members			[]string	`json:"members"`
+	Created			time.Time	`json:"created"`
+}
+
+func (ctl *AuthCtl) NewGroup(name string) error {
+	_, err := ctl.db.Exec("INSERT INTO user_groups SET name=?,created=?", name, time.Now())
+	if err != nil {
+		return fmt.Errorf("could not insert new group: %s: %v", name, err)
+	}
+
+	return nil
+}
+
+func (ctl *AuthCtl) DeleteGroup(name string) error {
+	// cached credentials contain group lists, there is no cheap way to find members of the deleted group
+	defer ctl.cache().flush()
+
+	_, err := ctl.db.Exec("DELETE FROM group_members WHERE groupname=?", name)
+	if err != nil {
+		return fmt.Errorf("could not delete members of group: %s: %v", name, err)
+	}
+
+	_, err = ctl.db.Exec("DELETE FROM user_groups WHERE name=?", name)
+	if err != nil {
+		return fmt.Errorf("could not delete group: %s: %v", name, err)
+	}
+
+	return nil
+}
+
+func (ctl *AuthCtl) AddMember(group, username string) error {
+	defer ctl.cache().invalidate(username)
+
+	_, err := ctl.db.Exec("INSERT INTO group_members SET groupname=?,username=?", group, username)
+	if err != nil {
+		return fmt.Errorf("could not add user %s to group %s: %v", username, group, err)
+	}
+
+	return nil
+}
+
+func (ctl *AuthCtl) RemoveMember(group, username string) error {
+	defer ctl.cache().invalidate(username)
+
+	_, err := ctl.db.Exec("DELETE FROM group_members WHERE groupname=? AND username=?", group, username)
+	if err != nil {
+		return fmt.Errorf("could not remove user %s from group %s: %v", username, group, err)
+	}
+
+	return nil
+}
+
+func (ctl *AuthCtl) GetUserGroups(username string) ([]string, error) {
+	rows, err := ctl.db.Query("SELECT groupname FROM group_members WHERE username=? ORDER BY groupname", username)
+	if err != nil {
+		return nil, fmt.Errorf("could not read groups of user: %s: %v", username, err)
+	}
+	defer rows.Close()
+
+	groups := make([]string, 0)
+	for rows.Next() {
+		var g string
+
+		err = rows.Scan(&g)
+		if err != nil {
+			return nil, fmt.Errorf("database schema mismatch: %v", err)
+		}
+
+		groups = append(groups, g)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not scan database: %v", err)
+	}
+
+	return groups, nil
+}
+
+func (ctl *AuthCtl) ListGroups() ([]*Group, error) {
+	rows, err := ctl.db.Query("SELECT g.name, g.created, m.username FROM user_groups g " +
+		"LEFT JOIN group_members m ON m.groupname=g.name ORDER BY g.name, m.username")
+	if err != nil {
+		return nil, fmt.Errorf("could not read groups: %v", err)
+	}
+	defer rows.Close()
+
+	groups := make([]*Group, 0)
+	var last *Group
+	for rows.Next() {
+		var name string
+		var created time.Time
+		var member *string
+
+		err = rows.Scan(&name, &created, &member)
+		if err != nil {
+			return nil, fmt.Errorf("database schema mismatch: %v", err)
+		}
+
+		if last == nil || last.Name != name {
+			last = &Group {
+				Name: name,
+				Members: make([]string, 0),
+				Created: created,
+			}
+			groups = append(groups, last)
+		}
+
+		if member != nil {
+			last.Members = append(last.Members, *member)
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not scan database: %v", err)
+	}
+
+	return groups, nil
+}
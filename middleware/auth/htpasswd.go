@@ -0,0 +1,245 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"github.com/golang/glog"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HtpasswdAuthenticator checks passwords stored in the Apache htpasswd file,
+// bcrypt, {SHA} and $apr1$ hashes are supported, file is reloaded when it changes
+type HtpasswdAuthenticator struct {
+	path			string
+
+	sync.Mutex
+	users			map[string]string
+	mtime			time.Time
+	size			int64
+	provisioned		map[string]bool
+
+	// called after the file has been reread
+	on_reload		func()
+
+	// Provision is called once per user after the first successful authentication,
+	// it is supposed to create user's root directory if it does not exist yet
+	Provision		func(username string) error
+}
+
+func NewHtpasswdAuthenticator(path string) (*HtpasswdAuthenticator, error) {
+	a := &HtpasswdAuthenticator {
+		path: path,
+		users: make(map[string]string),
+		provisioned: make(map[string]bool),
+	}
+
+	err := a.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (a *HtpasswdAuthenticator) Close() {
+}
+
+// OnReload sets function which is called every time the file is reread after it has been changed
+func (a *HtpasswdAuthenticator) OnReload(fn func()) {
+	a.Lock()
+	a.on_reload = fn
+	a.Unlock()
+}
+
+// reload rereads the file if its modification time or size has changed since the last read
+func (a *HtpasswdAuthenticator) reload() error {
+	st, err := os.Stat(a.path)
+	if err != nil {
+		return fmt.Errorf("htpasswd: could not stat '%s': %v", a.path, err)
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	if st.ModTime().Equal(a.mtime) && st.Size() == a.size {
+		return nil
+	}
+
+	f, err := os.Open(a.path)
+	if err != nil {
+		return fmt.Errorf("htpasswd: could not open '%s': %v", a.path, err)
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			glog.Errorf("htpasswd: %s:%d: invalid line", a.path, line)
+			continue
+		}
+
+		users[parts[0]] = parts[1]
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return fmt.Errorf("htpasswd: could not read '%s': %v", a.path, err)
+	}
+
+	a.users = users
+	a.mtime = st.ModTime()
+	a.size = st.Size()
+
+	// removed users and changed passwords must not be served from the credential cache
+	if a.on_reload != nil {
+		a.on_reload()
+	}
+
+	glog.Infof("htpasswd: %s: loaded %d users", a.path, len(users))
+	return nil
+}
+
+const apr1_alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1 implements Apache variant of the MD5-based crypt
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	h := md5.New()
+	h.Write(pw)
+	h.Write([]byte(magic + salt))
+
+	alt := md5.Sum([]byte(password + salt + password))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			h.Write(alt[:])
+		} else {
+			h.Write(alt[:i])
+		}
+	}
+
+	for i := len(pw); i > 0; i >>= 1 {
+		if i & 1 != 0 {
+			h.Write([]byte { 0 })
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+
+	final := h.Sum(nil)
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i & 1 != 0 {
+			h.Write(pw)
+		} else {
+			h.Write(final)
+		}
+		if i % 3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i % 7 != 0 {
+			h.Write(pw)
+		}
+		if i & 1 != 0 {
+			h.Write(final)
+		} else {
+			h.Write(pw)
+		}
+		final = h.Sum(nil)
+	}
+
+	out := make([]byte, 0, 22)
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out = append(out, apr1_alphabet[v & 0x3f])
+			v >>= 6
+		}
+	}
+
+	for _, g := range [][3]int { {0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5} } {
+		to64(uint32(final[g[0]]) << 16 | uint32(final[g[1]]) << 8 | uint32(final[g[2]]), 4)
+	}
+	to64(uint32(final[11]), 2)
+
+	return magic + salt + "$" + string(out)
+}
+
+func htpasswd_check(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2y$"), strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expected := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1
+	case strings.HasPrefix(hash, "$apr1$"):
+		parts := strings.Split(hash, "$")
+		if len(parts) != 4 {
+			return false
+		}
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(apr1(password, parts[2]))) == 1
+	}
+
+	return false
+}
+
+func (a *HtpasswdAuthenticator) Authenticate(mbox *Mailbox) error {
+	err := a.reload()
+	if err != nil {
+		// keep serving users from the previously loaded file
+		glog.Errorf("%v", err)
+	}
+
+	a.Lock()
+	hash, ok := a.users[mbox.Username]
+	a.Unlock()
+
+	if !ok {
+		return fmt.Errorf("there is no user %s", mbox.Username)
+	}
+
+	if !htpasswd_check(hash, mbox.Password) {
+		return fmt.Errorf("username or password mismatch")
+	}
+
+	if a.Provision != nil {
+		a.Lock()
+		done := a.provisioned[mbox.Username]
+		a.Unlock()
+
+		if !done {
+			err = a.Provision(mbox.Username)
+			if err != nil {
+				return fmt.Errorf("htpasswd: could not provision user %s: %v", mbox.Username, err)
+			}
+
+			a.Lock()
+			a.provisioned[mbox.Username] = true
+			a.Unlock()
+		}
+	}
+
+	mbox.Role = RoleUser
+	mbox.Groups = nil
+	return nil
+}
@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestApr1(t *testing.T) {
+	// reference hashes are generated by 'openssl passwd -apr1 -salt <salt> <password>'
+	tests := []struct {
+		password	string
+		salt		string
+		hash		string
+	} {
+		{ "password", "saltsalt", "$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/" },
+		{ "secret", "abc", "$apr1$abc$PZF73YJz5hJ9yyI.7OP.R." },
+		{ "", "12345678", "$apr1$12345678$sHuPAw7VA9xjRbJz7zKV7/" },
+		{ "a-very-long-password-over-16-bytes", "ab/cd.EF", "$apr1$ab/cd.EF$f8LR6utUFCKPJxzikoVGu." },
+		// salt is truncated to 8 characters
+		{ "password", "saltsaltsalt", "$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/" },
+	}
+
+	for _, test := range tests {
+		if got := apr1(test.password, test.salt); got != test.hash {
+			t.Errorf("apr1(%q, %q) = %q, want %q", test.password, test.salt, got, test.hash)
+		}
+	}
+}
+
+func TestHtpasswdCheck(t *testing.T) {
+	bhash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("could not generate bcrypt hash: %v", err)
+	}
+
+	tests := []struct {
+		hash		string
+		password	string
+		ok		bool
+	} {
+		{ string(bhash), "password", true },
+		{ string(bhash), "Password", false },
+		{ "$2y$" + string(bhash[4:]), "password", true },
+		{ "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "password", true },
+		{ "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "passwor", false },
+		{ "$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/", "password", true },
+		{ "$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/", "password1", false },
+		{ "$apr1$saltsalt", "password", false },
+		{ "$apr1$salt$salt$yAAkm4libquA.ZWLHbSBq/", "password", false },
+		// plain text and crypt(3) hashes are not supported
+		{ "password", "password", false },
+		{ "rqXexS6ZhobKA", "password", false },
+		{ "", "", false },
+	}
+
+	for _, test := range tests {
+		if got := htpasswd_check(test.hash, test.password); got != test.ok {
+			t.Errorf("htpasswd_check(%q, %q) = %v, want %v", test.hash, test.password, got, test.ok)
+		}
+	}
+}
+
+func TestHtpasswdAuthenticate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	data := "# comment\n\nalice:$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/\ninvalid line\nbob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"
+	err := ioutil.WriteFile(path, []byte(data), 0600)
+	if err != nil {
+		t.Fatalf("could not write htpasswd file: %v", err)
+	}
+
+	a, err := NewHtpasswdAuthenticator(path)
+	if err != nil {
+		t.Fatalf("could not create authenticator: %v", err)
+	}
+
+	provisioned := make(map[string]int)
+	a.Provision = func(username string) error {
+		provisioned[username]++
+		return nil
+	}
+
+	tests := []struct {
+		username	string
+		password	string
+		ok		bool
+	} {
+		{ "alice", "password", true },
+		{ "alice", "password", true },
+		{ "alice", "wrong", false },
+		{ "bob", "password", true },
+		{ "carol", "password", false },
+		{ "invalid line", "", false },
+	}
+
+	for _, test := range tests {
+		mbox := &Mailbox { Username: test.username, Password: test.password }
+		err := a.Authenticate(mbox)
+		if (err == nil) != test.ok {
+			t.Errorf("%s/%s: error: %v, want success: %v", test.username, test.password, err, test.ok)
+			continue
+		}
+
+		if err == nil && mbox.Role != RoleUser {
+			t.Errorf("%s: role is '%s'", test.username, mbox.Role)
+		}
+	}
+
+	if provisioned["alice"] != 1 || provisioned["bob"] != 1 || len(provisioned) != 2 {
+		t.Errorf("unexpected provisioning: %v", provisioned)
+	}
+}
+
+func TestHtpasswdReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	err := ioutil.WriteFile(path, []byte("bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0600)
+	if err != nil {
+		t.Fatalf("could not write htpasswd file: %v", err)
+	}
+
+	a, err := NewHtpasswdAuthenticator(path)
+	if err != nil {
+		t.Fatalf("could not create authenticator: %v", err)
+	}
+
+	ctl := NewAuthCtlWithoutDatabase(a)
+	err = ctl.SetCredentialCache(&CredCacheCtl {})
+	if err != nil {
+		t.Fatalf("could not set up credential cache: %v", err)
+	}
+	ctl.cache().put(cred_basic + "bob", "password", &Mailbox { Username: "bob" }, "")
+
+	// unchanged file must not flush the cache
+	err = a.Authenticate(&Mailbox { Username: "bob", Password: "password" })
+	if err != nil {
+		t.Fatalf("could not authenticate: %v", err)
+	}
+	if _, _, ok := ctl.cache().get(cred_basic + "bob", "password"); !ok {
+		t.Fatalf("cache has been flushed without file change")
+	}
+
+	err = ioutil.WriteFile(path, []byte("alice:$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/\n"), 0600)
+	if err != nil {
+		t.Fatalf("could not write htpasswd file: %v", err)
+	}
+	mtime := time.Now().Add(time.Second)
+	err = os.Chtimes(path, mtime, mtime)
+	if err != nil {
+		t.Fatalf("could not change modification time: %v", err)
+	}
+
+	err = a.Authenticate(&Mailbox { Username: "bob", Password: "password" })
+	if err == nil {
+		t.Errorf("removed user has been authenticated")
+	}
+	if _, _, ok := ctl.cache().get(cred_basic + "bob", "password"); ok {
+		t.Errorf("removed user is still cached after reload")
+	}
+}
@@ -0,0 +1,545 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bioothod/wd2/metrics"
+	"github.com/golang/glog"
+	"github.com/zenazn/goji/web"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type JWTIssuer struct {
+	// value of the 'iss' claim
+	Issuer			string		`json:"issuer"`
+	// if not empty, 'aud' claim must contain this value
+	Audience		string		`json:"audience"`
+	// keys are loaded either from the local file (offline environments) or from the issuer's url
+	JWKSFile		string		`json:"jwks_file"`
+	JWKSURL			string		`json:"jwks_url"`
+	// claim which contains wd2 username, 'sub' by default
+	UsernameClaim		string		`json:"username_claim"`
+	// optional claim with the list of groups, they are added to the groups stored in the auth database
+	GroupsClaim		string		`json:"groups_claim"`
+	// create unknown users and their root directory on the first login
+	Provision		bool		`json:"provision"`
+	// role of the provisioned users
+	Role			string		`json:"role"`
+}
+
+type JWTCtl struct {
+	Issuers			[]JWTIssuer	`json:"issuers"`
+	// allowed clock skew in seconds when checking 'exp' and 'nbf'
+	Leeway			int		`json:"leeway"`
+	// minimal interval in seconds between JWKS downloads when token is signed with unknown key
+	RefreshInterval		int		`json:"refresh_interval"`
+}
+
+const (
+	DefaultJWTLeeway = 60
+	DefaultJWKSRefreshInterval = 300
+)
+
+var (
+	ErrJWTMalformed = errors.New("malformed token")
+	ErrJWTSignature = errors.New("invalid token signature")
+	ErrJWTUnknownKey = errors.New("token is signed with unknown key")
+)
+
+type jwks_key struct {
+	Kty			string		`json:"kty"`
+	Kid			string		`json:"kid"`
+	Use			string		`json:"use"`
+	Alg			string		`json:"alg"`
+	N			string		`json:"n"`
+	E			string		`json:"e"`
+	Crv			string		`json:"crv"`
+	X			string		`json:"x"`
+	Y			string		`json:"y"`
+}
+
+type jwks struct {
+	Keys			[]jwks_key	`json:"keys"`
+}
+
+type jwt_issuer struct {
+	JWTIssuer
+
+	sync.Mutex
+	keys			map[string]crypto.PublicKey
+	loaded			time.Time
+}
+
+type JWTAuth struct {
+	actl			*AuthCtl
+	issuers			map[string]*jwt_issuer
+	leeway			time.Duration
+	refresh			time.Duration
+
+	// Provision is called after new user has been inserted into the auth database,
+	// it is supposed to create user's root directory, user is deleted if it fails
+	Provision		func(username string) error
+}
+
+func NewJWTAuth(conf *JWTCtl, actl *AuthCtl) (*JWTAuth, error) {
+	if !actl.HasDatabase() {
+		return nil, fmt.Errorf("jwt: auth database is required to map token claims to users")
+	}
+
+	ja := &JWTAuth {
+		actl: actl,
+		issuers: make(map[string]*jwt_issuer),
+		leeway: time.Duration(conf.Leeway) * time.Second,
+		refresh: time.Duration(conf.RefreshInterval) * time.Second,
+	}
+	if conf.Leeway == 0 {
+		ja.leeway = DefaultJWTLeeway * time.Second
+	}
+	if conf.RefreshInterval == 0 {
+		ja.refresh = DefaultJWKSRefreshInterval * time.Second
+	}
+
+	for _, ic := range conf.Issuers {
+		if ic.Issuer == "" {
+			return nil, fmt.Errorf("jwt: issuer must not be empty")
+		}
+		if ic.JWKSFile == "" && ic.JWKSURL == "" {
+			return nil, fmt.Errorf("jwt: issuer: %s: either jwks_file or jwks_url must be provided", ic.Issuer)
+		}
+		if ic.UsernameClaim == "" {
+			ic.UsernameClaim = "sub"
+		}
+		if ic.Role == "" {
+			ic.Role = RoleUser
+		}
+		if !ValidRole(ic.Role) {
+			return nil, fmt.Errorf("jwt: issuer: %s: invalid role '%s'", ic.Issuer, ic.Role)
+		}
+
+		iss := &jwt_issuer {
+			JWTIssuer: ic,
+		}
+
+		err := iss.load()
+		if err != nil {
+			return nil, err
+		}
+
+		ja.issuers[ic.Issuer] = iss
+	}
+
+	return ja, nil
+}
+
+func b64decode(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func (k *jwks_key) public_key() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := b64decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey {
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve '%s'", k.Crv)
+		}
+
+		x, err := b64decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		return &ecdsa.PublicKey {
+			Curve: curve,
+			X: new(big.Int).SetBytes(x),
+			Y: new(big.Int).SetBytes(y),
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type '%s'", k.Kty)
+}
+
+// load reads JWKS from the file or downloads it from the issuer, must be called with the issuer locked or before it is shared
+func (iss *jwt_issuer) load() error {
+	var data []byte
+	var err error
+
+	if iss.JWKSFile != "" {
+		data, err = ioutil.ReadFile(iss.JWKSFile)
+		if err != nil {
+			return fmt.Errorf("jwt: issuer: %s: could not read jwks file '%s': %v", iss.Issuer, iss.JWKSFile, err)
+		}
+	} else {
+		client := &http.Client {
+			Timeout: 10 * time.Second,
+		}
+
+		resp, err := client.Get(iss.JWKSURL)
+		if err != nil {
+			return fmt.Errorf("jwt: issuer: %s: could not download jwks '%s': %v", iss.Issuer, iss.JWKSURL, err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("jwt: issuer: %s: could not download jwks '%s': status: %d", iss.Issuer, iss.JWKSURL, resp.StatusCode)
+		}
+
+		data, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("jwt: issuer: %s: could not read jwks '%s': %v", iss.Issuer, iss.JWKSURL, err)
+		}
+	}
+
+	var set jwks
+	err = json.Unmarshal(data, &set)
+	if err != nil {
+		return fmt.Errorf("jwt: issuer: %s: could not parse jwks: %v", iss.Issuer, err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for i := range set.Keys {
+		k := &set.Keys[i]
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		pub, err := k.public_key()
+		if err != nil {
+			glog.Errorf("jwt: issuer: %s: skipping key '%s': %v", iss.Issuer, k.Kid, err)
+			continue
+		}
+
+		keys[k.Kid] = pub
+	}
+
+	iss.keys = keys
+	iss.loaded = time.Now()
+
+	glog.Infof("jwt: issuer: %s: loaded %d keys", iss.Issuer, len(keys))
+	return nil
+}
+
+// key returns public key with the given id, keys are reloaded if the key is not known
+// and the last reload was more than @refresh ago, so that rotated keys are picked up
+func (iss *jwt_issuer) key(kid string, refresh time.Duration) (crypto.PublicKey, error) {
+	iss.Lock()
+	defer iss.Unlock()
+
+	if k, ok := iss.keys[kid]; ok {
+		return k, nil
+	}
+
+	if time.Since(iss.loaded) < refresh {
+		return nil, ErrJWTUnknownKey
+	}
+
+	err := iss.load()
+	if err != nil {
+		// do not retry on every request if the issuer is down
+		iss.loaded = time.Now()
+		return nil, err
+	}
+
+	if k, ok := iss.keys[kid]; ok {
+		return k, nil
+	}
+
+	return nil, ErrJWTUnknownKey
+}
+
+type jwt_header struct {
+	Alg			string		`json:"alg"`
+	Kid			string		`json:"kid"`
+}
+
+func verify_signature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm '%s'", alg)
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return ErrJWTSignature
+		}
+		if rsa.VerifyPKCS1v15(pub, hash, digest, sig) != nil {
+			return ErrJWTSignature
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			return ErrJWTSignature
+		}
+
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2 * size {
+			return ErrJWTSignature
+		}
+
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return ErrJWTSignature
+		}
+		return nil
+	}
+
+	return ErrJWTSignature
+}
+
+func claim_time(claims map[string]interface{}, name string) (time.Time, bool) {
+	v, ok := claims[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return time.Unix(int64(v), 0), true
+}
+
+func claim_strings(v interface{}) []string {
+	switch val := v.(type) {
+	case string:
+		return []string { val }
+	case []interface{}:
+		ret := make([]string, 0, len(val))
+		for _, s := range val {
+			if str, ok := s.(string); ok {
+				ret = append(ret, str)
+			}
+		}
+		return ret
+	}
+
+	return nil
+}
+
+// validate checks signature and standard claims of the token and returns its issuer and claims
+func (ja *JWTAuth) validate(token string) (*jwt_issuer, map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, nil, ErrJWTMalformed
+	}
+
+	hdata, err := b64decode(parts[0])
+	if err != nil {
+		return nil, nil, ErrJWTMalformed
+	}
+	cdata, err := b64decode(parts[1])
+	if err != nil {
+		return nil, nil, ErrJWTMalformed
+	}
+	sig, err := b64decode(parts[2])
+	if err != nil {
+		return nil, nil, ErrJWTMalformed
+	}
+
+	var hdr jwt_header
+	err = json.Unmarshal(hdata, &hdr)
+	if err != nil {
+		return nil, nil, ErrJWTMalformed
+	}
+
+	claims := make(map[string]interface{})
+	err = json.Unmarshal(cdata, &claims)
+	if err != nil {
+		return nil, nil, ErrJWTMalformed
+	}
+
+	iss_name, _ := claims["iss"].(string)
+	iss, ok := ja.issuers[iss_name]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown issuer '%s'", iss_name)
+	}
+
+	key, err := iss.key(hdr.Kid, ja.refresh)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = verify_signature(hdr.Alg, key, []byte(parts[0] + "." + parts[1]), sig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	exp, ok := claim_time(claims, "exp")
+	if !ok {
+		return nil, nil, fmt.Errorf("token does not expire")
+	}
+	if now.After(exp.Add(ja.leeway)) {
+		return nil, nil, fmt.Errorf("token has expired at %s", exp.String())
+	}
+	if nbf, ok := claim_time(claims, "nbf"); ok && now.Add(ja.leeway).Before(nbf) {
+		return nil, nil, fmt.Errorf("token is not valid before %s", nbf.String())
+	}
+
+	if iss.Audience != "" {
+		found := false
+		for _, aud := range claim_strings(claims["aud"]) {
+			if aud == iss.Audience {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, nil, fmt.Errorf("token audience does not match '%s'", iss.Audience)
+		}
+	}
+
+	return iss, claims, nil
+}
+
+// provision inserts new user with unusable random password, such users can only log in with tokens
+func (ja *JWTAuth) provision(iss *jwt_issuer, mbox *Mailbox) error {
+	var err error
+	mbox.Password, err = random_string(TokenSecretLength)
+	if err != nil {
+		return err
+	}
+	mbox.Role = iss.Role
+
+	err = ja.actl.NewUser(mbox)
+	if err != nil {
+		return err
+	}
+
+	if ja.Provision != nil {
+		err = ja.Provision(mbox.Username)
+		if err != nil {
+			ja.actl.DeleteUser(mbox)
+			return fmt.Errorf("could not provision user %s: %v", mbox.Username, err)
+		}
+	}
+
+	mbox.Password = ""
+	glog.Infof("jwt: issuer: %s: provisioned new user: %s", iss.Issuer, mbox.String())
+	return nil
+}
+
+func (ja *JWTAuth) authenticate(token string) (*Mailbox, error) {
+	iss, claims, err := ja.validate(token)
+	if err != nil {
+		return nil, err
+	}
+
+	username, _ := claims[iss.UsernameClaim].(string)
+	if username == "" {
+		return nil, fmt.Errorf("token does not contain claim '%s'", iss.UsernameClaim)
+	}
+
+	mbox := &Mailbox {
+		Username: username,
+	}
+
+	_, err = ja.actl.read_user(mbox)
+	if err != nil {
+		// only missing users are provisioned, database errors must not end up in the insert of the user
+		// which may already exist
+		if err != ErrUserNotFound || !iss.Provision {
+			return nil, err
+		}
+
+		err = ja.provision(iss, mbox)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if iss.GroupsClaim != "" {
+		mbox.Groups = append(mbox.Groups, claim_strings(claims[iss.GroupsClaim])...)
+	}
+
+	return mbox, nil
+}
+
+// Auth validates JWT from the 'Authorization: Bearer' header, requests without JWT are passed to the next
+// middleware unchanged, so it has to be installed before BasicAuth which accepts other credentials
+func (ja *JWTAuth) Auth(c *web.C, h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		hdr := r.Header.Get("Authorization")
+		if !strings.HasPrefix(hdr, "Bearer ") {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		token := strings.TrimSpace(strings.TrimPrefix(hdr, "Bearer "))
+		// opaque api tokens do not contain dots, they are checked by BasicAuth
+		if strings.Count(token, ".") != 2 {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		mbox, err := ja.authenticate(token)
+		if err != nil {
+			metrics.Auth("jwt", metrics.AuthFailure)
+
+			estr := fmt.Sprintf("invalid jwt: %v", err)
+			glog.Errorf("%s", estr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="wd2", error="invalid_token"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(estr))
+			return
+		}
+
+		metrics.Auth("jwt", metrics.AuthSuccess)
+
+		if c.Env == nil {
+			c.Env = make(map[interface{}]interface{})
+		}
+		c.Env[AuthUsernameString] = mbox.Username
+		c.Env[AuthRoleString] = mbox.Role
+		c.Env[AuthGroupsString] = mbox.Groups
+
+		h.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
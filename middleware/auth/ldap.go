@@ -0,0 +1,359 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/golang/glog"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LDAPCtl struct {
+	// ldap://host:389 or ldaps://host:636
+	URL			string			`json:"url"`
+	StartTLS		bool			`json:"start_tls"`
+	InsecureSkipVerify	bool			`json:"insecure_skip_verify"`
+	// connection and operation timeout in seconds
+	Timeout			int			`json:"timeout"`
+
+	// service account used to search for the user entry, anonymous search is used if empty
+	BindDN			string			`json:"bind_dn"`
+	BindPassword		string			`json:"bind_password"`
+
+	BaseDN			string			`json:"base_dn"`
+	// %s is replaced with the escaped username
+	UserFilter		string			`json:"user_filter"`
+
+	// user attribute which lists groups the user is member of
+	GroupAttr		string			`json:"group_attr"`
+	// if not empty, groups are searched under this DN with GroupFilter instead of reading GroupAttr,
+	// %s in the filter is replaced with the escaped user DN
+	GroupBaseDN		string			`json:"group_base_dn"`
+	GroupFilter		string			`json:"group_filter"`
+	// maps LDAP group names (CN) to wd2 groups, if not empty only mapped groups are used
+	GroupMap		map[string]string	`json:"group_map"`
+	// wd2 groups which grant admin or read-only roles, all other users get user role
+	AdminGroups		[]string		`json:"admin_groups"`
+	ReadOnlyGroups		[]string		`json:"read_only_groups"`
+
+	// successful binds are cached for this number of seconds, 0 disables caching
+	CacheTTL		int			`json:"cache_ttl"`
+	// maximum number of cached binds
+	CacheSize		int			`json:"cache_size"`
+}
+
+const (
+	DefaultLDAPTimeout = 10
+	DefaultLDAPUserFilter = "(uid=%s)"
+	DefaultLDAPGroupAttr = "memberOf"
+	DefaultLDAPGroupFilter = "(member=%s)"
+	DefaultLDAPCacheSize = 10000
+)
+
+// ldap_conn is the part of the LDAP connection used by the authenticator
+type ldap_conn interface {
+	Bind(username, password string) error
+	Search(req *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close()
+}
+
+// ldap_client hides the return value of Close() which differs between versions of the library
+type ldap_client struct {
+	*ldap.Conn
+}
+
+func (c *ldap_client) Close() {
+	c.Conn.Close()
+}
+
+type ldap_cached struct {
+	hash			[sha256.Size]byte
+	role			string
+	groups			[]string
+	expires			time.Time
+}
+
+type LDAPAuthenticator struct {
+	conf			LDAPCtl
+	timeout			time.Duration
+
+	sync.Mutex
+	cache			map[string]*ldap_cached
+
+	// connects to the server, tests replace it with a stand-in
+	dial			func() (ldap_conn, error)
+
+	// Provision is called after every bind which has not been served from the cache,
+	// it is supposed to create user's root directory if it does not exist yet
+	Provision		func(username string) error
+}
+
+func NewLDAPAuthenticator(conf *LDAPCtl) (*LDAPAuthenticator, error) {
+	if conf.URL == "" {
+		return nil, fmt.Errorf("ldap: url must not be empty")
+	}
+	if conf.BaseDN == "" {
+		return nil, fmt.Errorf("ldap: base_dn must not be empty")
+	}
+
+	a := &LDAPAuthenticator {
+		conf: *conf,
+		timeout: time.Duration(conf.Timeout) * time.Second,
+		cache: make(map[string]*ldap_cached),
+	}
+
+	if a.conf.Timeout == 0 {
+		a.timeout = DefaultLDAPTimeout * time.Second
+	}
+	if a.conf.UserFilter == "" {
+		a.conf.UserFilter = DefaultLDAPUserFilter
+	}
+	if a.conf.GroupAttr == "" {
+		a.conf.GroupAttr = DefaultLDAPGroupAttr
+	}
+	if a.conf.GroupFilter == "" {
+		a.conf.GroupFilter = DefaultLDAPGroupFilter
+	}
+	if a.conf.CacheSize <= 0 {
+		a.conf.CacheSize = DefaultLDAPCacheSize
+	}
+	a.dial = a.connect
+
+	return a, nil
+}
+
+func (a *LDAPAuthenticator) Close() {
+}
+
+func (a *LDAPAuthenticator) connect() (ldap_conn, error) {
+	tc := &tls.Config {
+		InsecureSkipVerify: a.conf.InsecureSkipVerify,
+	}
+
+	conn, err := ldap.DialURL(a.conf.URL, ldap.DialWithTLSConfig(tc))
+	if err != nil {
+		return nil, fmt.Errorf("ldap: could not connect to %s: %v", a.conf.URL, err)
+	}
+	conn.SetTimeout(a.timeout)
+
+	if a.conf.StartTLS {
+		err = conn.StartTLS(tc)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("ldap: %s: starttls has failed: %v", a.conf.URL, err)
+		}
+	}
+
+	return &ldap_client { conn }, nil
+}
+
+// group_name returns CN of the group DN, or the value itself if it is not a DN
+func group_name(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 {
+		return dn
+	}
+
+	for _, attr := range parsed.RDNs[0].Attributes {
+		if strings.EqualFold(attr.Type, "cn") {
+			return attr.Value
+		}
+	}
+
+	return dn
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// map_groups converts LDAP groups into wd2 groups and selects role of the user
+func (a *LDAPAuthenticator) map_groups(ldap_groups []string) ([]string, string) {
+	groups := make([]string, 0, len(ldap_groups))
+	for _, g := range ldap_groups {
+		name := group_name(g)
+
+		if len(a.conf.GroupMap) != 0 {
+			mapped, ok := a.conf.GroupMap[name]
+			if !ok {
+				continue
+			}
+			name = mapped
+		}
+
+		if !contains(groups, name) {
+			groups = append(groups, name)
+		}
+	}
+
+	role := RoleUser
+	for _, g := range groups {
+		if contains(a.conf.AdminGroups, g) {
+			return groups, RoleAdmin
+		}
+		if contains(a.conf.ReadOnlyGroups, g) {
+			role = RoleReadOnly
+		}
+	}
+
+	return groups, role
+}
+
+func (a *LDAPAuthenticator) bind(mbox *Mailbox) error {
+	conn, err := a.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if a.conf.BindDN != "" {
+		err = conn.Bind(a.conf.BindDN, a.conf.BindPassword)
+		if err != nil {
+			return fmt.Errorf("ldap: could not bind service account %s: %v", a.conf.BindDN, err)
+		}
+	}
+
+	attrs := []string { "dn" }
+	if a.conf.GroupBaseDN == "" {
+		attrs = append(attrs, a.conf.GroupAttr)
+	}
+
+	req := ldap.NewSearchRequest(a.conf.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(a.timeout / time.Second), false,
+		fmt.Sprintf(a.conf.UserFilter, ldap.EscapeFilter(mbox.Username)), attrs, nil)
+	res, err := conn.Search(req)
+	if err != nil {
+		return fmt.Errorf("ldap: could not search for user %s: %v", mbox.Username, err)
+	}
+	if len(res.Entries) != 1 {
+		return fmt.Errorf("ldap: user %s: search returned %d entries", mbox.Username, len(res.Entries))
+	}
+
+	entry := res.Entries[0]
+
+	err = conn.Bind(entry.DN, mbox.Password)
+	if err != nil {
+		return fmt.Errorf("username or password mismatch")
+	}
+
+	var ldap_groups []string
+	if a.conf.GroupBaseDN == "" {
+		ldap_groups = entry.GetAttributeValues(a.conf.GroupAttr)
+	} else {
+		// search for groups with the service account, user may not be allowed to read them
+		if a.conf.BindDN != "" {
+			err = conn.Bind(a.conf.BindDN, a.conf.BindPassword)
+			if err != nil {
+				return fmt.Errorf("ldap: could not bind service account %s: %v", a.conf.BindDN, err)
+			}
+		}
+
+		greq := ldap.NewSearchRequest(a.conf.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0,
+			int(a.timeout / time.Second), false,
+			fmt.Sprintf(a.conf.GroupFilter, ldap.EscapeFilter(entry.DN)), []string { "dn" }, nil)
+		gres, err := conn.Search(greq)
+		if err != nil {
+			return fmt.Errorf("ldap: could not search for groups of user %s: %v", mbox.Username, err)
+		}
+
+		for _, g := range gres.Entries {
+			ldap_groups = append(ldap_groups, g.DN)
+		}
+	}
+
+	mbox.Groups, mbox.Role = a.map_groups(ldap_groups)
+	return nil
+}
+
+func (a *LDAPAuthenticator) cached(mbox *Mailbox, hash [sha256.Size]byte) bool {
+	a.Lock()
+	defer a.Unlock()
+
+	ce, ok := a.cache[mbox.Username]
+	if !ok {
+		return false
+	}
+
+	if time.Now().After(ce.expires) {
+		delete(a.cache, mbox.Username)
+		return false
+	}
+
+	if subtle.ConstantTimeCompare(ce.hash[:], hash[:]) != 1 {
+		return false
+	}
+
+	mbox.Role = ce.role
+	mbox.Groups = ce.groups
+	return true
+}
+
+func (a *LDAPAuthenticator) Authenticate(mbox *Mailbox) error {
+	// empty password turns the bind into unauthenticated one, which always succeeds
+	if mbox.Password == "" {
+		return fmt.Errorf("username or password mismatch")
+	}
+
+	hash := sha256.Sum256([]byte(mbox.Username + "\x00" + mbox.Password))
+	if a.conf.CacheTTL > 0 && a.cached(mbox, hash) {
+		return nil
+	}
+
+	err := a.bind(mbox)
+	if err != nil {
+		glog.Errorf("ldap: username: %s: %v", mbox.Username, err)
+		return err
+	}
+
+	if a.Provision != nil {
+		err = a.Provision(mbox.Username)
+		if err != nil {
+			return fmt.Errorf("ldap: could not provision user %s: %v", mbox.Username, err)
+		}
+	}
+
+	if a.conf.CacheTTL > 0 {
+		a.store(mbox, hash)
+	}
+
+	return nil
+}
+
+// store caches successful bind, expired entries are dropped when the cache is full,
+// random entries are evicted if that is not enough
+func (a *LDAPAuthenticator) store(mbox *Mailbox, hash [sha256.Size]byte) {
+	now := time.Now()
+
+	a.Lock()
+	defer a.Unlock()
+
+	if _, ok := a.cache[mbox.Username]; !ok && len(a.cache) >= a.conf.CacheSize {
+		for username, ce := range a.cache {
+			if now.After(ce.expires) {
+				delete(a.cache, username)
+			}
+		}
+
+		for username := range a.cache {
+			if len(a.cache) < a.conf.CacheSize {
+				break
+			}
+			delete(a.cache, username)
+		}
+	}
+
+	a.cache[mbox.Username] = &ldap_cached {
+		hash: hash,
+		role: mbox.Role,
+		groups: mbox.Groups,
+		expires: now.Add(time.Duration(a.conf.CacheTTL) * time.Second),
+	}
+}
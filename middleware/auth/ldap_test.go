@@ -0,0 +1,259 @@
+package auth
+
+import (
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"testing"
+	"time"
+)
+
+const (
+	test_people_dn = "ou=people,dc=example,dc=org"
+	test_groups_dn = "ou=groups,dc=example,dc=org"
+	test_service_dn = "cn=wd2,dc=example,dc=org"
+	test_service_password = "service"
+)
+
+type test_ldap_user struct {
+	uid			string
+	password		string
+	member_of		[]string
+}
+
+func (u *test_ldap_user) dn() string {
+	return "uid=" + u.uid + "," + test_people_dn
+}
+
+// test_ldap is a local stand-in of the directory: users live under test_people_dn,
+// groups under test_groups_dn list their members by DN
+type test_ldap struct {
+	users			[]*test_ldap_user
+	// group CN -> member DNs
+	groups			map[string][]string
+	fail_search		bool
+
+	dials			int
+}
+
+type test_ldap_conn struct {
+	dir			*test_ldap
+}
+
+func (d *test_ldap) dial() (ldap_conn, error) {
+	d.dials++
+	return &test_ldap_conn { dir: d }, nil
+}
+
+func (c *test_ldap_conn) Bind(username, password string) error {
+	if username == test_service_dn && password == test_service_password {
+		return nil
+	}
+
+	for _, u := range c.dir.users {
+		if u.dn() == username && u.password == password {
+			return nil
+		}
+	}
+
+	return ldap.NewError(ldap.LDAPResultInvalidCredentials, fmt.Errorf("invalid credentials"))
+}
+
+func (c *test_ldap_conn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	if c.dir.fail_search {
+		return nil, ldap.NewError(ldap.LDAPResultUnavailable, fmt.Errorf("server is unavailable"))
+	}
+
+	res := &ldap.SearchResult{}
+	switch req.BaseDN {
+	case test_people_dn:
+		for _, u := range c.dir.users {
+			if req.Filter == fmt.Sprintf(DefaultLDAPUserFilter, ldap.EscapeFilter(u.uid)) {
+				res.Entries = append(res.Entries, ldap.NewEntry(u.dn(), map[string][]string {
+					DefaultLDAPGroupAttr: u.member_of,
+				}))
+			}
+		}
+	case test_groups_dn:
+		for cn, members := range c.dir.groups {
+			for _, m := range members {
+				if req.Filter == fmt.Sprintf(DefaultLDAPGroupFilter, ldap.EscapeFilter(m)) {
+					res.Entries = append(res.Entries, ldap.NewEntry("cn=" + cn + "," + test_groups_dn, nil))
+				}
+			}
+		}
+	}
+
+	return res, nil
+}
+
+func (c *test_ldap_conn) Close() {
+}
+
+func new_test_directory() *test_ldap {
+	return &test_ldap {
+		users: []*test_ldap_user {
+			{ "alice", "alice-password", []string { "cn=admins," + test_groups_dn, "cn=staff," + test_groups_dn } },
+			{ "bob", "bob-password", []string { "cn=staff," + test_groups_dn, "cn=guests," + test_groups_dn } },
+			{ "carol", "carol-password", []string { "cn=unknown," + test_groups_dn } },
+			{ "dup", "dup-password", nil },
+			{ "dup", "dup-password", nil },
+		},
+		groups: map[string][]string {
+			"admins": []string { "uid=alice," + test_people_dn },
+			"staff": []string { "uid=alice," + test_people_dn, "uid=bob," + test_people_dn },
+			"guests": []string { "uid=bob," + test_people_dn },
+		},
+	}
+}
+
+func new_test_ldap(t *testing.T, dir *test_ldap, conf LDAPCtl) *LDAPAuthenticator {
+	conf.URL = "ldap://localhost"
+	conf.BaseDN = test_people_dn
+	conf.BindDN = test_service_dn
+	if conf.BindPassword == "" {
+		conf.BindPassword = test_service_password
+	}
+	conf.GroupMap = map[string]string {
+		"admins": "wd2-admins",
+		"staff": "staff",
+		"guests": "guests",
+	}
+	conf.AdminGroups = []string { "wd2-admins" }
+	conf.ReadOnlyGroups = []string { "guests" }
+
+	a, err := NewLDAPAuthenticator(&conf)
+	if err != nil {
+		t.Fatalf("could not create ldap authenticator: %v", err)
+	}
+	a.dial = dir.dial
+	return a
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	tests := []struct {
+		name		string
+		conf		LDAPCtl
+		fail_search	bool
+		username	string
+		password	string
+		ok		bool
+		role		string
+		groups		[]string
+	} {
+		{ "admin via attribute", LDAPCtl{}, false, "alice", "alice-password", true, RoleAdmin, []string { "wd2-admins", "staff" } },
+		{ "read-only via attribute", LDAPCtl{}, false, "bob", "bob-password", true, RoleReadOnly, []string { "staff", "guests" } },
+		{ "unmapped groups are dropped", LDAPCtl{}, false, "carol", "carol-password", true, RoleUser, []string {} },
+		{
+			"admin via search", LDAPCtl { GroupBaseDN: test_groups_dn }, false,
+			"alice", "alice-password", true, RoleAdmin, []string { "wd2-admins", "staff" },
+		},
+		{
+			"read-only via search", LDAPCtl { GroupBaseDN: test_groups_dn }, false,
+			"bob", "bob-password", true, RoleReadOnly, []string { "guests", "staff" },
+		},
+		{ "wrong password", LDAPCtl{}, false, "alice", "bob-password", false, "", nil },
+		{ "empty password", LDAPCtl{}, false, "alice", "", false, "", nil },
+		{ "unknown user", LDAPCtl{}, false, "mallory", "password", false, "", nil },
+		{ "ambiguous user", LDAPCtl{}, false, "dup", "dup-password", false, "", nil },
+		{ "filter injection", LDAPCtl{}, false, "*", "alice-password", false, "", nil },
+		{ "search failure", LDAPCtl{}, true, "alice", "alice-password", false, "", nil },
+		{ "service bind failure", LDAPCtl { BindPassword: "wrong" }, false, "alice", "alice-password", false, "", nil },
+	}
+
+	for _, test := range tests {
+		dir := new_test_directory()
+		dir.fail_search = test.fail_search
+		a := new_test_ldap(t, dir, test.conf)
+
+		mbox := &Mailbox { Username: test.username, Password: test.password }
+		err := a.Authenticate(mbox)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: error: %v, want success: %v", test.name, err, test.ok)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		if mbox.Role != test.role {
+			t.Errorf("%s: role is '%s', want '%s'", test.name, mbox.Role, test.role)
+		}
+
+		// groups found by the search come in random order
+		if len(mbox.Groups) != len(test.groups) {
+			t.Errorf("%s: groups are %v, want %v", test.name, mbox.Groups, test.groups)
+			continue
+		}
+		for _, g := range test.groups {
+			if !contains(mbox.Groups, g) {
+				t.Errorf("%s: groups are %v, want %v", test.name, mbox.Groups, test.groups)
+				break
+			}
+		}
+	}
+}
+
+func TestLDAPCache(t *testing.T) {
+	dir := new_test_directory()
+	a := new_test_ldap(t, dir, LDAPCtl { CacheTTL: 60 })
+
+	auth := func(password string) error {
+		return a.Authenticate(&Mailbox { Username: "alice", Password: password })
+	}
+
+	if err := auth("alice-password"); err != nil {
+		t.Fatalf("could not authenticate: %v", err)
+	}
+	if err := auth("alice-password"); err != nil || dir.dials != 1 {
+		t.Errorf("cached bind: error: %v, connections: %d, want 1", err, dir.dials)
+	}
+
+	mbox := &Mailbox { Username: "alice", Password: "alice-password" }
+	a.Authenticate(mbox)
+	if mbox.Role != RoleAdmin || len(mbox.Groups) != 2 {
+		t.Errorf("cached bind returned role '%s' and groups %v", mbox.Role, mbox.Groups)
+	}
+
+	// wrong password is never served from the cache
+	if err := auth("wrong"); err == nil || dir.dials != 2 {
+		t.Errorf("wrong password: error: %v, connections: %d, want 2", err, dir.dials)
+	}
+
+	// password has been changed in the directory, the old one works until the entry expires
+	dir.users[0].password = "new-password"
+	if err := auth("alice-password"); err != nil {
+		t.Errorf("old password is not served from the cache: %v", err)
+	}
+
+	a.Lock()
+	a.cache["alice"].expires = time.Now().Add(-time.Second)
+	a.Unlock()
+
+	if err := auth("alice-password"); err == nil {
+		t.Errorf("old password has been accepted after the cache entry has expired")
+	}
+	if err := auth("new-password"); err != nil {
+		t.Errorf("new password has been rejected: %v", err)
+	}
+}
+
+func TestLDAPCacheSize(t *testing.T) {
+	dir := new_test_directory()
+	a := new_test_ldap(t, dir, LDAPCtl { CacheTTL: 60, CacheSize: 2 })
+
+	for _, u := range dir.users[:3] {
+		err := a.Authenticate(&Mailbox { Username: u.uid, Password: u.password })
+		if err != nil {
+			t.Fatalf("%s: could not authenticate: %v", u.uid, err)
+		}
+
+		a.Lock()
+		size := len(a.cache)
+		_, ok := a.cache[u.uid]
+		a.Unlock()
+
+		if size > 2 || !ok {
+			t.Errorf("%s: cache holds %d entries, just cached entry is present: %v", u.uid, size, ok)
+		}
+	}
+}
@@ -0,0 +1,445 @@
+package auth
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LockoutUser = "user"
+	LockoutIP = "ip"
+	// password protected public link, name is the link id, not the token
+	LockoutLink = "link"
+)
+
+type LockoutCtl struct {
+	// number of consecutive failures which locks username or address, negative value disables protection
+	MaxFailures		int		`json:"max_failures"`
+	// delay after the first failure in milliseconds, it is doubled after every next failure up to MaxDelay
+	BaseDelay		int		`json:"base_delay"`
+	MaxDelay		int		`json:"max_delay"`
+	// lockout duration in seconds
+	LockoutTime		int		`json:"lockout_time"`
+	// failure counter is reset if there were no failures for this number of seconds
+	ResetAfter		int		`json:"reset_after"`
+	// lockouts are written to and reread from the auth database with this interval in seconds,
+	// this is how lockouts are shared between instances and how cleared lockouts are picked up
+	SyncInterval		int		`json:"sync_interval"`
+	// addresses and networks (CIDR) which are never throttled
+	AllowList		[]string	`json:"allow_list"`
+}
+
+const (
+	DefaultLockoutMaxFailures = 10
+	DefaultLockoutBaseDelay = 1000
+	DefaultLockoutMaxDelay = 60000
+	DefaultLockoutTime = 900
+	DefaultLockoutResetAfter = 900
+	DefaultLockoutSyncInterval = 30
+)
+
+type Lockout struct {
+	Kind			string		`json:"kind"`
+	Name			string		`json:"name"`
+	Failures		int		`json:"failures"`
+	LockedUntil		time.Time	`json:"locked_until"`
+	Updated			time.Time	`json:"updated"`
+}
+
+func (l *Lockout) String() string {
+	return fmt.Sprintf("%s: %s, failures: %d, locked until: '%s', updated: '%s'",
+		l.Kind, l.Name, l.Failures, l.LockedUntil.String(), l.Updated.String())
+}
+
+type failure_state struct {
+	failures		int
+	last			time.Time
+	// next attempt is not allowed until this time
+	until			time.Time
+	// state has reached the lockout and must be stored in the database
+	locked			bool
+}
+
+type lockout_guard struct {
+	ctl			*AuthCtl
+	max_failures		int
+	base_delay		time.Duration
+	max_delay		time.Duration
+	lockout_time		time.Duration
+	reset_after		time.Duration
+	sync_interval		time.Duration
+	allow			[]*net.IPNet
+
+	sync.Mutex
+	states			map[string]*failure_state
+
+	done			chan struct{}
+	wg			sync.WaitGroup
+}
+
+func lockout_key(kind, name string) string {
+	return kind + ":" + name
+}
+
+func or_default(v, def int) int {
+	if v == 0 {
+		return def
+	}
+	return v
+}
+
+// SetLockout enables brute-force protection in BasicAuth, if it is already enabled,
+// the old guard is replaced and its failure counters are moved to the new one
+func (ctl *AuthCtl) SetLockout(conf *LockoutCtl) error {
+	if conf.MaxFailures < 0 {
+		ctl.lock.Lock()
+		old := ctl.lockout
+		ctl.lockout = nil
+		ctl.lock.Unlock()
+
+		if old != nil {
+			old.close()
+		}
+		return nil
+	}
+
+	g := &lockout_guard {
+		ctl: ctl,
+		max_failures: or_default(conf.MaxFailures, DefaultLockoutMaxFailures),
+		base_delay: time.Duration(or_default(conf.BaseDelay, DefaultLockoutBaseDelay)) * time.Millisecond,
+		max_delay: time.Duration(or_default(conf.MaxDelay, DefaultLockoutMaxDelay)) * time.Millisecond,
+		lockout_time: time.Duration(or_default(conf.LockoutTime, DefaultLockoutTime)) * time.Second,
+		reset_after: time.Duration(or_default(conf.ResetAfter, DefaultLockoutResetAfter)) * time.Second,
+		sync_interval: time.Duration(or_default(conf.SyncInterval, DefaultLockoutSyncInterval)) * time.Second,
+		states: make(map[string]*failure_state),
+		done: make(chan struct{}),
+	}
+
+	for _, a := range conf.AllowList {
+		if !strings.Contains(a, "/") {
+			if strings.Contains(a, ":") {
+				a += "/128"
+			} else {
+				a += "/32"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(a)
+		if err != nil {
+			return fmt.Errorf("lockout: invalid allow list entry '%s': %v", a, err)
+		}
+
+		g.allow = append(g.allow, network)
+	}
+
+	if old := ctl.guard(); old != nil {
+		old.Lock()
+		for key, st := range old.states {
+			copied := *st
+			g.states[key] = &copied
+		}
+		old.Unlock()
+	}
+
+	g.sync()
+
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+
+		for {
+			select {
+			case <-g.done:
+				return
+			case <-time.After(g.sync_interval):
+				g.sync()
+			}
+		}
+	}()
+
+	ctl.lock.Lock()
+	old := ctl.lockout
+	ctl.lockout = g
+	ctl.lock.Unlock()
+
+	if old != nil {
+		old.close()
+	}
+
+	return nil
+}
+
+func (g *lockout_guard) close() {
+	close(g.done)
+	g.wg.Wait()
+}
+
+func client_address(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (g *lockout_guard) allowed(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range g.allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns time to wait before the next attempt for the given username and address, zero if attempt is allowed
+func (g *lockout_guard) check(username, addr string) time.Duration {
+	return g.check_kind(LockoutUser, username, addr)
+}
+
+func (g *lockout_guard) check_kind(kind, name, addr string) time.Duration {
+	if g.allowed(addr) {
+		return 0
+	}
+
+	g.Lock()
+	defer g.Unlock()
+
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range []string { lockout_key(kind, name), lockout_key(LockoutIP, addr) } {
+		st, ok := g.states[key]
+		if !ok {
+			continue
+		}
+
+		if st.until.After(now) && st.until.Sub(now) > wait {
+			wait = st.until.Sub(now)
+		}
+	}
+
+	return wait
+}
+
+// fail_key increments failure counter and returns lockout if this failure has locked the key
+func (g *lockout_guard) fail_key(kind, name string, now time.Time) *Lockout {
+	key := lockout_key(kind, name)
+	st, ok := g.states[key]
+	if !ok || (now.Sub(st.last) > g.reset_after && !st.until.After(now)) {
+		st = &failure_state{}
+		g.states[key] = st
+	}
+
+	st.failures++
+	st.last = now
+
+	if st.failures >= g.max_failures {
+		st.until = now.Add(g.lockout_time)
+		st.locked = true
+
+		return &Lockout {
+			Kind: kind,
+			Name: name,
+			Failures: st.failures,
+			LockedUntil: st.until,
+			Updated: now,
+		}
+	}
+
+	delay := g.base_delay << uint(st.failures - 1)
+	if delay > g.max_delay || delay <= 0 {
+		delay = g.max_delay
+	}
+	st.until = now.Add(delay)
+	return nil
+}
+
+func (g *lockout_guard) failure(username, addr string) {
+	g.failure_kind(LockoutUser, username, addr)
+}
+
+func (g *lockout_guard) failure_kind(kind, name, addr string) {
+	if g.allowed(addr) {
+		return
+	}
+
+	g.Lock()
+	now := time.Now()
+	locked := make([]*Lockout, 0, 2)
+	if name != "" {
+		if l := g.fail_key(kind, name, now); l != nil {
+			locked = append(locked, l)
+		}
+	}
+	if l := g.fail_key(LockoutIP, addr, now); l != nil {
+		locked = append(locked, l)
+	}
+	g.Unlock()
+
+	for _, l := range locked {
+		glog.Errorf("lockout: %s: locked", l.String())
+
+		if g.ctl.db != nil {
+			err := g.ctl.SaveLockout(l)
+			if err != nil {
+				glog.Errorf("%v", err)
+			}
+		}
+	}
+}
+
+// success only clears the counter of the username, otherwise attacker could reset the counter of its address
+// by logging in into its own account between the guesses, address counter decays after reset_after
+func (g *lockout_guard) success(username string) {
+	g.success_kind(LockoutUser, username)
+}
+
+func (g *lockout_guard) success_kind(kind, name string) {
+	g.Lock()
+	delete(g.states, lockout_key(kind, name))
+	g.Unlock()
+}
+
+// Throttled returns time the client of @r has to wait before the next attempt to authenticate as @name of @kind,
+// zero if the attempt is allowed or brute-force protection is disabled
+func (ctl *AuthCtl) Throttled(kind, name string, r *http.Request) time.Duration {
+	if g := ctl.guard(); g != nil {
+		return g.check_kind(kind, name, client_address(r))
+	}
+	return 0
+}
+
+// AttemptFailed counts failed attempt of the client of @r to authenticate as @name of @kind
+func (ctl *AuthCtl) AttemptFailed(kind, name string, r *http.Request) {
+	if g := ctl.guard(); g != nil {
+		g.failure_kind(kind, name, client_address(r))
+	}
+}
+
+// AttemptSucceeded clears failure counter of @name of @kind
+func (ctl *AuthCtl) AttemptSucceeded(kind, name string) {
+	if g := ctl.guard(); g != nil {
+		g.success_kind(kind, name)
+	}
+}
+
+// sync drops stale counters, removes lockouts which have been cleared in the database
+// and picks up lockouts set by other instances
+func (g *lockout_guard) sync() {
+	now := time.Now()
+	var stored map[string]*Lockout
+
+	if g.ctl.db != nil {
+		lockouts, err := g.ctl.ListLockouts()
+		if err != nil {
+			glog.Errorf("lockout: sync: %v", err)
+			return
+		}
+
+		stored = make(map[string]*Lockout)
+		for _, l := range lockouts {
+			if l.LockedUntil.After(now) {
+				stored[lockout_key(l.Kind, l.Name)] = l
+			}
+		}
+	}
+
+	g.Lock()
+	defer g.Unlock()
+
+	for key, st := range g.states {
+		if st.locked && stored != nil {
+			if _, ok := stored[key]; !ok {
+				delete(g.states, key)
+			}
+			continue
+		}
+
+		if now.Sub(st.last) > g.reset_after && !st.until.After(now) {
+			delete(g.states, key)
+		}
+	}
+
+	for key, l := range stored {
+		g.states[key] = &failure_state {
+			failures: l.Failures,
+			last: l.Updated,
+			until: l.LockedUntil,
+			locked: true,
+		}
+	}
+}
+
+// TooManyRequests replies to the client which has to wait @wait before the next attempt
+func TooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait / time.Second) + 1))
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write([]byte("too many failed authentication attempts, try again later"))
+}
+
+func (ctl *AuthCtl) SaveLockout(l *Lockout) error {
+	_, err := ctl.db.Exec("REPLACE INTO lockouts SET kind=?,name=?,failures=?,locked_until=?,updated=?",
+		l.Kind, l.Name, l.Failures, l.LockedUntil, l.Updated)
+	if err != nil {
+		return fmt.Errorf("could not save lockout: %s: %v", l.String(), err)
+	}
+
+	return nil
+}
+
+func (ctl *AuthCtl) ListLockouts() ([]*Lockout, error) {
+	rows, err := ctl.db.Query("SELECT kind,name,failures,locked_until,updated FROM lockouts ORDER BY kind, name")
+	if err != nil {
+		return nil, fmt.Errorf("could not read lockouts: %v", err)
+	}
+	defer rows.Close()
+
+	lockouts := make([]*Lockout, 0)
+	for rows.Next() {
+		var l Lockout
+
+		err = rows.Scan(&l.Kind, &l.Name, &l.Failures, &l.LockedUntil, &l.Updated)
+		if err != nil {
+			return nil, fmt.Errorf("database schema mismatch: %v", err)
+		}
+
+		lockouts = append(lockouts, &l)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not scan database: %v", err)
+	}
+
+	return lockouts, nil
+}
+
+// ClearLockout removes lockout from the database, running servers pick it up within the sync interval
+func (ctl *AuthCtl) ClearLockout(kind, name string) error {
+	_, err := ctl.db.Exec("DELETE FROM lockouts WHERE kind=? AND name=?", kind, name)
+	if err != nil {
+		return fmt.Errorf("could not clear lockout: %s: %s: %v", kind, name, err)
+	}
+
+	return nil
+}
+
+// ClearExpiredLockouts removes lockouts which have already expired
+func (ctl *AuthCtl) ClearExpiredLockouts() error {
+	_, err := ctl.db.Exec("DELETE FROM lockouts WHERE locked_until < ?", time.Now())
+	if err != nil {
+		return fmt.Errorf("could not clear expired lockouts: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func new_test_guard() *lockout_guard {
+	return &lockout_guard {
+		ctl: &AuthCtl{},
+		max_failures: 5,
+		base_delay: time.Second,
+		max_delay: 5 * time.Second,
+		lockout_time: time.Hour,
+		reset_after: time.Minute,
+		states: make(map[string]*failure_state),
+	}
+}
+
+func TestFailKeyBackoff(t *testing.T) {
+	g := new_test_guard()
+	now := time.Now()
+
+	tests := []struct {
+		delay		time.Duration
+		locked		bool
+	} {
+		{ time.Second, false },
+		{ 2 * time.Second, false },
+		{ 4 * time.Second, false },
+		// capped by max_delay
+		{ 5 * time.Second, false },
+		{ time.Hour, true },
+	}
+
+	for i, test := range tests {
+		l := g.fail_key(LockoutUser, "user", now)
+		if (l != nil) != test.locked {
+			t.Fatalf("failure %d: locked: %v, want %v", i + 1, l != nil, test.locked)
+		}
+
+		st := g.states[lockout_key(LockoutUser, "user")]
+		if st.failures != i + 1 {
+			t.Errorf("failure %d: counter is %d", i + 1, st.failures)
+		}
+		if delay := st.until.Sub(now); delay != test.delay {
+			t.Errorf("failure %d: delay is %v, want %v", i + 1, delay, test.delay)
+		}
+	}
+}
+
+func TestFailKeyOverflow(t *testing.T) {
+	g := new_test_guard()
+	g.max_failures = 1000
+	now := time.Now()
+
+	for i := 0; i < 100; i++ {
+		g.fail_key(LockoutIP, "10.0.0.1", now)
+
+		st := g.states[lockout_key(LockoutIP, "10.0.0.1")]
+		if delay := st.until.Sub(now); delay <= 0 || delay > g.max_delay {
+			t.Fatalf("failure %d: delay %v is out of (0, %v] range", i + 1, delay, g.max_delay)
+		}
+	}
+}
+
+func TestFailKeyReset(t *testing.T) {
+	g := new_test_guard()
+	now := time.Now()
+
+	g.fail_key(LockoutUser, "user", now)
+	g.fail_key(LockoutUser, "user", now)
+
+	// counter is not reset while the delay is still active
+	g.fail_key(LockoutUser, "user", now.Add(3 * time.Second))
+	if st := g.states[lockout_key(LockoutUser, "user")]; st.failures != 3 {
+		t.Errorf("counter is %d after the delayed failure, want 3", st.failures)
+	}
+
+	later := now.Add(3 * time.Second + g.reset_after + time.Minute)
+	g.fail_key(LockoutUser, "user", later)
+	st := g.states[lockout_key(LockoutUser, "user")]
+	if st.failures != 1 {
+		t.Errorf("counter is %d after reset_after, want 1", st.failures)
+	}
+	if delay := st.until.Sub(later); delay != g.base_delay {
+		t.Errorf("delay is %v after reset_after, want %v", delay, g.base_delay)
+	}
+}
+
+func TestSuccessKeepsAddress(t *testing.T) {
+	g := new_test_guard()
+
+	g.failure("victim", "10.0.0.1")
+	g.success("attacker")
+	if wait := g.check("victim", "10.0.0.1"); wait <= 0 {
+		t.Errorf("failure has been cleared by the successful login of another user")
+	}
+
+	g.success("victim")
+	if _, ok := g.states[lockout_key(LockoutUser, "victim")]; ok {
+		t.Errorf("user counter has not been cleared by the successful login")
+	}
+	if _, ok := g.states[lockout_key(LockoutIP, "10.0.0.1")]; !ok {
+		t.Errorf("address counter has been cleared by the successful login")
+	}
+}
+
+func TestLockoutKinds(t *testing.T) {
+	g := new_test_guard()
+	g.max_failures = 2
+
+	g.failure_kind(LockoutLink, "0123456789ab", "10.0.0.1")
+	g.failure_kind(LockoutLink, "0123456789ab", "10.0.0.2")
+	if _, ok := g.states[lockout_key(LockoutUser, "0123456789ab")]; ok {
+		t.Errorf("link failures have been counted for the user with the same name")
+	}
+
+	// link is locked for every address
+	if wait := g.check_kind(LockoutLink, "0123456789ab", "10.0.0.3"); wait < g.lockout_time - time.Second {
+		t.Errorf("link has not been locked, wait: %v", wait)
+	}
+	if wait := g.check_kind(LockoutLink, "ba9876543210", "10.0.0.3"); wait != 0 {
+		t.Errorf("other link is throttled, wait: %v", wait)
+	}
+
+	g.success_kind(LockoutLink, "0123456789ab")
+	if wait := g.check_kind(LockoutLink, "0123456789ab", "10.0.0.3"); wait != 0 {
+		t.Errorf("link is still throttled after the successful attempt, wait: %v", wait)
+	}
+}
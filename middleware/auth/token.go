@@ -0,0 +1,213 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// application password is accepted in place of the primary password by basic authentication
+	TokenAppPassword = "app-password"
+	// api token is sent in the 'Authorization: Bearer <secret>' header, username is not needed
+	TokenAPI = "api"
+
+	ScopeRead = "read"
+	ScopeReadWrite = "read-write"
+
+	TokenIDLength = 8
+	TokenSecretLength = 32
+)
+
+var ErrTokenNotFound = errors.New("token not found")
+
+type Token struct {
+	ID			string		`json:"id"`
+	Username		string		`json:"username"`
+	Name			string		`json:"name"`
+	Kind			string		`json:"kind"`
+	Scope			string		`json:"scope"`
+	// plain secret is only returned when token is created, database stores its sha256 hash
+	Secret			string		`json:"secret,omitempty"`
+	Created			time.Time	`json:"created"`
+	// zero time means token has never been used
+	LastUsed		time.Time	`json:"last_used"`
+	Revoked			bool		`json:"revoked"`
+}
+
+func (t *Token) String() string {
+	return fmt.Sprintf("id: %s, username: %s, name: %s, kind: %s, scope: %s, revoked: %v, created: '%s', last_used: '%s'",
+		t.ID, t.Username, t.Name, t.Kind, t.Scope, t.Revoked, t.Created.String(), t.LastUsed.String())
+}
+
+func random_string(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hash_secret(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+const tokensColumns = "id,username,name,kind,scope,created,last_used,revoked"
+
+type row_scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scan_token(rows row_scanner, t *Token) error {
+	var last_used *time.Time
+
+	err := rows.Scan(&t.ID, &t.Username, &t.Name, &t.Kind, &t.Scope, &t.Created, &last_used, &t.Revoked)
+	if err != nil {
+		return err
+	}
+
+	t.LastUsed = time.Time{}
+	if last_used != nil {
+		t.LastUsed = *last_used
+	}
+
+	return nil
+}
+
+// NewToken generates identifier and secret of the new token and stores its hash,
+// secret is returned in @t.Secret and can not be recovered later
+func (ctl *AuthCtl) NewToken(t *Token) error {
+	if t.Kind != TokenAppPassword && t.Kind != TokenAPI {
+		return fmt.Errorf("could not insert token: %s: invalid kind", t.String())
+	}
+	if t.Scope == "" {
+		t.Scope = ScopeReadWrite
+	}
+	if t.Scope != ScopeRead && t.Scope != ScopeReadWrite {
+		return fmt.Errorf("could not insert token: %s: invalid scope", t.String())
+	}
+
+	var err error
+	t.ID, err = random_string(TokenIDLength)
+	if err != nil {
+		return fmt.Errorf("could not generate token id: %v", err)
+	}
+
+	t.Secret, err = random_string(TokenSecretLength)
+	if err != nil {
+		return fmt.Errorf("could not generate token secret: %v", err)
+	}
+
+	t.Created = time.Now()
+	t.LastUsed = time.Time{}
+	t.Revoked = false
+
+	_, err = ctl.db.Exec("INSERT INTO tokens SET id=?,username=?,name=?,kind=?,scope=?,hash=?,created=?,revoked=?",
+		t.ID, t.Username, t.Name, t.Kind, t.Scope, hash_secret(t.Secret), t.Created, t.Revoked)
+	if err != nil {
+		return fmt.Errorf("could not insert token: %s: %v", t.String(), err)
+	}
+
+	return nil
+}
+
+func (ctl *AuthCtl) ListTokens(username string) ([]*Token, error) {
+	rows, err := ctl.db.Query("SELECT " + tokensColumns + " FROM tokens WHERE username=? ORDER BY created", username)
+	if err != nil {
+		return nil, fmt.Errorf("could not read tokens of user %s: %v", username, err)
+	}
+	defer rows.Close()
+
+	tokens := make([]*Token, 0)
+	for rows.Next() {
+		var t Token
+
+		err = scan_token(rows, &t)
+		if err != nil {
+			return nil, fmt.Errorf("database schema mismatch: %v", err)
+		}
+
+		tokens = append(tokens, &t)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not scan database: %v", err)
+	}
+
+	return tokens, nil
+}
+
+// RevokeToken disables token, revoked tokens are kept to show when they have been used for the last time
+func (ctl *AuthCtl) RevokeToken(username, id string) error {
+	defer ctl.cache().invalidate(username)
+
+	res, err := ctl.db.Exec("UPDATE tokens SET revoked=1 WHERE username=? AND id=?", username, id)
+	if err != nil {
+		return fmt.Errorf("could not revoke token: username: %s, id: %s: %v", username, id, err)
+	}
+
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		return ErrTokenNotFound
+	}
+
+	return nil
+}
+
+func (ctl *AuthCtl) DeleteUserTokens(username string) error {
+	defer ctl.cache().invalidate(username)
+
+	_, err := ctl.db.Exec("DELETE FROM tokens WHERE username=?", username)
+	if err != nil {
+		return fmt.Errorf("could not delete tokens of user %s: %v", username, err)
+	}
+
+	return nil
+}
+
+// CheckToken looks up valid token of the given @kind by its secret and updates its last used time,
+// @username is optional, if it is not empty token must belong to this user
+func (ctl *AuthCtl) CheckToken(username, kind, secret string) (*Token, error) {
+	rows, err := ctl.db.Query("SELECT " + tokensColumns + " FROM tokens WHERE hash=? AND kind=? AND revoked=0",
+		hash_secret(secret), kind)
+	if err != nil {
+		return nil, fmt.Errorf("could not read token: %v", err)
+	}
+	defer rows.Close()
+
+	var t *Token
+	for rows.Next() {
+		t = &Token{}
+
+		err = scan_token(rows, t)
+		if err != nil {
+			return nil, fmt.Errorf("database schema mismatch: %v", err)
+		}
+		break
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not scan database: %v", err)
+	}
+
+	if t == nil || (username != "" && t.Username != username) {
+		return nil, ErrTokenNotFound
+	}
+
+	t.LastUsed = time.Now()
+	_, err = ctl.db.Exec("UPDATE tokens SET last_used=? WHERE id=?", t.LastUsed, t.ID)
+	if err != nil {
+		return nil, fmt.Errorf("could not update token: %s: %v", t.String(), err)
+	}
+
+	return t, nil
+}
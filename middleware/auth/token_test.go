@@ -0,0 +1,27 @@
+package auth
+
+import (
+	"testing"
+)
+
+func TestTokenRole(t *testing.T) {
+	tests := []struct {
+		role		string
+		scope		string
+		want		string
+	} {
+		{ RoleAdmin, ScopeReadWrite, RoleUser },
+		{ RoleAdmin, ScopeRead, RoleReadOnly },
+		{ RoleUser, ScopeReadWrite, RoleUser },
+		{ RoleUser, ScopeRead, RoleReadOnly },
+		{ RoleReadOnly, ScopeReadWrite, RoleReadOnly },
+		{ RoleReadOnly, ScopeRead, RoleReadOnly },
+		{ RoleAdmin, "", RoleReadOnly },
+	}
+
+	for _, test := range tests {
+		if got := token_role(test.role, test.scope); got != test.want {
+			t.Errorf("token_role(%q, %q) = %q, want %q", test.role, test.scope, got, test.want)
+		}
+	}
+}
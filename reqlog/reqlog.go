@@ -0,0 +1,263 @@
+package reqlog
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/bioothod/wd2/middleware/auth"
+	"github.com/golang/glog"
+	"github.com/zenazn/goji/web"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RequestIDHeader = "X-Request-ID"
+	RequestIDString = "RequestID"
+
+	// incoming request ids longer than this are replaced with the generated one
+	MaxRequestIDLength = 128
+)
+
+// Fields are keys and values of the single structured log record
+type Fields map[string]interface{}
+
+type ctx_key int
+
+const request_id_key ctx_key = 0
+
+var (
+	lock sync.Mutex
+	output io.Writer = os.Stderr
+)
+
+type redaction struct {
+	prefix		string
+	redact		func(secret string) string
+}
+
+// paths which carry secrets, they are only changed at startup
+var redactions []redaction
+
+// RedactPath makes access log replace path component which follows @prefix with @redact(component),
+// it must be called before requests are served
+func RedactPath(prefix string, redact func(secret string) string) {
+	redactions = append(redactions, redaction {
+		prefix: prefix,
+		redact: redact,
+	})
+}
+
+func redact_path(p string) string {
+	for _, rd := range redactions {
+		if !strings.HasPrefix(p, rd.prefix) {
+			continue
+		}
+
+		secret := p[len(rd.prefix):]
+		rest := ""
+		if i := strings.Index(secret, "/"); i >= 0 {
+			secret, rest = secret[:i], secret[i:]
+		}
+
+		return rd.prefix + rd.redact(secret) + rest
+	}
+
+	return p
+}
+
+// SetOutput sets destination of the structured logs, default is stderr
+func SetOutput(w io.Writer) {
+	lock.Lock()
+	output = w
+	lock.Unlock()
+}
+
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, request_id_key, id)
+}
+
+// FromContext returns request id stored in @ctx, empty string if there is none
+func FromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+
+	id, _ := ctx.Value(request_id_key).(string)
+	return id
+}
+
+func GetRequestID(c web.C) string {
+	if c.Env == nil {
+		return ""
+	}
+
+	id, _ := c.Env[RequestIDString].(string)
+	return id
+}
+
+// Log writes single json line of the given @kind, time and request id of @ctx are added to @fields
+func Log(ctx context.Context, kind string, fields Fields) {
+	fields["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	fields["type"] = kind
+	if id := FromContext(ctx); id != "" {
+		fields["request_id"] = id
+	}
+
+	data, err := json.Marshal(fields)
+	if err != nil {
+		glog.Errorf("reqlog: could not marshal log record: %+v: %v", fields, err)
+		return
+	}
+	data = append(data, '\n')
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	_, err = output.Write(data)
+	if err != nil {
+		glog.Errorf("reqlog: could not write log record: %v", err)
+	}
+}
+
+// Duration converts time passed since @start into the milliseconds used by all records
+func Duration(start time.Time) float64 {
+	return float64(time.Since(start).Nanoseconds()) / float64(time.Millisecond)
+}
+
+func new_request_id() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(b)
+}
+
+func valid_request_id(id string) bool {
+	if id == "" || len(id) > MaxRequestIDLength {
+		return false
+	}
+
+	for _, ch := range id {
+		if ch <= ' ' || ch > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// RequestID middleware reuses request id sent by the client or proxy in the X-Request-ID header or generates new one,
+// id is returned in the response header, stored in the goji environment and in the request context
+func RequestID(c *web.C, h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !valid_request_id(id) {
+			id = new_request_id()
+		}
+
+		if c.Env == nil {
+			c.Env = make(map[interface{}]interface{})
+		}
+		c.Env[RequestIDString] = id
+		w.Header().Set(RequestIDHeader, id)
+
+		h.ServeHTTP(w, r.WithContext(NewContext(r.Context(), id)))
+	}
+	return http.HandlerFunc(fn)
+}
+
+type access_writer struct {
+	http.ResponseWriter
+	status			int
+	bytes			int64
+}
+
+func (w *access_writer) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *access_writer) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+type access_reader struct {
+	io.ReadCloser
+	bytes			int64
+}
+
+func (r *access_reader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// WriteTo keeps io.WriterTo of the wrapped body, like http.NoBody, visible to io.Copy
+func (r *access_reader) WriteTo(w io.Writer) (int64, error) {
+	if wt, ok := r.ReadCloser.(io.WriterTo); ok {
+		n, err := wt.WriteTo(w)
+		r.bytes += n
+		return n, err
+	}
+
+	return io.Copy(w, struct { io.Reader } { r })
+}
+
+// AccessLog writes record of every request after it has been served, it must be installed after RequestID
+// and before authentication, username is read from the environment filled by the auth middleware
+func AccessLog(c *web.C, h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		aw := &access_writer {
+			ResponseWriter: w,
+		}
+		var ar *access_reader
+		if r.Body != nil {
+			ar = &access_reader {
+				ReadCloser: r.Body,
+			}
+			r.Body = ar
+		}
+
+		h.ServeHTTP(aw, r)
+
+		if aw.status == 0 {
+			aw.status = http.StatusOK
+		}
+
+		fields := Fields {
+			"method": r.Method,
+			"path": redact_path(r.URL.Path),
+			"status": aw.status,
+			"bytes_out": aw.bytes,
+			"remote": r.RemoteAddr,
+			"duration_ms": Duration(start),
+		}
+		if ar != nil {
+			fields["bytes_in"] = ar.bytes
+		}
+		if username := auth.GetAuthUsername(*c); username != "" {
+			fields["user"] = username
+		}
+
+		Log(r.Context(), "access", fields)
+	}
+	return http.HandlerFunc(fn)
+}
@@ -0,0 +1,118 @@
+package reqlog
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestValidRequestID(t *testing.T) {
+	tests := []struct {
+		id		string
+		valid		bool
+	} {
+		{ "", false },
+		{ "abc-123", true },
+		{ "0123456789abcdef0123456789abcdef", true },
+		{ strings.Repeat("a", MaxRequestIDLength), true },
+		{ strings.Repeat("a", MaxRequestIDLength + 1), false },
+		{ "with space", false },
+		{ "tab\tinside", false },
+		{ "line\nbreak", false },
+		{ "non-ascii-é", false },
+		{ "del\x7f", false },
+	}
+
+	for _, test := range tests {
+		if got := valid_request_id(test.id); got != test.valid {
+			t.Errorf("valid_request_id(%q) = %v, want %v", test.id, got, test.valid)
+		}
+	}
+}
+
+func TestNewRequestID(t *testing.T) {
+	a := new_request_id()
+	b := new_request_id()
+
+	if !valid_request_id(a) {
+		t.Errorf("generated request id %q is not valid", a)
+	}
+	if a == b {
+		t.Errorf("two generated request ids are equal: %q", a)
+	}
+}
+
+// reader_from recurses into io.Copy the same way dbfs.File does if it is passed directly as the destination
+type reader_from struct {
+	bytes.Buffer
+	depth		int
+}
+
+func (rf *reader_from) ReadFrom(r io.Reader) (int64, error) {
+	rf.depth++
+	if rf.depth > 1 {
+		panic("ReadFrom has been called recursively")
+	}
+	return io.Copy(struct { io.Writer } { &rf.Buffer }, r)
+}
+
+func TestAccessReaderWriteTo(t *testing.T) {
+	tests := []struct {
+		name		string
+		body		io.ReadCloser
+		data		string
+	} {
+		{ "no body", http.NoBody, "" },
+		{ "plain body", io.NopCloser(strings.NewReader("some data")), "some data" },
+	}
+
+	for _, test := range tests {
+		ar := &access_reader {
+			ReadCloser: test.body,
+		}
+
+		var dst reader_from
+		n, err := io.Copy(&dst, ar)
+		if err != nil {
+			t.Fatalf("%s: copy failed: %v", test.name, err)
+		}
+		if n != int64(len(test.data)) || dst.String() != test.data {
+			t.Errorf("%s: copied %d bytes %q, want %q", test.name, n, dst.String(), test.data)
+		}
+		if ar.bytes != int64(len(test.data)) {
+			t.Errorf("%s: access reader counted %d bytes, want %d", test.name, ar.bytes, len(test.data))
+		}
+	}
+}
+
+func TestRedactPath(t *testing.T) {
+	old := redactions
+	defer func() {
+		redactions = old
+	}()
+
+	RedactPath("/s/", func(secret string) string {
+		return "id-" + strconv.Itoa(len(secret))
+	})
+
+	tests := []struct {
+		path		string
+		want		string
+	} {
+		{ "/s/secret-token", "/s/id-12" },
+		{ "/s/secret-token/", "/s/id-12/" },
+		{ "/s/secret-token/dir/file", "/s/id-12/dir/file" },
+		{ "/s/", "/s/id-0" },
+		{ "/webdav/s/file", "/webdav/s/file" },
+		{ "/api/links/secret-token", "/api/links/secret-token" },
+	}
+
+	for _, test := range tests {
+		if got := redact_path(test.path); got != test.want {
+			t.Errorf("redact_path(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
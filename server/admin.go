@@ -0,0 +1,567 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/bioothod/wd2/dbfs"
+	"github.com/bioothod/wd2/middleware/auth"
+	"github.com/bioothod/wd2/tracing"
+	"github.com/golang/glog"
+	"github.com/zenazn/goji/web"
+	"go.opentelemetry.io/otel/attribute"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	JobDeleteUser = "delete-user"
+	JobExpiredLinks = "expired-links"
+	JobExpiredLockouts = "expired-lockouts"
+	JobFlushCache = "flush-cache"
+
+	JobRunning = "running"
+	JobDone = "done"
+	JobFailed = "failed"
+
+	// number of finished jobs kept in memory
+	MaxFinishedJobs = 100
+)
+
+// admin_job is a maintenance task which runs in background, jobs are kept in memory of this instance only
+type admin_job struct {
+	ID			string			`json:"id"`
+	Type			string			`json:"type"`
+	Username		string			`json:"username,omitempty"`
+	State			string			`json:"state"`
+	Error			string			`json:"error,omitempty"`
+	Result			string			`json:"result,omitempty"`
+	Started			time.Time		`json:"started"`
+	Finished		*time.Time		`json:"finished,omitempty"`
+}
+
+// admin_api manages users, their quotas and runs maintenance jobs, it must only be available to administrators
+type admin_api struct {
+	actl *auth.AuthCtl
+	fs *dbfs.DbFS
+
+	sync.Mutex
+	next_id			int
+	jobs			map[string]*admin_job
+	running			sync.WaitGroup
+
+	// parent context of all jobs, it is cancelled when jobs do not complete in time during shutdown
+	ctx			context.Context
+	cancel			context.CancelFunc
+}
+
+type admin_user struct {
+	Username		string			`json:"username"`
+	Role			string			`json:"role"`
+	Groups			[]string		`json:"groups,omitempty"`
+	Disabled		bool			`json:"disabled"`
+	Created			time.Time		`json:"created"`
+	Usage			*dbfs.Usage		`json:"usage,omitempty"`
+	Quota			*dbfs.Quota		`json:"quota,omitempty"`
+}
+
+type admin_user_request struct {
+	Username		string			`json:"username"`
+	Password		string			`json:"password"`
+	Role			string			`json:"role"`
+	Disabled		*bool			`json:"disabled"`
+}
+
+type admin_job_request struct {
+	Type			string			`json:"type"`
+}
+
+func new_admin_api(actl *auth.AuthCtl, fs *dbfs.DbFS) *admin_api {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &admin_api {
+		actl: actl,
+		fs: fs,
+		jobs: make(map[string]*admin_job),
+		ctx: ctx,
+		cancel: cancel,
+	}
+}
+
+func new_admin_user(mbox *auth.Mailbox) *admin_user {
+	return &admin_user {
+		Username: mbox.Username,
+		Role: mbox.Role,
+		Groups: mbox.Groups,
+		Disabled: mbox.Disabled,
+		Created: mbox.Created,
+	}
+}
+
+func (api *admin_api) user_error(w http.ResponseWriter, username string, err error, estr string) {
+	if err == auth.ErrUserNotFound {
+		write_error(w, http.StatusNotFound, "user not found")
+		return
+	}
+
+	glog.Errorf("admin: username: %s: %s: %v", username, estr, err)
+	write_error(w, http.StatusInternalServerError, estr)
+}
+
+func (api *admin_api) ListUsers(c web.C, w http.ResponseWriter, r *http.Request) {
+	users, err := api.actl.ListUsers()
+	if err != nil {
+		glog.Errorf("admin: %v", err)
+		write_error(w, http.StatusInternalServerError, "could not list users")
+		return
+	}
+
+	ret := make([]*admin_user, 0, len(users))
+	for _, mbox := range users {
+		ret = append(ret, new_admin_user(mbox))
+	}
+
+	write_json(w, http.StatusOK, ret)
+}
+
+func (api *admin_api) CreateUser(c web.C, w http.ResponseWriter, r *http.Request) {
+	var req admin_user_request
+	err := read_json(r, &req)
+	if err != nil {
+		write_error(w, http.StatusBadRequest, fmt.Sprintf("could not parse request: %v", err))
+		return
+	}
+
+	if req.Username == "" || req.Password == "" {
+		write_error(w, http.StatusBadRequest, "username and password must not be empty")
+		return
+	}
+	if req.Role == "" {
+		req.Role = auth.RoleUser
+	}
+	if !auth.ValidRole(req.Role) {
+		write_error(w, http.StatusBadRequest, fmt.Sprintf("invalid role '%s'", req.Role))
+		return
+	}
+
+	_, err = api.actl.UserInfo(req.Username)
+	if err == nil {
+		write_error(w, http.StatusConflict, "user already exists")
+		return
+	}
+	if err != auth.ErrUserNotFound {
+		api.user_error(w, req.Username, err, "could not create user")
+		return
+	}
+
+	mbox := &auth.Mailbox {
+		Username: req.Username,
+		Password: req.Password,
+		Role: req.Role,
+	}
+
+	err = api.actl.NewUser(mbox)
+	if err != nil {
+		api.user_error(w, req.Username, err, "could not create user")
+		return
+	}
+
+	u := &dbfs.DbFSUser {
+		Username: mbox.Username,
+		FS: api.fs,
+	}
+	err = u.Mkdir(r.Context(), "/", 0755 | os.ModeDir)
+	if err != nil {
+		api.actl.DeleteUser(mbox)
+
+		api.user_error(w, req.Username, err, "could not create root directory")
+		return
+	}
+
+	glog.Infof("admin: %s: created user: %s", auth.GetAuthUsername(c), mbox.String())
+	write_json(w, http.StatusCreated, new_admin_user(mbox))
+}
+
+func (api *admin_api) GetUser(c web.C, w http.ResponseWriter, r *http.Request) {
+	username := c.URLParams["user"]
+
+	mbox, err := api.actl.UserInfo(username)
+	if err != nil {
+		api.user_error(w, username, err, "could not read user")
+		return
+	}
+
+	ret := new_admin_user(mbox)
+
+	ret.Usage, err = api.fs.Usage(r.Context(), username)
+	if err != nil {
+		api.user_error(w, username, err, "could not read usage")
+		return
+	}
+
+	ret.Quota, err = api.fs.GetQuota(r.Context(), username)
+	if err != nil {
+		api.user_error(w, username, err, "could not read quota")
+		return
+	}
+
+	write_json(w, http.StatusOK, ret)
+}
+
+// UpdateUser changes role and state of the user, fields which are not set in the request are not changed
+func (api *admin_api) UpdateUser(c web.C, w http.ResponseWriter, r *http.Request) {
+	username := c.URLParams["user"]
+
+	var req admin_user_request
+	err := read_json(r, &req)
+	if err != nil {
+		write_error(w, http.StatusBadRequest, fmt.Sprintf("could not parse request: %v", err))
+		return
+	}
+
+	if req.Role != "" && !auth.ValidRole(req.Role) {
+		write_error(w, http.StatusBadRequest, fmt.Sprintf("invalid role '%s'", req.Role))
+		return
+	}
+
+	mbox, err := api.actl.UserInfo(username)
+	if err != nil {
+		api.user_error(w, username, err, "could not read user")
+		return
+	}
+
+	if req.Role != "" && req.Role != mbox.Role {
+		mbox.Role = req.Role
+		err = api.actl.SetRole(mbox)
+		if err != nil {
+			api.user_error(w, username, err, "could not set role")
+			return
+		}
+	}
+
+	if req.Disabled != nil && *req.Disabled != mbox.Disabled {
+		mbox.Disabled = *req.Disabled
+		err = api.actl.SetDisabled(username, mbox.Disabled)
+		if err != nil {
+			api.user_error(w, username, err, "could not update user")
+			return
+		}
+	}
+
+	glog.Infof("admin: %s: updated user: %s", auth.GetAuthUsername(c), mbox.String())
+	write_json(w, http.StatusOK, new_admin_user(mbox))
+}
+
+// DeleteUser disables the user and starts background job which purges its data and deletes the account
+func (api *admin_api) DeleteUser(c web.C, w http.ResponseWriter, r *http.Request) {
+	username := c.URLParams["user"]
+
+	if username == auth.GetAuthUsername(c) {
+		write_error(w, http.StatusBadRequest, "administrator can not delete itself")
+		return
+	}
+
+	mbox, err := api.actl.UserInfo(username)
+	if err != nil {
+		api.user_error(w, username, err, "could not read user")
+		return
+	}
+
+	// user must not be able to upload new files while the tree is being purged
+	err = api.actl.SetDisabled(username, true)
+	if err != nil {
+		api.user_error(w, username, err, "could not disable user")
+		return
+	}
+
+	job := api.start_job(JobDeleteUser, username, func(ctx context.Context) (string, error) {
+		err := api.fs.PurgeUser(ctx, username)
+		if err != nil {
+			return "", err
+		}
+
+		err = api.fs.DeleteQuota(ctx, username)
+		if err != nil {
+			return "", err
+		}
+
+		err = api.actl.DeleteUser(mbox)
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("user '%s' has been deleted", username), nil
+	})
+
+	glog.Infof("admin: %s: deleting user: %s, job: %s", auth.GetAuthUsername(c), mbox.String(), job.ID)
+	write_json(w, http.StatusAccepted, job)
+}
+
+func (api *admin_api) SetPassword(c web.C, w http.ResponseWriter, r *http.Request) {
+	username := c.URLParams["user"]
+
+	var req admin_user_request
+	err := read_json(r, &req)
+	if err != nil {
+		write_error(w, http.StatusBadRequest, fmt.Sprintf("could not parse request: %v", err))
+		return
+	}
+
+	if req.Password == "" {
+		write_error(w, http.StatusBadRequest, "password must not be empty")
+		return
+	}
+
+	mbox, err := api.actl.UserInfo(username)
+	if err != nil {
+		api.user_error(w, username, err, "could not read user")
+		return
+	}
+
+	mbox.Password = req.Password
+	err = api.actl.UpdateUser(mbox)
+	if err != nil {
+		api.user_error(w, username, err, "could not update password")
+		return
+	}
+
+	glog.Infof("admin: %s: password of user %s has been reset", auth.GetAuthUsername(c), username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (api *admin_api) GetQuota(c web.C, w http.ResponseWriter, r *http.Request) {
+	username := c.URLParams["user"]
+
+	q, err := api.fs.GetQuota(r.Context(), username)
+	if err != nil {
+		api.user_error(w, username, err, "could not read quota")
+		return
+	}
+
+	write_json(w, http.StatusOK, q)
+}
+
+func (api *admin_api) SetQuota(c web.C, w http.ResponseWriter, r *http.Request) {
+	username := c.URLParams["user"]
+
+	var q dbfs.Quota
+	err := read_json(r, &q)
+	if err != nil {
+		write_error(w, http.StatusBadRequest, fmt.Sprintf("could not parse request: %v", err))
+		return
+	}
+
+	if q.MaxFiles < 0 {
+		write_error(w, http.StatusBadRequest, "limits must not be negative")
+		return
+	}
+
+	_, err = api.actl.UserInfo(username)
+	if err != nil {
+		api.user_error(w, username, err, "could not read user")
+		return
+	}
+
+	q.Username = username
+	err = api.fs.SetQuota(r.Context(), &q)
+	if err != nil {
+		api.user_error(w, username, err, "could not set quota")
+		return
+	}
+
+	glog.Infof("admin: %s: set quota: %s", auth.GetAuthUsername(c), q.String())
+	write_json(w, http.StatusOK, &q)
+}
+
+func (api *admin_api) DeleteQuota(c web.C, w http.ResponseWriter, r *http.Request) {
+	username := c.URLParams["user"]
+
+	err := api.fs.DeleteQuota(r.Context(), username)
+	if err != nil {
+		api.user_error(w, username, err, "could not delete quota")
+		return
+	}
+
+	glog.Infof("admin: %s: quota of user %s has been removed", auth.GetAuthUsername(c), username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (api *admin_api) UsageByUser(c web.C, w http.ResponseWriter, r *http.Request) {
+	usage, err := api.fs.UsageByUser(r.Context())
+	if err != nil {
+		glog.Errorf("admin: %v", err)
+		write_error(w, http.StatusInternalServerError, "could not read usage")
+		return
+	}
+
+	write_json(w, http.StatusOK, usage)
+}
+
+func (api *admin_api) UsageByBucket(c web.C, w http.ResponseWriter, r *http.Request) {
+	usage, err := api.fs.UsageByBucket(r.Context())
+	if err != nil {
+		glog.Errorf("admin: %v", err)
+		write_error(w, http.StatusInternalServerError, "could not read usage")
+		return
+	}
+
+	write_json(w, http.StatusOK, usage)
+}
+
+// start_job runs @fn in background, job is not bound to the request which has started it and gets its own trace,
+// returned job must not be modified by the caller
+func (api *admin_api) start_job(tp, username string, fn func(ctx context.Context) (string, error)) *admin_job {
+	api.Lock()
+	api.next_id++
+	job := &admin_job {
+		ID: strconv.Itoa(api.next_id),
+		Type: tp,
+		Username: username,
+		State: JobRunning,
+		Started: time.Now(),
+	}
+	api.jobs[job.ID] = job
+	ret := *job
+	api.running.Add(1)
+	api.Unlock()
+
+	go func() {
+		defer api.running.Done()
+
+		ctx, span := tracing.Start(api.ctx, "admin.job",
+			attribute.String("id", job.ID),
+			attribute.String("type", job.Type),
+			attribute.String("username", job.Username))
+		res, err := fn(ctx)
+		tracing.End(span, err)
+
+		api.Lock()
+		defer api.Unlock()
+
+		finished := time.Now()
+		job.Finished = &finished
+		job.Result = res
+		job.State = JobDone
+		if err != nil {
+			job.State = JobFailed
+			job.Error = err.Error()
+			glog.Errorf("admin: job: id: %s, type: %s, username: '%s': %v", job.ID, job.Type, job.Username, err)
+		} else {
+			glog.Infof("admin: job: id: %s, type: %s, username: '%s': %s", job.ID, job.Type, job.Username, res)
+		}
+
+		api.prune_jobs()
+	}()
+
+	return &ret
+}
+
+// prune_jobs removes the oldest finished jobs, must be called with lock held
+func (api *admin_api) prune_jobs() {
+	finished := make([]*admin_job, 0, len(api.jobs))
+	for _, job := range api.jobs {
+		if job.Finished != nil {
+			finished = append(finished, job)
+		}
+	}
+
+	if len(finished) <= MaxFinishedJobs {
+		return
+	}
+
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].Finished.Before(*finished[j].Finished)
+	})
+
+	for _, job := range finished[:len(finished) - MaxFinishedJobs] {
+		delete(api.jobs, job.ID)
+	}
+}
+
+// stop waits until all running jobs complete, if they do not complete within @timeout, they are cancelled
+// and get another @timeout to return, purge jobs stop between the entries and can be restarted later
+func (api *admin_api) stop(timeout time.Duration) error {
+	err := wait_timeout(&api.running, timeout)
+	if err == nil {
+		return nil
+	}
+
+	glog.Errorf("admin: jobs have not completed in %s, cancelling them", timeout)
+	api.cancel()
+
+	return wait_timeout(&api.running, timeout)
+}
+
+func (api *admin_api) ListJobs(c web.C, w http.ResponseWriter, r *http.Request) {
+	api.Lock()
+	jobs := make([]admin_job, 0, len(api.jobs))
+	for _, job := range api.jobs {
+		jobs = append(jobs, *job)
+	}
+	api.Unlock()
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Started.Before(jobs[j].Started)
+	})
+
+	write_json(w, http.StatusOK, jobs)
+}
+
+func (api *admin_api) GetJob(c web.C, w http.ResponseWriter, r *http.Request) {
+	id := c.URLParams["id"]
+
+	api.Lock()
+	job, ok := api.jobs[id]
+	var ret admin_job
+	if ok {
+		ret = *job
+	}
+	api.Unlock()
+
+	if !ok {
+		write_error(w, http.StatusNotFound, "job not found")
+		return
+	}
+
+	write_json(w, http.StatusOK, &ret)
+}
+
+// CreateJob starts maintenance job, users are deleted with DELETE request of the user
+func (api *admin_api) CreateJob(c web.C, w http.ResponseWriter, r *http.Request) {
+	var req admin_job_request
+	err := read_json(r, &req)
+	if err != nil {
+		write_error(w, http.StatusBadRequest, fmt.Sprintf("could not parse request: %v", err))
+		return
+	}
+
+	var fn func(ctx context.Context) (string, error)
+	switch req.Type {
+	case JobExpiredLinks:
+		fn = func(ctx context.Context) (string, error) {
+			n, err := api.fs.DeleteExpiredLinks(ctx)
+			return fmt.Sprintf("%d expired links have been removed", n), err
+		}
+	case JobExpiredLockouts:
+		fn = func(ctx context.Context) (string, error) {
+			err := api.actl.ClearExpiredLockouts()
+			return "expired lockouts have been cleared", err
+		}
+	case JobFlushCache:
+		fn = func(ctx context.Context) (string, error) {
+			api.fs.FlushCache()
+			return "metadata cache has been flushed", nil
+		}
+	default:
+		write_error(w, http.StatusBadRequest, fmt.Sprintf("invalid job type '%s'", req.Type))
+		return
+	}
+
+	job := api.start_job(req.Type, "", fn)
+
+	glog.Infof("admin: %s: started job: id: %s, type: %s", auth.GetAuthUsername(c), job.ID, job.Type)
+	write_json(w, http.StatusAccepted, job)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/golang/glog"
+	"net/http"
+)
+
+type api_error struct {
+	Error			string			`json:"error"`
+}
+
+func write_json(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		glog.Errorf("api: could not marshal reply: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func write_error(w http.ResponseWriter, status int, estr string) {
+	write_json(w, status, &api_error {
+		Error: estr,
+	})
+}
+
+func read_json(r *http.Request, v interface{}) error {
+	defer r.Body.Close()
+	return json.NewDecoder(r.Body).Decode(v)
+}
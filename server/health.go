@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	HealthOK = "ok"
+	HealthFailed = "failed"
+	HealthDegraded = "degraded"
+
+	// dependency which has not replied within this time is considered failed
+	HealthCheckTimeout = 3 * time.Second
+)
+
+type health_status struct {
+	Status			string			`json:"status"`
+	Error			string			`json:"error,omitempty"`
+	LatencyMs		int64			`json:"latency_ms"`
+}
+
+type health_reply struct {
+	Status			string				`json:"status"`
+	Checks			map[string]*health_status	`json:"checks"`
+}
+
+// health_check is a single dependency check, only one check per dependency can run at a time,
+// so that hung dependency does not accumulate goroutines with every probe
+type health_check struct {
+	check			func(ctx context.Context) error
+	running			int32
+}
+
+func new_health_check(check func(ctx context.Context) error) *health_check {
+	return &health_check {
+		check:		check,
+	}
+}
+
+// health_handler checks dependencies of the server: databases and blob store
+type health_handler struct {
+	checks			map[string]*health_check
+}
+
+// run_check returns generic error in the reply, details are only logged since probes are not authenticated
+func run_check(name string, hc *health_check) *health_status {
+	start := time.Now()
+	st := &health_status {
+		Status: HealthOK,
+	}
+
+	if !atomic.CompareAndSwapInt32(&hc.running, 0, 1) {
+		st.Status = HealthFailed
+		st.Error = "previous check has not completed yet"
+		return st
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), HealthCheckTimeout)
+	done := make(chan error, 1)
+	go func() {
+		defer atomic.StoreInt32(&hc.running, 0)
+		defer cancel()
+		done <- hc.check(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			glog.Errorf("health: %s: %v", name, err)
+			st.Status = HealthFailed
+			st.Error = "check failed"
+		}
+	case <-ctx.Done():
+		glog.Errorf("health: %s: timed out after %s", name, HealthCheckTimeout)
+		st.Status = HealthFailed
+		st.Error = fmt.Sprintf("timed out after %s", HealthCheckTimeout)
+	}
+
+	st.LatencyMs = time.Since(start).Nanoseconds() / int64(time.Millisecond)
+	return st
+}
+
+// check runs all checks concurrently and returns true if all of them have succeeded
+func (hh *health_handler) check() (*health_reply, bool) {
+	reply := &health_reply {
+		Status: HealthOK,
+		Checks: make(map[string]*health_status),
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for name, hc := range hh.checks {
+		wg.Add(1)
+		go func(name string, hc *health_check) {
+			defer wg.Done()
+
+			st := run_check(name, hc)
+
+			lock.Lock()
+			reply.Checks[name] = st
+			lock.Unlock()
+		}(name, hc)
+	}
+	wg.Wait()
+
+	ok := true
+	for _, st := range reply.Checks {
+		if st.Status != HealthOK {
+			ok = false
+		}
+	}
+
+	return reply, ok
+}
+
+// Healthz reports status of the dependencies, it only fails if the server can not serve requests at all,
+// failed dependencies make it degraded, so that the orchestrator does not restart server because of database outage
+func (hh *health_handler) Healthz(w http.ResponseWriter, r *http.Request) {
+	reply, ok := hh.check()
+	if !ok {
+		reply.Status = HealthDegraded
+	}
+
+	write_json(w, http.StatusOK, reply)
+}
+
+// Readyz fails with 503 if any dependency is not available, traffic should not be routed to this server
+func (hh *health_handler) Readyz(w http.ResponseWriter, r *http.Request) {
+	reply, ok := hh.check()
+	if !ok {
+		reply.Status = HealthFailed
+		write_json(w, http.StatusServiceUnavailable, reply)
+		return
+	}
+
+	write_json(w, http.StatusOK, reply)
+}
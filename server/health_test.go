@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRunCheck(t *testing.T) {
+	tests := []struct {
+		check		func(ctx context.Context) error
+		status		string
+	} {
+		{ func(ctx context.Context) error { return nil }, HealthOK },
+		{ func(ctx context.Context) error { return errors.New("dial tcp 10.0.0.1:3306: connection refused") }, HealthFailed },
+	}
+
+	for i, test := range tests {
+		st := run_check("test", new_health_check(test.check))
+		if st.Status != test.status {
+			t.Errorf("%d: status: %s, want %s", i, st.Status, test.status)
+		}
+		if strings.Contains(st.Error, "10.0.0.1") {
+			t.Errorf("%d: error exposes check details: %s", i, st.Error)
+		}
+	}
+}
+
+func TestRunCheckHung(t *testing.T) {
+	release := make(chan struct{})
+	var started int32
+	hc := new_health_check(func(ctx context.Context) error {
+		atomic.AddInt32(&started, 1)
+		<-ctx.Done()
+		<-release
+		return ctx.Err()
+	})
+
+	st := run_check("hung", hc)
+	if st.Status != HealthFailed || !strings.Contains(st.Error, "timed out") {
+		t.Fatalf("hung check: %+v", st)
+	}
+
+	st = run_check("hung", hc)
+	if st.Status != HealthFailed {
+		t.Fatalf("second check: %+v", st)
+	}
+	if atomic.LoadInt32(&started) != 1 {
+		t.Fatalf("check has been started again while previous one is still running")
+	}
+
+	close(release)
+}
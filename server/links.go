@@ -0,0 +1,403 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bioothod/wd2/dbfs"
+	"github.com/bioothod/wd2/metrics"
+	"github.com/bioothod/wd2/middleware/auth"
+	"github.com/golang/glog"
+	"github.com/zenazn/goji/web"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const LinkPrefix = "/s/"
+
+// links_handler serves public links, requests are not authenticated, access is granted by the token
+type links_handler struct {
+	fs *dbfs.DbFS
+	// link passwords are protected from guessing by the lockout of the auth controller
+	actl *auth.AuthCtl
+}
+
+type link_dirent struct {
+	Name			string			`json:"name"`
+	Size			int64			`json:"size"`
+	Dir			bool			`json:"dir"`
+	Modified		time.Time		`json:"modified"`
+}
+
+func (lh *links_handler) ServeHTTPC(c web.C, w http.ResponseWriter, r *http.Request) {
+	token := c.URLParams["token"]
+	rest := c.URLParams["*"]
+	if rest == "" {
+		rest = "/"
+	}
+
+	l, err := lh.fs.GetLink(r.Context(), token)
+	if err != nil {
+		if err != dbfs.ErrLinkNotFound {
+			glog.Errorf("link: id: %s: %v", dbfs.LinkID(token), err)
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	if l.Expired() {
+		http.Error(w, "link has expired", http.StatusGone)
+		return
+	}
+
+	if l.Password != "" {
+		id := dbfs.LinkID(l.Token)
+		if wait := lh.actl.Throttled(auth.LockoutLink, id, r); wait > 0 {
+			metrics.Auth("link", metrics.AuthLocked)
+			glog.Errorf("link: %s: %s %s: too many failed attempts, retry in %s", l.String(), r.Method, rest, wait.String())
+			auth.TooManyRequests(w, wait)
+			return
+		}
+
+		_, password, ok := r.BasicAuth()
+		if !ok {
+			password = r.Header.Get("X-Link-Password")
+		}
+
+		if !l.CheckPassword(password) {
+			// requests without password are the normal first step of the basic auth and are not counted
+			if password != "" {
+				metrics.Auth("link", metrics.AuthFailure)
+				lh.actl.AttemptFailed(auth.LockoutLink, id, r)
+			}
+
+			glog.Errorf("link: %s: %s %s: invalid password", l.String(), r.Method, rest)
+			w.Header().Set("WWW-Authenticate", `Basic realm="wd2 link"`)
+			http.Error(w, "link is protected by password", http.StatusUnauthorized)
+			return
+		}
+
+		metrics.Auth("link", metrics.AuthSuccess)
+		lh.actl.AttemptSucceeded(auth.LockoutLink, id)
+	}
+
+	u := &dbfs.DbFSUser {
+		FS: lh.fs,
+		Root: l.Root(),
+		TotalSize: r.ContentLength,
+	}
+
+	switch l.Mode {
+	case dbfs.LinkRead:
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "link is read-only", http.StatusMethodNotAllowed)
+			return
+		}
+
+		lh.download(w, r, l, u, rest)
+	case dbfs.LinkUpload:
+		if r.Method != "PUT" {
+			http.Error(w, "link is upload-only", http.StatusMethodNotAllowed)
+			return
+		}
+
+		lh.upload(w, r, l, u, rest)
+	default:
+		glog.Errorf("link: %s: invalid mode", l.String())
+		http.NotFound(w, r)
+	}
+}
+
+// counted_download returns true if the request downloads the end of the file of @size bytes,
+// resumed downloads and players fetching the file in chunks are counted once when they reach the end,
+// requests which make ServeContent send the whole file are always counted
+func counted_download(r *http.Request, size int64) bool {
+	// ServeContent ignores the range if the file has changed since the client has seen it
+	if r.Header.Get("If-Range") != "" {
+		return true
+	}
+
+	rng := strings.TrimSpace(r.Header.Get("Range"))
+	if rng == "" || !strings.HasPrefix(rng, "bytes=") {
+		return true
+	}
+
+	var sum int64
+	for _, spec := range strings.Split(strings.TrimPrefix(rng, "bytes="), ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		i := strings.Index(spec, "-")
+		if i < 0 {
+			return true
+		}
+		first, last := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+
+		if first == "" {
+			// suffix range always contains the last byte unless it is empty
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n != 0 {
+				return true
+			}
+			continue
+		}
+
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || start < 0 {
+			return true
+		}
+		if start >= size {
+			// unsatisfiable range, nothing is sent
+			continue
+		}
+
+		end := size - 1
+		if last != "" {
+			e, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || e < start {
+				return true
+			}
+			if e < end {
+				end = e
+			}
+		}
+
+		if end == size - 1 {
+			return true
+		}
+		sum += end - start + 1
+	}
+
+	// ServeContent sends the whole file if the ranges add up to more than its size
+	return sum >= size
+}
+
+func (lh *links_handler) download(w http.ResponseWriter, r *http.Request, l *dbfs.Link, u *dbfs.DbFSUser, name string) {
+	// range requests are only counted when they reach the end of the file,
+	// nothing but HEAD is served once the limit has been reached, otherwise ranges could be used to bypass it
+	if r.Method == "GET" && l.Exhausted() {
+		http.Error(w, "link download limit has been reached", http.StatusGone)
+		return
+	}
+
+	f, err := u.OpenFile(r.Context(), name, os.O_RDONLY, 0)
+	if err != nil {
+		glog.Errorf("link: %s: %s %s: could not open: %v", l.String(), r.Method, name, err)
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if fi.IsDir() {
+		entries, err := f.Readdir(0)
+		if err != nil {
+			glog.Errorf("link: %s: %s %s: could not read directory: %v", l.String(), r.Method, name, err)
+			http.Error(w, "could not read directory", http.StatusForbidden)
+			return
+		}
+
+		ret := make([]link_dirent, 0, len(entries))
+		for _, e := range entries {
+			ret = append(ret, link_dirent {
+				Name: e.Name(),
+				Size: e.Size(),
+				Dir: e.IsDir(),
+				Modified: e.ModTime(),
+			})
+		}
+
+		write_json(w, http.StatusOK, ret)
+		return
+	}
+
+	if r.Method == "GET" && counted_download(r, fi.Size()) {
+		err = lh.fs.CountLinkDownload(r.Context(), l)
+		if err != nil {
+			glog.Errorf("link: %s: %s %s: %v", l.String(), r.Method, name, err)
+			http.Error(w, "link download limit has been reached", http.StatusGone)
+			return
+		}
+	}
+
+	glog.Infof("link: %s: %s %s: size: %d", l.String(), r.Method, name, fi.Size())
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+}
+
+func (lh *links_handler) upload(w http.ResponseWriter, r *http.Request, l *dbfs.Link, u *dbfs.DbFSUser, name string) {
+	defer r.Body.Close()
+
+	if name == "/" || strings.HasSuffix(name, "/") {
+		http.Error(w, "file name is required", http.StatusBadRequest)
+		return
+	}
+
+	// upload-only links never overwrite existing files, their content is not visible to the uploader
+	_, err := u.Stat(r.Context(), name)
+	if err == nil {
+		http.Error(w, "file already exists", http.StatusConflict)
+		return
+	}
+
+	f, err := u.OpenFile(r.Context(), name, os.O_RDWR | os.O_CREATE | os.O_TRUNC, 0666)
+	if err != nil {
+		glog.Errorf("link: %s: %s %s: could not create file: %v", l.String(), r.Method, name, err)
+		http.Error(w, "could not create file", http.StatusForbidden)
+		return
+	}
+	defer f.Close()
+
+	n, err := io.Copy(f, r.Body)
+	if err != nil {
+		glog.Errorf("link: %s: %s %s: could not upload data: %v", l.String(), r.Method, name, err)
+		http.Error(w, "could not upload data", http.StatusInternalServerError)
+		return
+	}
+
+	glog.Infof("link: %s: %s %s: uploaded %d bytes", l.String(), r.Method, name, n)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// links_api manages public links of the authenticated user
+type links_api struct {
+	fs *dbfs.DbFS
+}
+
+type link_request struct {
+	Path			string			`json:"path"`
+	Mode			string			`json:"mode"`
+	Password		string			`json:"password"`
+	// either absolute expiration time or lifetime in seconds
+	Expires			time.Time		`json:"expires"`
+	TTL			int64			`json:"ttl"`
+	MaxDownloads		int64			`json:"max_downloads"`
+}
+
+type link_reply struct {
+	*dbfs.Link
+	URL			string			`json:"url"`
+}
+
+func (api *links_api) List(c web.C, w http.ResponseWriter, r *http.Request) {
+	username := auth.GetAuthUsername(c)
+
+	links, err := api.fs.ListLinks(r.Context(), username)
+	if err != nil {
+		glog.Errorf("links: username: %s: %v", username, err)
+		write_error(w, http.StatusInternalServerError, "could not list links")
+		return
+	}
+
+	ret := make([]link_reply, 0, len(links))
+	for _, l := range links {
+		ret = append(ret, link_reply { Link: l, URL: LinkPrefix + l.Token })
+	}
+
+	write_json(w, http.StatusOK, ret)
+}
+
+func (api *links_api) Create(c web.C, w http.ResponseWriter, r *http.Request) {
+	username := auth.GetAuthUsername(c)
+	if !auth.CanWrite(c) {
+		write_error(w, http.StatusForbidden, "read-only access")
+		return
+	}
+
+	var req link_request
+	err := read_json(r, &req)
+	if err != nil {
+		write_error(w, http.StatusBadRequest, fmt.Sprintf("could not parse request: %v", err))
+		return
+	}
+
+	if req.Mode == "" {
+		req.Mode = dbfs.LinkRead
+	}
+	if req.Mode != dbfs.LinkRead && req.Mode != dbfs.LinkUpload {
+		write_error(w, http.StatusBadRequest, fmt.Sprintf("invalid mode '%s'", req.Mode))
+		return
+	}
+	if req.MaxDownloads < 0 || req.TTL < 0 {
+		write_error(w, http.StatusBadRequest, "limits must not be negative")
+		return
+	}
+
+	u := &dbfs.DbFSUser {
+		FS: api.fs,
+		Username: username,
+	}
+
+	// links point to the real path in the user's own namespace, neither symbolic links nor shared folders are stored
+	real_name, err := u.ResolvePath(r.Context(), username, req.Path, true)
+	if err != nil || real_name == dbfs.SharedRoot || strings.HasPrefix(real_name, dbfs.SharedRoot + "/") {
+		write_error(w, http.StatusBadRequest, fmt.Sprintf("invalid path '%s'", req.Path))
+		return
+	}
+
+	fi, err := u.Stat(r.Context(), real_name)
+	if err != nil {
+		write_error(w, http.StatusNotFound, fmt.Sprintf("path '%s' does not exist", req.Path))
+		return
+	}
+	if req.Mode == dbfs.LinkUpload && !fi.IsDir() {
+		write_error(w, http.StatusBadRequest, "upload links must point to a directory")
+		return
+	}
+
+	l := &dbfs.Link {
+		Owner: username,
+		Path: real_name,
+		Mode: req.Mode,
+		Expires: req.Expires,
+		MaxDownloads: req.MaxDownloads,
+	}
+	if req.TTL != 0 {
+		l.Expires = time.Now().Add(time.Duration(req.TTL) * time.Second)
+	}
+
+	err = l.SetPassword(req.Password)
+	if err == nil {
+		err = api.fs.InsertLink(r.Context(), l)
+	}
+	if err != nil {
+		glog.Errorf("links: username: %s, path: %s: %v", username, req.Path, err)
+		write_error(w, http.StatusInternalServerError, "could not create link")
+		return
+	}
+
+	glog.Infof("links: username: %s: created link: %s", username, l.String())
+	write_json(w, http.StatusCreated, link_reply { Link: l, URL: LinkPrefix + l.Token })
+}
+
+func (api *links_api) Delete(c web.C, w http.ResponseWriter, r *http.Request) {
+	username := auth.GetAuthUsername(c)
+	token := c.URLParams["token"]
+	if !auth.CanWrite(c) {
+		write_error(w, http.StatusForbidden, "read-only access")
+		return
+	}
+
+	err := api.fs.DeleteLink(r.Context(), username, token)
+	if err != nil {
+		if err == dbfs.ErrLinkNotFound {
+			write_error(w, http.StatusNotFound, "link not found")
+			return
+		}
+
+		glog.Errorf("links: username: %s, id: %s: %v", username, dbfs.LinkID(token), err)
+		write_error(w, http.StatusInternalServerError, "could not delete link")
+		return
+	}
+
+	glog.Infof("links: username: %s: deleted link %s", username, dbfs.LinkID(token))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCountedDownload(t *testing.T) {
+	tests := []struct {
+		rng		string
+		if_range	string
+		counted		bool
+	} {
+		{ "", "", true },
+		{ "bytes=0-", "", true },
+		{ "bytes=0-999", "", true },
+		{ "bytes=0-5000", "", true },
+		{ "items=10-20", "", true },
+		{ "bytes=garbage", "", true },
+		// chunks which do not reach the end of the file are not counted, the last one is
+		{ "bytes=0-99", "", false },
+		{ " bytes=0-99, 200-299", "", false },
+		{ "bytes=100-199", "", false },
+		{ "bytes=900-999", "", true },
+		{ "bytes=900-", "", true },
+		{ "bytes=-500", "", true },
+		// whole file requested in the pieces which do not start at zero
+		{ "bytes=1-", "", true },
+		{ "bytes=100-,0-99", "", true },
+		{ "bytes=100-999,0-99", "", true },
+		// the last byte is still missing, it is counted when it is fetched
+		{ "bytes=100-998,0-99", "", false },
+		// ranges which add up to the file size make ServeContent send the whole file
+		{ "bytes=0-499,0-499", "", true },
+		{ "bytes=0-99", "\"etag\"", true },
+		// unsatisfiable ranges do not send anything
+		{ "bytes=1000-", "", false },
+		{ "bytes=-0", "", false },
+	}
+
+	for _, test := range tests {
+		r, err := http.NewRequest("GET", "/s/token/file", nil)
+		if err != nil {
+			t.Fatalf("could not create request: %v", err)
+		}
+		if test.rng != "" {
+			r.Header.Set("Range", test.rng)
+		}
+		if test.if_range != "" {
+			r.Header.Set("If-Range", test.if_range)
+		}
+
+		if got := counted_download(r, 1000); got != test.counted {
+			t.Errorf("counted_download(Range: %q, If-Range: %q) = %v, want %v", test.rng, test.if_range, got, test.counted)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"github.com/bioothod/wd2/metrics"
+	"golang.org/x/net/webdav"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// status_writer remembers status of the response for metrics
+type status_writer struct {
+	http.ResponseWriter
+	status			int
+}
+
+func (w *status_writer) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *status_writer) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// code returns status which has been sent to the client, handler which has not written anything replies with 200
+func (w *status_writer) code() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// methods which are exported as is, every other method is exported as 'other',
+// otherwise clients could create unlimited number of series by sending random methods
+var webdav_methods = map[string]bool {
+	"OPTIONS": true,
+	"GET": true,
+	"HEAD": true,
+	"POST": true,
+	"PUT": true,
+	"DELETE": true,
+	"MKCOL": true,
+	"COPY": true,
+	"MOVE": true,
+	"LOCK": true,
+	"UNLOCK": true,
+	"PROPFIND": true,
+	"PROPPATCH": true,
+}
+
+func method_label(method string) string {
+	if webdav_methods[method] {
+		return method
+	}
+	return "other"
+}
+
+// observe_webdav records method, status and latency of the webdav request started at @start
+func observe_webdav(r *http.Request, w *status_writer, start time.Time) {
+	method := method_label(r.Method)
+	metrics.WebdavRequests.WithLabelValues(method, strconv.Itoa(w.code())).Inc()
+	metrics.WebdavDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+// metered_ls tracks tokens of the locks created through it to export number of active locks,
+// expired locks are dropped the same way the underlying lock system does it
+type metered_ls struct {
+	webdav.LockSystem
+
+	lock			sync.Mutex
+	// lock token -> expiration time, zero time means lock never expires
+	locks			map[string]time.Time
+}
+
+func new_metered_ls(ls webdav.LockSystem) *metered_ls {
+	return &metered_ls {
+		LockSystem: ls,
+		locks: make(map[string]time.Time),
+	}
+}
+
+func lock_expires(now time.Time, duration time.Duration) time.Time {
+	if duration < 0 {
+		return time.Time{}
+	}
+	return now.Add(duration)
+}
+
+func (ls *metered_ls) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	token, err := ls.LockSystem.Create(now, details)
+	if err == nil {
+		ls.lock.Lock()
+		ls.locks[token] = lock_expires(now, details.Duration)
+		ls.lock.Unlock()
+	}
+
+	return token, err
+}
+
+func (ls *metered_ls) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	details, err := ls.LockSystem.Refresh(now, token, duration)
+
+	ls.lock.Lock()
+	if err == nil {
+		ls.locks[token] = lock_expires(now, duration)
+	} else if err == webdav.ErrNoSuchLock {
+		delete(ls.locks, token)
+	}
+	ls.lock.Unlock()
+
+	return details, err
+}
+
+func (ls *metered_ls) Unlock(now time.Time, token string) error {
+	err := ls.LockSystem.Unlock(now, token)
+	if err == nil || err == webdav.ErrNoSuchLock {
+		ls.lock.Lock()
+		delete(ls.locks, token)
+		ls.lock.Unlock()
+	}
+
+	return err
+}
+
+func (ls *metered_ls) active() float64 {
+	now := time.Now()
+
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+
+	for token, expires := range ls.locks {
+		if !expires.IsZero() && now.After(expires) {
+			delete(ls.locks, token)
+		}
+	}
+
+	return float64(len(ls.locks))
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMethodLabel(t *testing.T) {
+	tests := []struct {
+		method		string
+		label		string
+	} {
+		{ "GET", "GET" },
+		{ "PROPFIND", "PROPFIND" },
+		{ "UNLOCK", "UNLOCK" },
+		{ "get", "other" },
+		{ "PATCH", "other" },
+		{ "RANDOM-12345", "other" },
+		{ "", "other" },
+	}
+
+	for _, test := range tests {
+		if got := method_label(test.method); got != test.label {
+			t.Errorf("method_label(%q) = %q, want %q", test.method, got, test.label)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/bioothod/wd2/dbfs"
+	"github.com/bioothod/wd2/middleware/auth"
+	"github.com/golang/glog"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+func read_config(path string) (*Config, error) {
+	cdata, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file '%s': %v", path, err)
+	}
+
+	var conf Config
+	err = json.Unmarshal(cdata, &conf)
+	if err != nil {
+		return nil, fmt.Errorf("could not unmarshal config file '%s': %v", path, err)
+	}
+
+	err = conf.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file '%s': %v", path, err)
+	}
+
+	return &conf, nil
+}
+
+func (conf *Config) validate() error {
+	if conf.DbFSParams == "" {
+		return fmt.Errorf("dbfs parameters must be set")
+	}
+	if conf.AuthParams == "" && conf.Htpasswd == "" {
+		return fmt.Errorf("either auth database parameters or htpasswd file must be set")
+	}
+	if len(conf.Ebucket.Remotes) == 0 {
+		return fmt.Errorf("ebucket remotes must be set")
+	}
+	if conf.LogVerbosity != nil && *conf.LogVerbosity < 0 {
+		return fmt.Errorf("log verbosity must not be negative")
+	}
+	if conf.ShutdownTimeout < 0 {
+		return fmt.Errorf("shutdown timeout must not be negative")
+	}
+
+	return nil
+}
+
+func (conf *Config) shutdown_timeout() time.Duration {
+	timeout := conf.ShutdownTimeout
+	if timeout == 0 {
+		timeout = DefaultShutdownTimeout
+	}
+
+	return time.Duration(timeout) * time.Second
+}
+
+// keep_restart_fields restores fields of @next which can not be changed without restart from @cur
+// and returns json names of the fields which have been changed
+func keep_restart_fields(cur, next *Config) []string {
+	changed := make([]string, 0)
+
+	if cur.Addr != next.Addr {
+		changed = append(changed, "addr")
+		next.Addr = cur.Addr
+	}
+	if cur.MetricsAddr != next.MetricsAddr {
+		changed = append(changed, "metrics_addr")
+		next.MetricsAddr = cur.MetricsAddr
+	}
+	if cur.AuthParams != next.AuthParams {
+		changed = append(changed, "auth")
+		next.AuthParams = cur.AuthParams
+	}
+	if cur.DbFSParams != next.DbFSParams {
+		changed = append(changed, "dbfs")
+		next.DbFSParams = cur.DbFSParams
+	}
+	if !reflect.DeepEqual(cur.Cache, next.Cache) {
+		changed = append(changed, "cache")
+		next.Cache = cur.Cache
+	}
+	if !reflect.DeepEqual(cur.JWT, next.JWT) {
+		changed = append(changed, "jwt")
+		next.JWT = cur.JWT
+	}
+	if cur.AccessLog != next.AccessLog {
+		changed = append(changed, "access_log")
+		next.AccessLog = cur.AccessLog
+	}
+	if !reflect.DeepEqual(cur.Tracing, next.Tracing) {
+		changed = append(changed, "tracing")
+		next.Tracing = cur.Tracing
+	}
+	// certificate files are reloaded by the tls config itself
+	if !reflect.DeepEqual(cur.TLS, next.TLS) {
+		changed = append(changed, "tls")
+		next.TLS = cur.TLS
+	}
+
+	return changed
+}
+
+// new_authenticator returns source of the primary passwords configured in @conf,
+// LDAP takes precedence over htpasswd, nil means the users table of the auth database
+func new_authenticator(conf *Config, fs *dbfs.DbFS) (auth.Authenticator, error) {
+	if conf.LDAP != nil {
+		la, err := auth.NewLDAPAuthenticator(conf.LDAP)
+		if err != nil {
+			return nil, fmt.Errorf("could not create ldap authenticator: %v", err)
+		}
+
+		la.Provision = provision_root(fs)
+		return la, nil
+	}
+
+	if conf.Htpasswd != "" {
+		ha, err := auth.NewHtpasswdAuthenticator(conf.Htpasswd)
+		if err != nil {
+			return nil, fmt.Errorf("could not create htpasswd authenticator: %v", err)
+		}
+
+		// without auth database htpasswd users have never been created by auth_ctl
+		if conf.AuthParams == "" {
+			ha.Provision = provision_root(fs)
+		}
+		return ha, nil
+	}
+
+	return nil, nil
+}
+
+func set_log_verbosity(conf *Config) error {
+	if conf.LogVerbosity == nil {
+		return nil
+	}
+
+	return flag.Set("v", strconv.Itoa(*conf.LogVerbosity))
+}
+
+// config_reloader re-reads config file on SIGHUP and applies settings which can be changed while requests are served
+type config_reloader struct {
+	path			string
+	actl			*auth.AuthCtl
+	fs			*dbfs.DbFS
+
+	sync.Mutex
+	conf			*Config
+}
+
+func (rl *config_reloader) config() *Config {
+	rl.Lock()
+	defer rl.Unlock()
+
+	return rl.conf
+}
+
+func (rl *config_reloader) shutdown_timeout() time.Duration {
+	return rl.config().shutdown_timeout()
+}
+
+// reload applies the new config, settings which can not be applied are left unchanged,
+// config which fails validation is not applied at all
+func (rl *config_reloader) reload() error {
+	next, err := read_config(rl.path)
+	if err != nil {
+		return err
+	}
+
+	rl.Lock()
+	defer rl.Unlock()
+
+	cur := rl.conf
+
+	restart := keep_restart_fields(cur, next)
+	if len(restart) != 0 {
+		glog.Errorf("reload: fields %v have been changed, restart is required to apply them", restart)
+	}
+
+	failed := make([]string, 0)
+
+	if !reflect.DeepEqual(cur.LogVerbosity, next.LogVerbosity) {
+		err = set_log_verbosity(next)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("log_verbosity: %v", err))
+			next.LogVerbosity = cur.LogVerbosity
+		}
+	}
+
+	if !reflect.DeepEqual(cur.Ebucket, next.Ebucket) {
+		err := rl.fs.ReloadBuckets(&next.Ebucket)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("ebucket: %v", err))
+			next.Ebucket = cur.Ebucket
+		} else {
+			glog.Infof("reload: ebucket: remotes: %v, buckets: %v, bucket key: '%s': bucket processor has been replaced",
+				next.Ebucket.Remotes, next.Ebucket.Bnames, next.Ebucket.BucketKey)
+		}
+	}
+
+	if !reflect.DeepEqual(cur.Lockout, next.Lockout) {
+		err = rl.actl.SetLockout(&next.Lockout)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("lockout: %v", err))
+			next.Lockout = cur.Lockout
+		}
+	}
+
+	if !reflect.DeepEqual(cur.CredCache, next.CredCache) {
+		err = rl.actl.SetCredentialCache(&next.CredCache)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("credential_cache: %v", err))
+			next.CredCache = cur.CredCache
+		}
+	}
+
+	if !reflect.DeepEqual(cur.LDAP, next.LDAP) || cur.Htpasswd != next.Htpasswd {
+		a, err := new_authenticator(next, rl.fs)
+		if err == nil && a == nil && !rl.actl.HasDatabase() {
+			err = fmt.Errorf("htpasswd file is required without auth database")
+		}
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("ldap/htpasswd: %v", err))
+			next.LDAP = cur.LDAP
+			next.Htpasswd = cur.Htpasswd
+		} else {
+			rl.actl.SetAuthenticator(a)
+		}
+	}
+
+	rl.conf = next
+
+	if len(failed) != 0 {
+		return fmt.Errorf("could not apply %v, old settings are kept", failed)
+	}
+
+	glog.Infof("reload: config '%s' has been applied", rl.path)
+	return nil
+}
+
+func (rl *config_reloader) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		err := rl.reload()
+		if err != nil {
+			glog.Errorf("reload: %v", err)
+		}
+	}
+}
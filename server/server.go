@@ -1,20 +1,25 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"flag"
 	//"github.com/goji/param"
 	"github.com/golang/glog"
 	//"github.com/zenazn/goji"
 	"github.com/bioothod/wd2/dbfs"
+	"github.com/bioothod/wd2/metrics"
 	"github.com/bioothod/wd2/middleware/auth"
+	"github.com/bioothod/wd2/reqlog"
+	"github.com/bioothod/wd2/tracing"
 	"github.com/zenazn/goji/web"
 	"github.com/zenazn/goji/web/middleware"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	"golang.org/x/net/webdav"
-	"io/ioutil"
 	"log"
 	"net/http"
-	//"os"
+	"os"
+	"time"
 	//"strings"
 )
 
@@ -24,14 +29,60 @@ func webdav_log(r *http.Request, err error) {
 	}
 }
 
+// read_method returns true for webdav methods which never modify data
+func read_method(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "PROPFIND":
+		return true
+	}
+	return false
+}
+
 type dbfs_webdav struct {
-	fs *dbfs.DbFS
 	locks webdav.LockSystem
 	prefix string
+	// shared by all requests, the user whose namespace is served is taken from the request context
+	handler *webdav.Handler
+}
+
+func new_dbfs_webdav(fs *dbfs.DbFS, locks webdav.LockSystem, prefix string) *dbfs_webdav {
+	return &dbfs_webdav {
+		locks: locks,
+		prefix: prefix,
+		handler: &webdav.Handler {
+			Prefix: prefix,
+			FileSystem: &dbfs.DbFSUser {
+				FS: fs,
+			},
+			LockSystem: locks,
+			Logger: webdav_log,
+		},
+	}
 }
 
 func (dbh *dbfs_webdav) ServeHTTPC(c web.C, w http.ResponseWriter, r *http.Request) {
+	sw := &status_writer {
+		ResponseWriter: w,
+	}
+	defer observe_webdav(r, sw, time.Now())
+	w = sw
+
+	// the request span is a child of the client's span if the client has sent trace context
+	ctx, span := tracing.Start(tracing.Extract(r.Context(), r.Header), "webdav " + r.Method,
+		attribute.String("http.method", r.Method),
+		attribute.String("http.target", r.URL.Path),
+		attribute.String("request_id", reqlog.GetRequestID(c)))
+	defer func() {
+		span.SetAttributes(attribute.Int("http.status_code", sw.code()))
+		if sw.code() >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(sw.code()))
+		}
+		span.End()
+	}()
+	r = r.WithContext(ctx)
+
 	username := auth.GetAuthUsername(c)
+	span.SetAttributes(attribute.String("user", username))
 	if username == "" {
 		w.Header().Set("WWW-Authenticate", `Basic realm="wd2"`)
 		w.WriteHeader(http.StatusUnauthorized)
@@ -39,20 +90,20 @@ func (dbh *dbfs_webdav) ServeHTTPC(c web.C, w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	fs := &dbfs.DbFSUser {
-		FS: dbh.fs,
-		Username: username,
-		TotalSize: r.ContentLength,
+	if !auth.CanWrite(c) && !read_method(r.Method) {
+		glog.Errorf("%s: %s: username: %s, role: %s: method is not allowed", r.Method, r.URL.Path, username, auth.GetAuthRole(c))
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("read-only access"))
+		return
 	}
 
-	wdh := &webdav.Handler {
-		Prefix: dbh.prefix,
-		FileSystem: fs,
-		LockSystem: dbh.locks,
-		Logger: webdav_log,
-	}
+	ctx = dbfs.NewContext(ctx, &dbfs.Identity {
+		Username: username,
+		Groups: auth.GetAuthGroups(c),
+	})
+	ctx = dbfs.NewUploadContext(ctx, r.ContentLength)
 
-	wdh.ServeHTTP(w, r)
+	dbh.handler.ServeHTTP(w, r.WithContext(ctx))
 }
 
 type Config struct {
@@ -60,6 +111,46 @@ type Config struct {
 	AuthParams		string				`json:"auth"`
 	DbFSParams		string				`json:"dbfs"`
 	Ebucket			dbfs.EbucketCtl			`json:"ebucket"`
+	Cache			dbfs.CacheCtl			`json:"cache"`
+	JWT			auth.JWTCtl			`json:"jwt"`
+	// if set, primary passwords are checked against LDAP directory instead of the users table
+	LDAP			*auth.LDAPCtl			`json:"ldap"`
+	// htpasswd file used instead of the auth database when auth parameters are empty
+	Htpasswd		string				`json:"htpasswd"`
+	Lockout			auth.LockoutCtl			`json:"lockout"`
+	CredCache		auth.CredCacheCtl		`json:"credential_cache"`
+	// if set, server accepts HTTPS connections on addr instead of plain HTTP
+	TLS			*TLSCtl				`json:"tls"`
+	// on SIGTERM or SIGINT server stops accepting new connections and waits this number of seconds
+	// for in-flight requests and admin jobs to complete, default is 30
+	ShutdownTimeout		int				`json:"shutdown_timeout"`
+	// glog verbosity level, overrides -v command line option
+	LogVerbosity		*int				`json:"log_verbosity"`
+	// if set, /metrics is served on this address only without authentication,
+	// otherwise it is served on addr to authenticated admins
+	MetricsAddr		string				`json:"metrics_addr"`
+	// file where access and operation logs are appended as json lines, default is stderr
+	AccessLog		string				`json:"access_log"`
+	Tracing			tracing.TracingCtl		`json:"tracing"`
+}
+
+const DefaultShutdownTimeout = 30
+
+// provision_root returns function which creates root directory of the externally authenticated user if it does not exist
+func provision_root(fs *dbfs.DbFS) func(username string) error {
+	return func(username string) error {
+		u := &dbfs.DbFSUser {
+			Username: username,
+			FS: fs,
+		}
+
+		_, err := u.Stat(context.Background(), "/")
+		if err == nil {
+			return nil
+		}
+
+		return u.Mkdir(context.Background(), "/", 0755 | os.ModeDir)
+	}
 }
 
 func main() {
@@ -70,37 +161,148 @@ func main() {
 		log.Fatalf("You must provide config file")
 	}
 
-	cdata, err := ioutil.ReadFile(*cpath)
+	conf, err := read_config(*cpath)
 	if err != nil {
-		log.Fatalf("Could not read config file '%s': %v", *cpath, err)
+		log.Fatalf("%v", err)
 	}
 
-	var conf Config
-	err = json.Unmarshal(cdata, &conf)
+	err = set_log_verbosity(conf)
 	if err != nil {
-		log.Fatalf("Could not unmarshal config file '%s': %v", *cpath, err)
+		log.Fatalf("Could not set log verbosity: %v", err)
+	}
+
+	if conf.AccessLog != "" {
+		alog, err := os.OpenFile(conf.AccessLog, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0644)
+		if err != nil {
+			log.Fatalf("Could not open access log: %v", err)
+		}
+		defer func() {
+			alog.Sync()
+			alog.Close()
+		}()
+
+		reqlog.SetOutput(alog)
 	}
 
-	actl, err := auth.NewAuthCtl("mysql", conf.AuthParams)
+	stop_tracing, err := tracing.Init(&conf.Tracing)
 	if err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+		log.Fatalf("Could not set up tracing: %v", err)
 	}
 
-	fs, err := dbfs.NewDbFS("mysql", conf.DbFSParams, &conf.Ebucket)
+	fs, err := dbfs.NewDbFS("mysql", conf.DbFSParams, &conf.Ebucket, &conf.Cache)
 	if err != nil {
 		log.Fatalf("Could not create database controller: %v\n", err)
 	}
+	metrics.RegisterCache(fs.CacheStats)
+
+	backend, err := new_authenticator(conf, fs)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	var actl *auth.AuthCtl
+	if conf.AuthParams == "" {
+		actl = auth.NewAuthCtlWithoutDatabase(backend)
+	} else {
+		actl, err = auth.NewAuthCtl("mysql", conf.AuthParams)
+		if err != nil {
+			log.Fatalf("Failed to initialize database: %v", err)
+		}
+
+		if backend != nil {
+			actl.SetAuthenticator(backend)
+		}
+	}
+
+	err = actl.SetLockout(&conf.Lockout)
+	if err != nil {
+		log.Fatalf("Could not set up lockout: %v", err)
+	}
+
+	err = actl.SetCredentialCache(&conf.CredCache)
+	if err != nil {
+		log.Fatalf("Could not set up credential cache: %v", err)
+	}
 
-	dbh := &dbfs_webdav {
-		prefix: "/webdav",
-		locks: webdav.NewMemLS(),
+	rl := &config_reloader {
+		path: *cpath,
+		actl: actl,
 		fs: fs,
+		conf: conf,
+	}
+	go rl.watch()
+
+	locks := new_metered_ls(webdav.NewMemLS())
+	metrics.RegisterActiveLocks(locks.active)
+
+	dbh := new_dbfs_webdav(fs, locks, "/webdav")
+
+	lh := &links_handler {
+		fs: fs,
+		actl: actl,
+	}
+	lapi := &links_api {
+		fs: fs,
+	}
+	tapi := &tokens_api {
+		actl: actl,
 	}
 
 	mux := web.New()
 	mux.Use(middleware.EnvInit)
-	mux.Use(middleware.SubRouter)
-	mux.Use(actl.BasicAuth)
+	mux.Use(reqlog.RequestID)
+	mux.Use(reqlog.AccessLog)
+	// link tokens grant access to the data, only their ids are logged
+	reqlog.RedactPath(LinkPrefix, dbfs.LinkID)
+	reqlog.RedactPath("/api/links/", dbfs.LinkID)
+
+	if conf.MetricsAddr != "" {
+		go func() {
+			mmux := http.NewServeMux()
+			mmux.Handle("/metrics", metrics.Handler())
+
+			err := http.ListenAndServe(conf.MetricsAddr, mmux)
+			log.Fatalf("Could not serve metrics on %s: %v", conf.MetricsAddr, err)
+		}()
+	}
+
+	hh := &health_handler {
+		checks: map[string]*health_check {
+			"dbfs": new_health_check(fs.Ping),
+			"ebucket": new_health_check(fs.PingBuckets),
+		},
+	}
+	if actl.HasDatabase() {
+		hh.checks["auth"] = new_health_check(actl.Ping)
+	}
+	mux.Get("/healthz", hh.Healthz)
+	mux.Get("/readyz", hh.Readyz)
+
+	// public links are served without authentication
+	mux.Handle(LinkPrefix + ":token", lh)
+	mux.Handle(LinkPrefix + ":token/*", lh)
+
+	amux := web.New()
+	amux.Use(middleware.SubRouter)
+	if len(conf.JWT.Issuers) != 0 {
+		ja, err := auth.NewJWTAuth(&conf.JWT, actl)
+		if err != nil {
+			log.Fatalf("Could not create jwt authenticator: %v", err)
+		}
+
+		ja.Provision = provision_root(fs)
+
+		amux.Use(ja.Auth)
+	}
+	amux.Use(actl.BasicAuth)
+	mux.Handle("/*", amux)
+
+	if conf.MetricsAddr == "" {
+		mmux := web.New()
+		mmux.Use(auth.RequireRole(auth.RoleAdmin))
+		mmux.Get("/metrics", metrics.Handler())
+		amux.Handle("/metrics", mmux)
+	}
 
 	if false {
 		wdh := &webdav.Handler {
@@ -109,12 +311,86 @@ func main() {
 			LockSystem: dbh.locks,
 			Logger: webdav_log,
 		}
-		mux.Handle(dbh.prefix + "/*", wdh)
+		amux.Handle(dbh.prefix + "/*", wdh)
 		http.ListenAndServe(conf.Addr, mux)
 	}
 
-	mux.Handle(dbh.prefix + "/*", dbh)
-	mux.Handle(dbh.prefix, dbh)
+	amux.Get("/api/links", lapi.List)
+	amux.Post("/api/links", lapi.Create)
+	amux.Delete("/api/links/:token", lapi.Delete)
+
+	var adm *admin_api
+	if actl.HasDatabase() {
+		amux.Get("/api/tokens", tapi.List)
+		amux.Post("/api/tokens", tapi.Create)
+		amux.Delete("/api/tokens/:id", tapi.Revoke)
+
+		adm = new_admin_api(actl, fs)
+
+		admux := web.New()
+		admux.Use(middleware.SubRouter)
+		admux.Use(auth.RequireRole(auth.RoleAdmin))
+		admux.Get("/users", adm.ListUsers)
+		admux.Post("/users", adm.CreateUser)
+		admux.Get("/users/:user", adm.GetUser)
+		admux.Put("/users/:user", adm.UpdateUser)
+		admux.Delete("/users/:user", adm.DeleteUser)
+		admux.Post("/users/:user/password", adm.SetPassword)
+		admux.Get("/users/:user/quota", adm.GetQuota)
+		admux.Put("/users/:user/quota", adm.SetQuota)
+		admux.Delete("/users/:user/quota", adm.DeleteQuota)
+		admux.Get("/usage/users", adm.UsageByUser)
+		admux.Get("/usage/buckets", adm.UsageByBucket)
+		admux.Get("/jobs", adm.ListJobs)
+		admux.Post("/jobs", adm.CreateJob)
+		admux.Get("/jobs/:id", adm.GetJob)
+		amux.Handle("/admin/api/*", admux)
+	}
+
+	amux.Handle(dbh.prefix + "/*", dbh)
+	amux.Handle(dbh.prefix, dbh)
+
+	handlers := &inflight{}
+	server := &http.Server {
+		Addr: conf.Addr,
+		Handler: handlers.handler(mux),
+	}
+
+	if conf.TLS != nil {
+		server.TLSConfig, err = NewTLSConfig(conf.TLS)
+		if err != nil {
+			log.Fatalf("Could not set up tls: %v", err)
+		}
+	}
+
+	stopped := handle_shutdown(server, handlers, adm, rl.shutdown_timeout)
+
+	if conf.TLS != nil {
+		// certificate is provided by the config
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatalf("Could not serve on %s: %v", conf.Addr, err)
+	}
+
+	if <-stopped {
+		// nothing uses database and elliptics anymore, all writes have updated their entries
+		actl.Close()
+		fs.Close()
+	} else {
+		// freeing elliptics node under running transfer would crash, process exit releases everything
+		glog.Errorf("shutdown: requests or admin jobs are still running, database and elliptics resources are not released")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rl.shutdown_timeout())
+	err = stop_tracing(ctx)
+	cancel()
+	if err != nil {
+		glog.Errorf("could not flush traces: %v", err)
+	}
 
-	http.ListenAndServe(conf.Addr, mux)
+	glog.Infof("server has been stopped")
+	glog.Flush()
 }
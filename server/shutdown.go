@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// inflight tracks handlers which are running, http.Server.Close closes connections,
+// but does not wait for the handlers which still may use database and elliptics
+type inflight struct {
+	wg			sync.WaitGroup
+}
+
+func (in *inflight) handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		in.wg.Add(1)
+		defer in.wg.Done()
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// wait_timeout blocks until @wg is done or @timeout has passed
+func wait_timeout(wg *sync.WaitGroup, timeout time.Duration) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+}
+
+// handle_shutdown gracefully stops @server on SIGTERM or SIGINT: listeners are closed at once,
+// in-flight requests get @timeout() to complete, remaining connections are closed after that
+// and their handlers get another @timeout() to notice it, admin jobs get their own @timeout().
+// Returned channel receives true when the server has been stopped and nothing uses database and elliptics anymore,
+// false means that some handlers or jobs are still running and resources must not be released.
+func handle_shutdown(server *http.Server, handlers *inflight, adm *admin_api, timeout func() time.Duration) <-chan bool {
+	stopped := make(chan bool, 1)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+
+	go func() {
+		s := <-sig
+		signal.Stop(sig)
+
+		drain := timeout()
+		glog.Infof("shutdown: received %v, draining connections, timeout: %s", s, drain)
+
+		ctx, cancel := context.WithTimeout(context.Background(), drain)
+		err := server.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			glog.Errorf("shutdown: could not drain connections: %v, closing them", err)
+			server.Close()
+		}
+
+		clean := true
+
+		// contexts of the requests are cancelled when connections are closed, uploads stop between the chunks
+		err = wait_timeout(&handlers.wg, drain)
+		if err != nil {
+			glog.Errorf("shutdown: handlers have not completed: %v", err)
+			clean = false
+		}
+
+		if adm != nil {
+			err = adm.stop(drain)
+			if err != nil {
+				glog.Errorf("shutdown: admin jobs have not completed: %v, restart them after the server is up", err)
+				clean = false
+			}
+		}
+
+		if clean {
+			glog.Infof("shutdown: all connections have been closed")
+		}
+		stopped <- clean
+	}()
+
+	return stopped
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestInflight(t *testing.T) {
+	in := &inflight{}
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	h := in.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+
+	go h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	<-started
+
+	if err := wait_timeout(&in.wg, 10 * time.Millisecond); err == nil {
+		t.Fatalf("wait has completed while the handler is running")
+	}
+
+	close(release)
+	if err := wait_timeout(&in.wg, time.Second); err != nil {
+		t.Fatalf("wait has not completed after the handler has returned: %v", err)
+	}
+}
+
+func TestAdminStop(t *testing.T) {
+	tests := []struct {
+		name		string
+		job		func(ctx context.Context, release chan struct{}) (string, error)
+		ok		bool
+	} {
+		{
+			"completes",
+			func(ctx context.Context, release chan struct{}) (string, error) { return "done", nil },
+			true,
+		},
+		{
+			"cancelled",
+			func(ctx context.Context, release chan struct{}) (string, error) {
+				<-ctx.Done()
+				return "", ctx.Err()
+			},
+			true,
+		},
+		{
+			"ignores cancellation",
+			func(ctx context.Context, release chan struct{}) (string, error) {
+				<-release
+				return "done", nil
+			},
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		api := new_admin_api(nil, nil)
+		release := make(chan struct{})
+
+		api.start_job("test", "", func(ctx context.Context) (string, error) {
+			return test.job(ctx, release)
+		})
+
+		err := api.stop(20 * time.Millisecond)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: stop: error: %v, want success: %v", test.name, err, test.ok)
+		}
+
+		close(release)
+		api.running.Wait()
+	}
+}
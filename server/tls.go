@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/golang/glog"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type TLSCtl struct {
+	Cert			string			`json:"cert"`
+	Key			string			`json:"key"`
+	// minimal protocol version: 1.0, 1.1, 1.2 or 1.3, default is 1.2
+	MinVersion		string			`json:"min_version"`
+	// cipher policy: 'modern', 'intermediate' or list of cipher suite names separated by comma,
+	// TLS 1.3 suites are not configurable, default is intermediate
+	Ciphers			string			`json:"ciphers"`
+	// PEM file with certificate authorities of the client certificates
+	ClientCA		string			`json:"client_ca"`
+	// client certificate policy: 'none', 'request', 'verify' (verify if present) or 'require', default is 'none',
+	// or 'require' if client_ca is set
+	ClientAuth		string			`json:"client_auth"`
+	// certificate files are checked for changes every this number of seconds, default is 60,
+	// certificates are also reloaded on SIGHUP, negative value disables periodic checks
+	ReloadInterval		int			`json:"reload_interval"`
+}
+
+const DefaultTLSReloadInterval = 60
+
+var tls_versions = map[string]uint16 {
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tls_client_auth = map[string]tls.ClientAuthType {
+	"none": tls.NoClientCert,
+	"request": tls.RequestClientCert,
+	"verify": tls.VerifyClientCertIfGiven,
+	"require": tls.RequireAndVerifyClientCert,
+}
+
+// ECDHE suites with AEAD ciphers, forward secrecy only
+var tls_modern_ciphers = []uint16 {
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// modern suites plus CBC ones for older clients
+var tls_intermediate_ciphers = append(append([]uint16 {}, tls_modern_ciphers...),
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+)
+
+func tls_ciphers(policy string) ([]uint16, error) {
+	switch policy {
+	case "", "intermediate":
+		return tls_intermediate_ciphers, nil
+	case "modern":
+		return tls_modern_ciphers, nil
+	}
+
+	suites := make(map[string]uint16)
+	for _, s := range tls.CipherSuites() {
+		suites[s.Name] = s.ID
+	}
+
+	ret := make([]uint16, 0)
+	for _, name := range strings.Split(policy, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		id, ok := suites[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite '%s'", name)
+		}
+
+		ret = append(ret, id)
+	}
+
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("empty cipher suite list")
+	}
+
+	return ret, nil
+}
+
+// cert_reloader serves certificate loaded from files and replaces it when files change,
+// new certificate is only used for new handshakes, established connections are not affected
+type cert_reloader struct {
+	cert_path		string
+	key_path		string
+
+	sync.RWMutex
+	cert			*tls.Certificate
+	cert_mtime		time.Time
+	key_mtime		time.Time
+}
+
+func mtime(path string) (time.Time, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return st.ModTime(), nil
+}
+
+// load reads certificate if files have changed since the last load or @force is set,
+// old certificate is kept if new one can not be loaded
+func (cr *cert_reloader) load(force bool) error {
+	cert_mtime, err := mtime(cr.cert_path)
+	if err != nil {
+		return fmt.Errorf("could not stat certificate: %v", err)
+	}
+	key_mtime, err := mtime(cr.key_path)
+	if err != nil {
+		return fmt.Errorf("could not stat key: %v", err)
+	}
+
+	cr.RLock()
+	changed := !cert_mtime.Equal(cr.cert_mtime) || !key_mtime.Equal(cr.key_mtime)
+	cr.RUnlock()
+
+	if !changed && !force {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.cert_path, cr.key_path)
+	if err != nil {
+		return fmt.Errorf("could not load certificate: %s, key: %s: %v", cr.cert_path, cr.key_path, err)
+	}
+
+	cr.Lock()
+	cr.cert = &cert
+	cr.cert_mtime = cert_mtime
+	cr.key_mtime = key_mtime
+	cr.Unlock()
+
+	glog.Infof("tls: certificate: %s, key: %s: certificate has been loaded", cr.cert_path, cr.key_path)
+	return nil
+}
+
+func (cr *cert_reloader) get_certificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.RLock()
+	defer cr.RUnlock()
+
+	return cr.cert, nil
+}
+
+func (cr *cert_reloader) watch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.NewTicker(interval).C
+	}
+
+	for {
+		force := false
+		select {
+		case <-hup:
+			force = true
+		case <-tick:
+		}
+
+		err := cr.load(force)
+		if err != nil {
+			glog.Errorf("tls: %v, old certificate is still used", err)
+		}
+	}
+}
+
+// NewTLSConfig creates server TLS config which reloads certificate when its files change or SIGHUP is received
+func NewTLSConfig(conf *TLSCtl) (*tls.Config, error) {
+	if conf.Cert == "" || conf.Key == "" {
+		return nil, fmt.Errorf("tls: certificate and key must be set")
+	}
+
+	cr := &cert_reloader {
+		cert_path: conf.Cert,
+		key_path: conf.Key,
+	}
+	err := cr.load(true)
+	if err != nil {
+		return nil, fmt.Errorf("tls: %v", err)
+	}
+
+	min_version := conf.MinVersion
+	if min_version == "" {
+		min_version = "1.2"
+	}
+	version, ok := tls_versions[min_version]
+	if !ok {
+		return nil, fmt.Errorf("tls: invalid min_version '%s'", conf.MinVersion)
+	}
+
+	ciphers, err := tls_ciphers(conf.Ciphers)
+	if err != nil {
+		return nil, fmt.Errorf("tls: ciphers: %v", err)
+	}
+
+	tc := &tls.Config {
+		MinVersion: version,
+		CipherSuites: ciphers,
+		GetCertificate: cr.get_certificate,
+		NextProtos: []string { "h2", "http/1.1" },
+	}
+
+	client_auth := conf.ClientAuth
+	if client_auth == "" {
+		client_auth = "none"
+		if conf.ClientCA != "" {
+			client_auth = "require"
+		}
+	}
+	tc.ClientAuth, ok = tls_client_auth[client_auth]
+	if !ok {
+		return nil, fmt.Errorf("tls: invalid client_auth '%s'", conf.ClientAuth)
+	}
+
+	if conf.ClientCA != "" {
+		pem, err := ioutil.ReadFile(conf.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("tls: could not read client ca: %v", err)
+		}
+
+		tc.ClientCAs = x509.NewCertPool()
+		if !tc.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls: client ca %s does not contain any certificate", conf.ClientCA)
+		}
+	} else if tc.ClientAuth == tls.VerifyClientCertIfGiven || tc.ClientAuth == tls.RequireAndVerifyClientCert {
+		return nil, fmt.Errorf("tls: client_auth '%s' requires client_ca", client_auth)
+	}
+
+	interval := time.Duration(DefaultTLSReloadInterval) * time.Second
+	if conf.ReloadInterval > 0 {
+		interval = time.Duration(conf.ReloadInterval) * time.Second
+	} else if conf.ReloadInterval < 0 {
+		interval = 0
+	}
+	go cr.watch(interval)
+
+	return tc, nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// write_cert writes self-signed certificate and its key into @dir and returns their paths
+func write_cert(t *testing.T, dir, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+
+	tmpl := &x509.Certificate {
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject: pkix.Name { CommonName: name },
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		IsCA: true,
+		BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("could not create certificate: %v", err)
+	}
+
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("could not marshal key: %v", err)
+	}
+
+	cert_path := filepath.Join(dir, name + ".crt")
+	key_path := filepath.Join(dir, name + ".key")
+
+	err = ioutil.WriteFile(cert_path, pem.EncodeToMemory(&pem.Block { Type: "CERTIFICATE", Bytes: der }), 0600)
+	if err != nil {
+		t.Fatalf("could not write certificate: %v", err)
+	}
+	err = ioutil.WriteFile(key_path, pem.EncodeToMemory(&pem.Block { Type: "EC PRIVATE KEY", Bytes: kder }), 0600)
+	if err != nil {
+		t.Fatalf("could not write key: %v", err)
+	}
+
+	return cert_path, key_path
+}
+
+func TestTLSCiphers(t *testing.T) {
+	tests := []struct {
+		policy		string
+		want		[]uint16
+		fail		bool
+	} {
+		{ "", tls_intermediate_ciphers, false },
+		{ "intermediate", tls_intermediate_ciphers, false },
+		{ "modern", tls_modern_ciphers, false },
+		{ "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", []uint16 { tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 }, false },
+		{
+			" TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, ,TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 ",
+			[]uint16 { tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 },
+			false,
+		},
+		// insecure suites are not accepted even if they are listed explicitly
+		{ "TLS_RSA_WITH_RC4_128_SHA", nil, true },
+		{ "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,NO_SUCH_SUITE", nil, true },
+		{ "Modern", nil, true },
+		{ ",", nil, true },
+	}
+
+	for _, test := range tests {
+		got, err := tls_ciphers(test.policy)
+		if (err != nil) != test.fail {
+			t.Errorf("tls_ciphers(%q): error: %v, want failure: %v", test.policy, err, test.fail)
+			continue
+		}
+
+		if len(got) != len(test.want) {
+			t.Errorf("tls_ciphers(%q) = %v, want %v", test.policy, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("tls_ciphers(%q) = %v, want %v", test.policy, got, test.want)
+				break
+			}
+		}
+	}
+
+	for _, id := range tls_modern_ciphers {
+		for _, s := range tls.InsecureCipherSuites() {
+			if s.ID == id {
+				t.Errorf("modern policy contains insecure suite %s", s.Name)
+			}
+		}
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := write_cert(t, dir, "server")
+	ca, _ := write_cert(t, dir, "ca")
+
+	invalid_ca := filepath.Join(dir, "invalid.pem")
+	err := ioutil.WriteFile(invalid_ca, []byte("not a certificate"), 0600)
+	if err != nil {
+		t.Fatalf("could not write invalid ca: %v", err)
+	}
+
+	tests := []struct {
+		name		string
+		conf		TLSCtl
+		fail		bool
+		version		uint16
+		client_auth	tls.ClientAuthType
+	} {
+		{ "defaults", TLSCtl { Cert: cert, Key: key }, false, tls.VersionTLS12, tls.NoClientCert },
+		{ "tls 1.3", TLSCtl { Cert: cert, Key: key, MinVersion: "1.3" }, false, tls.VersionTLS13, tls.NoClientCert },
+		{ "client ca", TLSCtl { Cert: cert, Key: key, ClientCA: ca }, false, tls.VersionTLS12, tls.RequireAndVerifyClientCert },
+		{ "verify", TLSCtl { Cert: cert, Key: key, ClientCA: ca, ClientAuth: "verify" }, false, tls.VersionTLS12, tls.VerifyClientCertIfGiven },
+		{ "request", TLSCtl { Cert: cert, Key: key, ClientAuth: "request" }, false, tls.VersionTLS12, tls.RequestClientCert },
+		{ "no certificate", TLSCtl { Key: key }, true, 0, 0 },
+		{ "no key", TLSCtl { Cert: cert }, true, 0, 0 },
+		{ "missing files", TLSCtl { Cert: cert + ".missing", Key: key }, true, 0, 0 },
+		{ "mismatched key", TLSCtl { Cert: ca, Key: key }, true, 0, 0 },
+		{ "invalid version", TLSCtl { Cert: cert, Key: key, MinVersion: "1.4" }, true, 0, 0 },
+		{ "invalid ciphers", TLSCtl { Cert: cert, Key: key, Ciphers: "none" }, true, 0, 0 },
+		{ "invalid client auth", TLSCtl { Cert: cert, Key: key, ClientAuth: "always" }, true, 0, 0 },
+		{ "require without ca", TLSCtl { Cert: cert, Key: key, ClientAuth: "require" }, true, 0, 0 },
+		{ "verify without ca", TLSCtl { Cert: cert, Key: key, ClientAuth: "verify" }, true, 0, 0 },
+		{ "missing ca", TLSCtl { Cert: cert, Key: key, ClientCA: ca + ".missing" }, true, 0, 0 },
+		{ "invalid ca", TLSCtl { Cert: cert, Key: key, ClientCA: invalid_ca }, true, 0, 0 },
+	}
+
+	for _, test := range tests {
+		test.conf.ReloadInterval = -1
+
+		tc, err := NewTLSConfig(&test.conf)
+		if (err != nil) != test.fail {
+			t.Errorf("%s: error: %v, want failure: %v", test.name, err, test.fail)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		if tc.MinVersion != test.version || tc.ClientAuth != test.client_auth {
+			t.Errorf("%s: min version: %x, client auth: %v, want %x and %v",
+				test.name, tc.MinVersion, tc.ClientAuth, test.version, test.client_auth)
+		}
+
+		c, err := tc.GetCertificate(nil)
+		if err != nil || c == nil {
+			t.Errorf("%s: no certificate: %v", test.name, err)
+		}
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := write_cert(t, dir, "server")
+
+	cr := &cert_reloader {
+		cert_path: cert,
+		key_path: key,
+	}
+	err := cr.load(true)
+	if err != nil {
+		t.Fatalf("could not load certificate: %v", err)
+	}
+	first, _ := cr.get_certificate(nil)
+
+	// files have not changed
+	err = cr.load(false)
+	if err != nil {
+		t.Fatalf("could not reload certificate: %v", err)
+	}
+	if c, _ := cr.get_certificate(nil); c != first {
+		t.Errorf("certificate has been reloaded while files have not changed")
+	}
+
+	// broken certificate is not loaded, the old one is kept
+	err = ioutil.WriteFile(cert, []byte("broken"), 0600)
+	if err != nil {
+		t.Fatalf("could not overwrite certificate: %v", err)
+	}
+	err = cr.load(true)
+	if err == nil {
+		t.Errorf("broken certificate has been loaded")
+	}
+	if c, _ := cr.get_certificate(nil); c != first {
+		t.Errorf("old certificate has been dropped after failed reload")
+	}
+
+	write_cert(t, dir, "server")
+	err = cr.load(true)
+	if err != nil {
+		t.Fatalf("could not load new certificate: %v", err)
+	}
+	if c, _ := cr.get_certificate(nil); c == first {
+		t.Errorf("new certificate has not been loaded")
+	}
+}
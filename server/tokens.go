@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bioothod/wd2/middleware/auth"
+	"github.com/golang/glog"
+	"github.com/zenazn/goji/web"
+	"net/http"
+)
+
+// tokens_api manages application passwords and api tokens of the authenticated user,
+// it is only available when authenticated with the primary password, tokens can not create or revoke tokens
+type tokens_api struct {
+	actl *auth.AuthCtl
+}
+
+type token_request struct {
+	Name			string			`json:"name"`
+	Kind			string			`json:"kind"`
+	Scope			string			`json:"scope"`
+}
+
+func (api *tokens_api) check(c web.C, w http.ResponseWriter) bool {
+	if auth.GetAuthToken(c) != "" {
+		write_error(w, http.StatusForbidden, "tokens can only be managed with the account password")
+		return false
+	}
+
+	return true
+}
+
+func (api *tokens_api) List(c web.C, w http.ResponseWriter, r *http.Request) {
+	username := auth.GetAuthUsername(c)
+	if !api.check(c, w) {
+		return
+	}
+
+	tokens, err := api.actl.ListTokens(username)
+	if err != nil {
+		glog.Errorf("tokens: username: %s: %v", username, err)
+		write_error(w, http.StatusInternalServerError, "could not list tokens")
+		return
+	}
+
+	write_json(w, http.StatusOK, tokens)
+}
+
+func (api *tokens_api) Create(c web.C, w http.ResponseWriter, r *http.Request) {
+	username := auth.GetAuthUsername(c)
+	if !api.check(c, w) {
+		return
+	}
+
+	var req token_request
+	err := read_json(r, &req)
+	if err != nil {
+		write_error(w, http.StatusBadRequest, fmt.Sprintf("could not parse request: %v", err))
+		return
+	}
+
+	if req.Kind == "" {
+		req.Kind = auth.TokenAppPassword
+	}
+	if req.Kind != auth.TokenAppPassword && req.Kind != auth.TokenAPI {
+		write_error(w, http.StatusBadRequest, fmt.Sprintf("invalid kind '%s'", req.Kind))
+		return
+	}
+	if req.Scope == "" {
+		req.Scope = auth.ScopeReadWrite
+	}
+	if req.Scope != auth.ScopeRead && req.Scope != auth.ScopeReadWrite {
+		write_error(w, http.StatusBadRequest, fmt.Sprintf("invalid scope '%s'", req.Scope))
+		return
+	}
+
+	// read-only users can not get more than read access through the token
+	if !auth.CanWrite(c) {
+		req.Scope = auth.ScopeRead
+	}
+
+	t := &auth.Token {
+		Username: username,
+		Name: req.Name,
+		Kind: req.Kind,
+		Scope: req.Scope,
+	}
+
+	err = api.actl.NewToken(t)
+	if err != nil {
+		glog.Errorf("tokens: username: %s: %v", username, err)
+		write_error(w, http.StatusInternalServerError, "could not create token")
+		return
+	}
+
+	glog.Infof("tokens: username: %s: created token: %s", username, t.String())
+	write_json(w, http.StatusCreated, t)
+}
+
+func (api *tokens_api) Revoke(c web.C, w http.ResponseWriter, r *http.Request) {
+	username := auth.GetAuthUsername(c)
+	id := c.URLParams["id"]
+	if !api.check(c, w) {
+		return
+	}
+
+	err := api.actl.RevokeToken(username, id)
+	if err != nil {
+		if err == auth.ErrTokenNotFound {
+			write_error(w, http.StatusNotFound, "token not found")
+			return
+		}
+
+		glog.Errorf("tokens: username: %s, id: %s: %v", username, id, err)
+		write_error(w, http.StatusInternalServerError, "could not revoke token")
+		return
+	}
+
+	glog.Infof("tokens: username: %s: revoked token %s", username, id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -7,7 +7,46 @@ CREATE TABLE `users` (
     `username` VARCHAR(128) NOT NULL,
     `password` VARCHAR(64) NOT NULL,
     `created` DATETIME NULL DEFAULT NULL,
+    `role` VARCHAR(16) NOT NULL DEFAULT 'user',
+    `disabled` TINYINT(1) NOT NULL DEFAULT 0,
     PRIMARY KEY (`username`),
     UNIQUE (`username`)
 ) ENGINE=InnoDB DEFAULT CHARSET=UTF8;
 
+CREATE TABLE `user_groups` (
+    `name` VARCHAR(128) NOT NULL,
+    `created` DATETIME NULL DEFAULT NULL,
+    PRIMARY KEY (`name`)
+) ENGINE=InnoDB DEFAULT CHARSET=UTF8;
+
+CREATE TABLE `group_members` (
+    `groupname` VARCHAR(128) NOT NULL,
+    `username` VARCHAR(128) NOT NULL,
+    PRIMARY KEY (`groupname`, `username`),
+    INDEX (`username`)
+) ENGINE=InnoDB DEFAULT CHARSET=UTF8;
+
+
+CREATE TABLE `tokens` (
+    `id` VARCHAR(16) NOT NULL,
+    `username` VARCHAR(128) NOT NULL,
+    `name` VARCHAR(128) NOT NULL DEFAULT '',
+    `kind` VARCHAR(16) NOT NULL,
+    `scope` VARCHAR(16) NOT NULL,
+    `hash` CHAR(64) NOT NULL,
+    `created` DATETIME NULL DEFAULT NULL,
+    `last_used` DATETIME NULL DEFAULT NULL,
+    `revoked` TINYINT(1) NOT NULL DEFAULT 0,
+    PRIMARY KEY (`id`),
+    UNIQUE (`hash`),
+    INDEX (`username`)
+) ENGINE=InnoDB DEFAULT CHARSET=UTF8;
+
+CREATE TABLE `lockouts` (
+    `kind` VARCHAR(8) NOT NULL,
+    `name` VARCHAR(128) NOT NULL,
+    `failures` INT NOT NULL DEFAULT 0,
+    `locked_until` DATETIME NOT NULL,
+    `updated` DATETIME NOT NULL,
+    PRIMARY KEY (`kind`, `name`)
+) ENGINE=InnoDB DEFAULT CHARSET=UTF8;
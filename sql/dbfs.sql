@@ -8,6 +8,7 @@ USE `wd2.data`;
 CREATE TABLE `dirs` (
     `username` VARCHAR(128) NOT NULL,
     `filename` VARCHAR(4096) NOT NULL,
+    `name` VARCHAR(255) NOT NULL,
     `parent` VARCHAR(512) NOT NULL,
     `bucket` VARCHAR(64) NOT NULL,
     `rkey` VARCHAR(256) NOT NULL,
@@ -15,6 +16,41 @@ CREATE TABLE `dirs` (
     `size` BIGINT NOT NULL,
     `created` DATETIME NULL DEFAULT NULL,
     `modified` DATETIME NULL DEFAULT NULL,
+    `target` VARCHAR(4096) NOT NULL DEFAULT '',
     INDEX name (`username`(128), `filename`(512), `parent`(256), `bucket`),
+    INDEX children (`username`(128), `parent`(256), `name`),
     INDEX (`rkey`)
 ) ENGINE=InnoDB DEFAULT CHARSET=UTF8 ROW_FORMAT=COMPRESSED;
+
+CREATE TABLE `shares` (
+    `owner` VARCHAR(128) NOT NULL,
+    `path` VARCHAR(4096) NOT NULL,
+    `name` VARCHAR(255) NOT NULL,
+    `grantee` VARCHAR(128) NOT NULL,
+    `grantee_type` VARCHAR(16) NOT NULL,
+    `access` VARCHAR(16) NOT NULL,
+    `created` DATETIME NULL DEFAULT NULL,
+    PRIMARY KEY (`owner`, `name`, `grantee`, `grantee_type`),
+    INDEX grantee (`grantee`, `grantee_type`)
+) ENGINE=InnoDB DEFAULT CHARSET=UTF8 ROW_FORMAT=COMPRESSED;
+
+CREATE TABLE `links` (
+    `token` VARCHAR(64) NOT NULL,
+    `owner` VARCHAR(128) NOT NULL,
+    `path` VARCHAR(4096) NOT NULL,
+    `mode` VARCHAR(16) NOT NULL,
+    `password` VARCHAR(128) NOT NULL,
+    `expires` DATETIME NULL DEFAULT NULL,
+    `max_downloads` BIGINT NOT NULL,
+    `downloads` BIGINT NOT NULL,
+    `created` DATETIME NULL DEFAULT NULL,
+    PRIMARY KEY (`token`),
+    INDEX (`owner`)
+) ENGINE=InnoDB DEFAULT CHARSET=UTF8;
+
+CREATE TABLE `quotas` (
+    `username` VARCHAR(128) NOT NULL,
+    `max_bytes` BIGINT UNSIGNED NOT NULL DEFAULT 0,
+    `max_files` BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (`username`)
+) ENGINE=InnoDB DEFAULT CHARSET=UTF8;
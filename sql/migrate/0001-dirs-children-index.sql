@@ -0,0 +1,4 @@
+USE `wd2.data`;
+
+-- directory listing uses keyset pagination: username=? AND parent=? AND filename > ? ORDER BY filename
+ALTER TABLE `dirs` ADD INDEX children (`username`(128), `parent`(256), `filename`(512));
@@ -0,0 +1,11 @@
+USE `wd2.data`;
+
+-- children are looked up by parent key and their own name, filename prefix matching is not used anymore
+ALTER TABLE `dirs` ADD COLUMN `name` VARCHAR(255) NOT NULL DEFAULT '' AFTER `filename`;
+
+-- root directory has neither name nor parent, otherwise it would be listed among its own children
+UPDATE `dirs` SET `name`='', `parent`='' WHERE `filename`='/';
+UPDATE `dirs` SET `name`=SUBSTRING_INDEX(`filename`, '/', -1) WHERE `filename`<>'/';
+
+ALTER TABLE `dirs` ALTER COLUMN `name` DROP DEFAULT;
+ALTER TABLE `dirs` DROP INDEX children, ADD INDEX children (`username`(128), `parent`(256), `name`);
@@ -0,0 +1,4 @@
+USE `wd2.data`;
+
+-- symbolic links have os.ModeSymlink in `mode` and their destination path in `target`
+ALTER TABLE `dirs` ADD COLUMN `target` VARCHAR(4096) NOT NULL DEFAULT '' AFTER `modified`;
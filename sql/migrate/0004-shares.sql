@@ -0,0 +1,14 @@
+USE `wd2.data`;
+
+-- folders shared with other users or groups, grantees see them as /Shared/<owner>/<name>
+CREATE TABLE `shares` (
+    `owner` VARCHAR(128) NOT NULL,
+    `path` VARCHAR(4096) NOT NULL,
+    `name` VARCHAR(255) NOT NULL,
+    `grantee` VARCHAR(128) NOT NULL,
+    `grantee_type` VARCHAR(16) NOT NULL,
+    `access` VARCHAR(16) NOT NULL,
+    `created` DATETIME NULL DEFAULT NULL,
+    PRIMARY KEY (`owner`, `name`, `grantee`, `grantee_type`),
+    INDEX grantee (`grantee`, `grantee_type`)
+) ENGINE=InnoDB DEFAULT CHARSET=UTF8 ROW_FORMAT=COMPRESSED;
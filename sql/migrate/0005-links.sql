@@ -0,0 +1,16 @@
+USE `wd2.data`;
+
+-- public share links served without authentication at /s/<token>
+CREATE TABLE `links` (
+    `token` VARCHAR(64) NOT NULL,
+    `owner` VARCHAR(128) NOT NULL,
+    `path` VARCHAR(4096) NOT NULL,
+    `mode` VARCHAR(16) NOT NULL,
+    `password` VARCHAR(128) NOT NULL,
+    `expires` DATETIME NULL DEFAULT NULL,
+    `max_downloads` BIGINT NOT NULL,
+    `downloads` BIGINT NOT NULL,
+    `created` DATETIME NULL DEFAULT NULL,
+    PRIMARY KEY (`token`),
+    INDEX (`owner`)
+) ENGINE=InnoDB DEFAULT CHARSET=UTF8;
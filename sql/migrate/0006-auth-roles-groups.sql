@@ -0,0 +1,16 @@
+USE `wd2.auth`;
+
+ALTER TABLE `users` ADD COLUMN `role` VARCHAR(16) NOT NULL DEFAULT 'user';
+
+CREATE TABLE `user_groups` (
+    `name` VARCHAR(128) NOT NULL,
+    `created` DATETIME NULL DEFAULT NULL,
+    PRIMARY KEY (`name`)
+) ENGINE=InnoDB DEFAULT CHARSET=UTF8;
+
+CREATE TABLE `group_members` (
+    `groupname` VARCHAR(128) NOT NULL,
+    `username` VARCHAR(128) NOT NULL,
+    PRIMARY KEY (`groupname`, `username`),
+    INDEX (`username`)
+) ENGINE=InnoDB DEFAULT CHARSET=UTF8;
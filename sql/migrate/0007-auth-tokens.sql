@@ -0,0 +1,16 @@
+USE `wd2.auth`;
+
+CREATE TABLE `tokens` (
+    `id` VARCHAR(16) NOT NULL,
+    `username` VARCHAR(128) NOT NULL,
+    `name` VARCHAR(128) NOT NULL DEFAULT '',
+    `kind` VARCHAR(16) NOT NULL,
+    `scope` VARCHAR(16) NOT NULL,
+    `hash` CHAR(64) NOT NULL,
+    `created` DATETIME NULL DEFAULT NULL,
+    `last_used` DATETIME NULL DEFAULT NULL,
+    `revoked` TINYINT(1) NOT NULL DEFAULT 0,
+    PRIMARY KEY (`id`),
+    UNIQUE (`hash`),
+    INDEX (`username`)
+) ENGINE=InnoDB DEFAULT CHARSET=UTF8;
@@ -0,0 +1,10 @@
+USE `wd2.auth`;
+
+CREATE TABLE `lockouts` (
+    `kind` VARCHAR(8) NOT NULL,
+    `name` VARCHAR(128) NOT NULL,
+    `failures` INT NOT NULL DEFAULT 0,
+    `locked_until` DATETIME NOT NULL,
+    `updated` DATETIME NOT NULL,
+    PRIMARY KEY (`kind`, `name`)
+) ENGINE=InnoDB DEFAULT CHARSET=UTF8;
@@ -0,0 +1,3 @@
+USE `wd2.auth`;
+
+ALTER TABLE `users` ADD COLUMN `disabled` TINYINT(1) NOT NULL DEFAULT 0;
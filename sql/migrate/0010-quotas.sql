@@ -0,0 +1,8 @@
+USE `wd2.data`;
+
+CREATE TABLE `quotas` (
+    `username` VARCHAR(128) NOT NULL,
+    `max_bytes` BIGINT UNSIGNED NOT NULL DEFAULT 0,
+    `max_files` BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (`username`)
+) ENGINE=InnoDB DEFAULT CHARSET=UTF8;
@@ -0,0 +1,121 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"net/http"
+)
+
+const (
+	TracerName = "github.com/bioothod/wd2"
+	DefaultServiceName = "wd2"
+
+	ExporterOTLP = "otlp"
+	// spans are printed to stdout, used for local testing
+	ExporterStdout = "stdout"
+)
+
+type TracingCtl struct {
+	// 'otlp', 'stdout' or empty string which disables tracing
+	Exporter		string			`json:"exporter"`
+	// host:port of the OTLP/HTTP collector, default is localhost:4318
+	Endpoint		string			`json:"endpoint"`
+	// use plain HTTP to talk to the collector
+	Insecure		bool			`json:"insecure"`
+	// fraction of the new traces which are sampled, 0 means all,
+	// traces started by the client are sampled according to its decision
+	SampleRatio		float64			`json:"sample_ratio"`
+	ServiceName		string			`json:"service_name"`
+}
+
+func new_exporter(conf *TracingCtl) (sdktrace.SpanExporter, error) {
+	switch conf.Exporter {
+	case ExporterOTLP:
+		opts := make([]otlptracehttp.Option, 0)
+		if conf.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(conf.Endpoint))
+		}
+		if conf.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+
+		return otlptracehttp.New(context.Background(), opts...)
+	case ExporterStdout:
+		return stdouttrace.New(stdouttrace.WithPrettyPrint())
+	}
+
+	return nil, fmt.Errorf("unknown exporter '%s'", conf.Exporter)
+}
+
+// Init sets up global tracer provider and propagator according to @conf,
+// returned function flushes spans which have not been exported yet and stops the provider
+func Init(conf *TracingCtl) (func(ctx context.Context) error, error) {
+	// trace context of the client is propagated even if the spans are not exported
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if conf.Exporter == "" {
+		return func(ctx context.Context) error { return nil }, nil
+	}
+
+	if conf.SampleRatio < 0 || conf.SampleRatio > 1 {
+		return nil, fmt.Errorf("tracing: sample ratio must be in [0, 1] range")
+	}
+	ratio := conf.SampleRatio
+	if ratio == 0 {
+		ratio = 1
+	}
+
+	exp, err := new_exporter(conf)
+	if err != nil {
+		return nil, fmt.Errorf("tracing: could not create exporter: %v", err)
+	}
+
+	service := conf.ServiceName
+	if service == "" {
+		service = DefaultServiceName
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", service))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(tp)
+
+	return tp.Shutdown, nil
+}
+
+// Start creates span which is a child of the span stored in @ctx if there is one,
+// tracer is looked up on every call, since global provider is only set up after packages are initialized
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	return otel.Tracer(TracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End marks span as failed if @err is set and ends it, end of file is not considered to be an error
+func End(span trace.Span, err error) {
+	if err != nil && err != io.EOF {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// Extract returns context which carries trace context sent by the client in the request headers
+func Extract(ctx context.Context, header http.Header) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(header))
+}
@@ -1,106 +1,570 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/bioothod/wd2/dbfs"
 	"github.com/bioothod/wd2/middleware/auth"
+	"io/ioutil"
 	"log"
 	"os"
+	"sort"
 )
 
-func main() {
-	auth_params := flag.String("auth", "", "mysql auth database parameters:\n" +
-		"	user@unix(/path/to/socket)/dbname?charset=utf8\n" +
-		"	user:password@tcp(localhost:5555)/dbname?charset=utf8\n" +
-		"	user:password@/dbname\n" +
-		"	user:password@tcp([de:ad:be:ef::ca:fe]:80)/dbname")
-	dbfs_params := flag.String("dbfs", "", "mysql dbfs data parameters:\n" +
-		"	user@unix(/path/to/socket)/dbname?charset=utf8\n" +
-		"	user:password@tcp(localhost:5555)/dbname?charset=utf8\n" +
-		"	user:password@/dbname\n" +
-		"	user:password@tcp([de:ad:be:ef::ca:fe]:80)/dbname")
-	new_user := flag.String("new", "", "create new user")
-	update_user := flag.String("update", "", "update user")
-	check_user := flag.String("check", "", "verify user/password")
-	pwd := flag.String("password", "", "password")
-	flag.Parse()
+// config contains the subset of the server config used by auth_ctl
+type config struct {
+	AuthParams		string				`json:"auth"`
+	DbFSParams		string				`json:"dbfs"`
+	Ebucket			*dbfs.EbucketCtl		`json:"ebucket"`
+}
 
-	if *new_user == "" && *update_user == "" && *check_user == "" {
-		log.Fatalf("You must provide username to create new user or update existing")
+type ctl struct {
+	conf			config
+	actl			*auth.AuthCtl
+	fs			*dbfs.DbFS
+}
+
+func (c *ctl) auth() *auth.AuthCtl {
+	if c.actl != nil {
+		return c.actl
 	}
-	if *new_user != "" && *dbfs_params == "" {
-		log.Fatalf("You must provide dbfs parameters when creating new user")
+
+	if c.conf.AuthParams == "" {
+		log.Fatalf("You must provide correct database parameters")
+	}
+
+	var err error
+	c.actl, err = auth.NewAuthCtl("mysql", c.conf.AuthParams)
+	if err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+
+	return c.actl
+}
+
+// dbfs opens data database, bucket processor is only created if @data is set, it is needed to remove data
+func (c *ctl) dbfs(data bool) *dbfs.DbFS {
+	if c.fs != nil {
+		return c.fs
+	}
+
+	if c.conf.DbFSParams == "" {
+		log.Fatalf("You must provide dbfs parameters")
+	}
+
+	var err error
+	if data {
+		if c.conf.Ebucket == nil {
+			log.Fatalf("You must provide config with ebucket parameters to remove data")
+		}
+
+		c.fs, err = dbfs.NewDbFS("mysql", c.conf.DbFSParams, c.conf.Ebucket, &dbfs.CacheCtl { Size: -1 })
+	} else {
+		c.fs, err = dbfs.NewDbFSWithoutBucket("mysql", c.conf.DbFSParams)
 	}
+	if err != nil {
+		log.Fatalf("Failed to initialize dbfs database: %v", err)
+	}
+
+	return c.fs
+}
+
+func (c *ctl) close() {
+	if c.actl != nil {
+		c.actl.Close()
+	}
+	if c.fs != nil {
+		c.fs.Close()
+	}
+}
+
+type command struct {
+	usage			string
+	// number of positional arguments
+	nargs			int
+	run			func(c *ctl, fset *flag.FlagSet)
+}
+
+func user_new(c *ctl, fset *flag.FlagSet) {
+	pwd := fset.String("password", "", "password")
+	role := fset.String("role", auth.RoleUser, "user role: " + auth.RoleAdmin + ", " + auth.RoleUser + " or " + auth.RoleReadOnly)
+	parse(fset)
+
 	if *pwd == "" {
 		log.Fatalf("You must provide password for the user")
 	}
-	if *auth_params == "" {
-		log.Fatalf("You must provide correct database parameters")
+
+	fs := c.dbfs(false)
+	actl := c.auth()
+
+	mbox := auth.Mailbox {
+		Username: fset.Arg(0),
+		Password: *pwd,
+		Role: *role,
 	}
 
-	actl, err := auth.NewAuthCtl("mysql", *auth_params)
+	err := actl.NewUser(&mbox)
 	if err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+		log.Fatalf("Failed to create new user '%s': %v", mbox.Username, err)
+	}
+
+	u := &dbfs.DbFSUser {
+		Username: mbox.Username,
+		FS: fs,
+	}
+	err = u.Mkdir(context.Background(), "/", 0755 | os.ModeDir)
+	if err != nil {
+		actl.DeleteUser(&mbox)
+
+		log.Fatalf("Failed to create / directory for new user '%s': %v", mbox.Username, err)
+	}
+
+	fmt.Printf("New user '%s' has been created\n", mbox.Username)
+}
+
+func user_update(c *ctl, fset *flag.FlagSet) {
+	pwd := fset.String("password", "", "new password")
+	role := fset.String("role", "", "new role: " + auth.RoleAdmin + ", " + auth.RoleUser + " or " + auth.RoleReadOnly)
+	parse(fset)
+
+	if *pwd == "" && *role == "" {
+		log.Fatalf("You must provide new password or role for the user")
+	}
+
+	actl := c.auth()
+	mbox := auth.Mailbox {
+		Username: fset.Arg(0),
+		Password: *pwd,
+		Role: *role,
 	}
-	defer actl.Close()
 
-	if *new_user != "" {
-		fs, err := dbfs.NewDbFSWithoutBucket("mysql", *dbfs_params)
+	if mbox.Password != "" {
+		err := actl.UpdateUser(&mbox)
 		if err != nil {
-			log.Fatalf("Failed to initialize dbfs database: %v", err)
+			log.Fatalf("Failed to update user '%s': %v", mbox.Username, err)
 		}
-		defer fs.Close()
+	}
 
-		mbox := auth.Mailbox {
-			Username: *new_user,
-			Password: *pwd,
+	if mbox.Role != "" {
+		err := actl.SetRole(&mbox)
+		if err != nil {
+			log.Fatalf("Failed to set role of user '%s': %v", mbox.Username, err)
 		}
+	}
+
+	fmt.Printf("User '%s' has been updated\n", mbox.Username)
+}
+
+func user_check(c *ctl, fset *flag.FlagSet) {
+	pwd := fset.String("password", "", "password")
+	parse(fset)
+
+	mbox := auth.Mailbox {
+		Username: fset.Arg(0),
+		Password: *pwd,
+	}
+
+	err := c.auth().GetUser(&mbox)
+	if err != nil {
+		log.Fatalf("Failed to verify user '%s': %v", mbox.Username, err)
+	}
+
+	fmt.Printf("User '%s' has been verified: username/password match, role: %s, groups: %v\n",
+		mbox.Username, mbox.Role, mbox.Groups)
+}
+
+func user_list(c *ctl, fset *flag.FlagSet) {
+	parse(fset)
 
-		err = actl.NewUser(&mbox)
+	users, err := c.auth().ListUsers()
+	if err != nil {
+		log.Fatalf("Failed to list users: %v", err)
+	}
+
+	for _, mbox := range users {
+		fmt.Printf("%s\n", mbox.String())
+	}
+}
+
+func user_info(c *ctl, fset *flag.FlagSet) {
+	parse(fset)
+
+	username := fset.Arg(0)
+	mbox, err := c.auth().UserInfo(username)
+	if err != nil {
+		log.Fatalf("Failed to read user '%s': %v", username, err)
+	}
+
+	usage, err := c.dbfs(false).Usage(context.Background(), username)
+	if err != nil {
+		log.Fatalf("Failed to read usage of user '%s': %v", username, err)
+	}
+
+	tokens, err := c.auth().ListTokens(username)
+	if err != nil {
+		log.Fatalf("Failed to list tokens of user '%s': %v", username, err)
+	}
+
+	active := 0
+	for _, t := range tokens {
+		if !t.Revoked {
+			active++
+		}
+	}
+
+	fmt.Printf("%s\n", mbox.String())
+	fmt.Printf("usage: %s\n", usage.String())
+	fmt.Printf("tokens: %d active, %d total\n", active, len(tokens))
+}
+
+func user_delete(c *ctl, fset *flag.FlagSet) {
+	keep := fset.Bool("keep-data", false, "only delete the account, keep user's files, shares and links")
+	parse(fset)
+
+	username := fset.Arg(0)
+	actl := c.auth()
+
+	mbox, err := actl.UserInfo(username)
+	if err != nil {
+		log.Fatalf("Failed to read user '%s': %v", username, err)
+	}
+
+	if !*keep {
+		// user must not be able to upload new files while the tree is being purged
+		err = actl.SetDisabled(username, true)
+		if err != nil {
+			log.Fatalf("Failed to disable user '%s': %v", username, err)
+		}
+
+		fs := c.dbfs(true)
+		err = fs.PurgeUser(context.Background(), username)
 		if err != nil {
-			log.Fatalf("Failed to create new user '%s': %v", mbox.Username, err)
+			log.Fatalf("Failed to purge data of user '%s', user has been disabled, restart delete to continue: %v",
+				username, err)
 		}
 
-		u := &dbfs.DbFSUser {
-			Username: mbox.Username,
-			FS: fs,
+		// new user with the same name must not inherit the quota
+		err = fs.DeleteQuota(context.Background(), username)
+		if err != nil {
+			log.Fatalf("Failed to delete quota of user '%s', data has been purged, restart delete to continue: %v",
+				username, err)
 		}
-		err = u.Mkdir("/", 0755 | os.ModeDir)
+	}
+
+	err = actl.DeleteUser(mbox)
+	if err != nil {
+		log.Fatalf("Failed to delete user '%s': %v", username, err)
+	}
+
+	fmt.Printf("User '%s' has been deleted\n", username)
+}
+
+func user_set_disabled(disabled bool) func(c *ctl, fset *flag.FlagSet) {
+	return func(c *ctl, fset *flag.FlagSet) {
+		parse(fset)
+
+		username := fset.Arg(0)
+		err := c.auth().SetDisabled(username, disabled)
 		if err != nil {
-			actl.DeleteUser(&mbox)
+			log.Fatalf("Failed to update user '%s': %v", username, err)
+		}
 
-			log.Fatalf("Failed to create / directory for new user '%s': %v", mbox.Username, err)
+		if disabled {
+			fmt.Printf("User '%s' has been disabled\n", username)
+		} else {
+			fmt.Printf("User '%s' has been enabled\n", username)
 		}
+	}
+}
+
+func user_rename(c *ctl, fset *flag.FlagSet) {
+	parse(fset)
 
-		fmt.Printf("New user '%s' has been created\n", mbox.Username)
+	username := fset.Arg(0)
+	new_username := fset.Arg(1)
+
+	fs := c.dbfs(false)
+	actl := c.auth()
+
+	_, err := actl.UserInfo(new_username)
+	if err == nil {
+		log.Fatalf("User '%s' already exists", new_username)
+	}
+
+	err = actl.RenameUser(username, new_username)
+	if err != nil {
+		log.Fatalf("Failed to rename user '%s': %v", username, err)
 	}
 
-	if *update_user != "" {
-		mbox := auth.Mailbox {
-			Username: *update_user,
-			Password: *pwd,
+	err = fs.RenameUser(context.Background(), username, new_username)
+	if err != nil {
+		rerr := actl.RenameUser(new_username, username)
+		if rerr != nil {
+			log.Fatalf("Failed to rename data of user '%s': %v, could not restore old username: %v", username, err, rerr)
 		}
 
-		err = actl.UpdateUser(&mbox)
+		log.Fatalf("Failed to rename data of user '%s': %v", username, err)
+	}
+
+	fmt.Printf("User '%s' has been renamed to '%s'\n", username, new_username)
+}
+
+func group_new(c *ctl, fset *flag.FlagSet) {
+	parse(fset)
+
+	err := c.auth().NewGroup(fset.Arg(0))
+	if err != nil {
+		log.Fatalf("Failed to create group '%s': %v", fset.Arg(0), err)
+	}
+
+	fmt.Printf("Group '%s' has been created\n", fset.Arg(0))
+}
+
+func group_delete(c *ctl, fset *flag.FlagSet) {
+	parse(fset)
+
+	err := c.auth().DeleteGroup(fset.Arg(0))
+	if err != nil {
+		log.Fatalf("Failed to delete group '%s': %v", fset.Arg(0), err)
+	}
+
+	fmt.Printf("Group '%s' has been deleted\n", fset.Arg(0))
+}
+
+func group_add(c *ctl, fset *flag.FlagSet) {
+	parse(fset)
+
+	err := c.auth().AddMember(fset.Arg(0), fset.Arg(1))
+	if err != nil {
+		log.Fatalf("Failed to add user '%s' to group '%s': %v", fset.Arg(1), fset.Arg(0), err)
+	}
+
+	fmt.Printf("User '%s' has been added to group '%s'\n", fset.Arg(1), fset.Arg(0))
+}
+
+func group_remove(c *ctl, fset *flag.FlagSet) {
+	parse(fset)
+
+	err := c.auth().RemoveMember(fset.Arg(0), fset.Arg(1))
+	if err != nil {
+		log.Fatalf("Failed to remove user '%s' from group '%s': %v", fset.Arg(1), fset.Arg(0), err)
+	}
+
+	fmt.Printf("User '%s' has been removed from group '%s'\n", fset.Arg(1), fset.Arg(0))
+}
+
+func group_list(c *ctl, fset *flag.FlagSet) {
+	parse(fset)
+
+	groups, err := c.auth().ListGroups()
+	if err != nil {
+		log.Fatalf("Failed to list groups: %v", err)
+	}
+
+	for _, g := range groups {
+		fmt.Printf("%s: %v\n", g.Name, g.Members)
+	}
+}
+
+func token_new(c *ctl, fset *flag.FlagSet) {
+	kind := fset.String("kind", auth.TokenAppPassword, "token kind: " + auth.TokenAppPassword + " or " + auth.TokenAPI)
+	scope := fset.String("scope", auth.ScopeReadWrite, "token scope: " + auth.ScopeRead + " or " + auth.ScopeReadWrite)
+	name := fset.String("name", "", "token description")
+	parse(fset)
+
+	t := &auth.Token {
+		Username: fset.Arg(0),
+		Name: *name,
+		Kind: *kind,
+		Scope: *scope,
+	}
+
+	err := c.auth().NewToken(t)
+	if err != nil {
+		log.Fatalf("Failed to create token for user '%s': %v", t.Username, err)
+	}
+
+	fmt.Printf("Token has been created: %s\nsecret: %s\n", t.String(), t.Secret)
+}
+
+func token_revoke(c *ctl, fset *flag.FlagSet) {
+	parse(fset)
+
+	err := c.auth().RevokeToken(fset.Arg(0), fset.Arg(1))
+	if err != nil {
+		log.Fatalf("Failed to revoke token '%s' of user '%s': %v", fset.Arg(1), fset.Arg(0), err)
+	}
+
+	fmt.Printf("Token '%s' of user '%s' has been revoked\n", fset.Arg(1), fset.Arg(0))
+}
+
+func token_list(c *ctl, fset *flag.FlagSet) {
+	parse(fset)
+
+	tokens, err := c.auth().ListTokens(fset.Arg(0))
+	if err != nil {
+		log.Fatalf("Failed to list tokens of user '%s': %v", fset.Arg(0), err)
+	}
+
+	for _, t := range tokens {
+		fmt.Printf("%s\n", t.String())
+	}
+}
+
+func lockout_list(c *ctl, fset *flag.FlagSet) {
+	parse(fset)
+
+	actl := c.auth()
+	err := actl.ClearExpiredLockouts()
+	if err != nil {
+		log.Fatalf("Failed to clear expired lockouts: %v", err)
+	}
+
+	lockouts, err := actl.ListLockouts()
+	if err != nil {
+		log.Fatalf("Failed to list lockouts: %v", err)
+	}
+
+	for _, l := range lockouts {
+		fmt.Printf("%s\n", l.String())
+	}
+}
+
+func lockout_clear(kind string) func(c *ctl, fset *flag.FlagSet) {
+	return func(c *ctl, fset *flag.FlagSet) {
+		parse(fset)
+
+		err := c.auth().ClearLockout(kind, fset.Arg(0))
 		if err != nil {
-			log.Fatalf("Failed to update user '%s': %v", mbox.Username, err)
+			log.Fatalf("Failed to clear lockout of %s '%s': %v", kind, fset.Arg(0), err)
 		}
 
-		fmt.Printf("User '%s' has been updated\n", mbox.Username)
+		fmt.Printf("Lockout of %s '%s' has been cleared\n", kind, fset.Arg(0))
 	}
+}
+
+var commands = map[string]*command {
+	"new":		{ "new <user> -password <password> [-role <role>]: create new user and its root directory", 1, user_new },
+	"update":	{ "update <user> [-password <password>] [-role <role>]: change password or role", 1, user_update },
+	"check":	{ "check <user> -password <password>: verify username and password", 1, user_check },
+	"list":		{ "list: list all users", 0, user_list },
+	"info":		{ "info <user>: show user, its usage and tokens", 1, user_info },
+	"delete":	{ "delete <user> [-keep-data]: delete user together with all files, shares and links", 1, user_delete },
+	"disable":	{ "disable <user>: forbid authentication, data is kept", 1, user_set_disabled(true) },
+	"enable":	{ "enable <user>: allow authentication of the disabled user", 1, user_set_disabled(false) },
+	"rename":	{ "rename <user> <new user>: rename user together with its data, shares and links", 2, user_rename },
+
+	"group-new":	{ "group-new <group>: create new group", 1, group_new },
+	"group-delete":	{ "group-delete <group>: delete group", 1, group_delete },
+	"group-add":	{ "group-add <group> <user>: add user to the group", 2, group_add },
+	"group-remove":	{ "group-remove <group> <user>: remove user from the group", 2, group_remove },
+	"groups":	{ "groups: list groups and their members", 0, group_list },
+
+	"token-new":	{ "token-new <user> [-kind <kind>] [-scope <scope>] [-name <name>]: create application password or api token, " +
+				"secret is printed once", 1, token_new },
+	"token-revoke":	{ "token-revoke <user> <id>: revoke token", 2, token_revoke },
+	"tokens":	{ "tokens <user>: list tokens of the user", 1, token_list },
+
+	"lockouts":	{ "lockouts: list locked out users and addresses", 0, lockout_list },
+	"unlock-user":	{ "unlock-user <user>: clear lockout of the user, servers pick it up within their sync interval", 1,
+				lockout_clear(auth.LockoutUser) },
+	"unlock-ip":	{ "unlock-ip <address>: clear lockout of the address, servers pick it up within their sync interval", 1,
+				lockout_clear(auth.LockoutIP) },
+}
+
+var (
+	current *command
+	command_args []string
+)
 
-	if *check_user != "" {
-		mbox := auth.Mailbox {
-			Username: *check_user,
-			Password: *pwd,
+// parse parses command flags, positional arguments may precede flags
+func parse(fset *flag.FlagSet) {
+	args := make([]string, 0)
+	rest := command_args
+	for len(rest) != 0 {
+		fset.Parse(rest)
+		if fset.NArg() == 0 {
+			break
 		}
 
-		err = actl.GetUser(&mbox)
+		args = append(args, fset.Arg(0))
+		rest = fset.Args()[1:]
+	}
+	fset.Parse(args)
+
+	if fset.NArg() != current.nargs {
+		log.Fatalf("Usage: %s", current.usage)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [-config <server config>] [-auth <params>] [-dbfs <params>] <command> [arguments]\n\n", os.Args[0])
+	flag.PrintDefaults()
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "\nCommands:\n")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+}
+
+func main() {
+	cpath := flag.String("config", "", "server config file, auth, dbfs and ebucket parameters are read from it")
+	auth_params := flag.String("auth", "", "mysql auth database parameters, override config:\n" +
+		"	user@unix(/path/to/socket)/dbname?charset=utf8\n" +
+		"	user:password@tcp(localhost:5555)/dbname?charset=utf8\n" +
+		"	user:password@/dbname\n" +
+		"	user:password@tcp([de:ad:be:ef::ca:fe]:80)/dbname")
+	dbfs_params := flag.String("dbfs", "", "mysql dbfs data parameters, override config:\n" +
+		"	user@unix(/path/to/socket)/dbname?charset=utf8\n" +
+		"	user:password@tcp(localhost:5555)/dbname?charset=utf8\n" +
+		"	user:password@/dbname\n" +
+		"	user:password@tcp([de:ad:be:ef::ca:fe]:80)/dbname")
+	flag.Usage = usage
+	flag.Parse()
+
+	c := &ctl{}
+	if *cpath != "" {
+		cdata, err := ioutil.ReadFile(*cpath)
+		if err != nil {
+			log.Fatalf("Could not read config file '%s': %v", *cpath, err)
+		}
+
+		err = json.Unmarshal(cdata, &c.conf)
 		if err != nil {
-			log.Fatalf("Failed to verify user '%s': %v", mbox.Username, err)
+			log.Fatalf("Could not unmarshal config file '%s': %v", *cpath, err)
 		}
+	}
+	if *auth_params != "" {
+		c.conf.AuthParams = *auth_params
+	}
+	if *dbfs_params != "" {
+		c.conf.DbFSParams = *dbfs_params
+	}
 
-		fmt.Printf("User '%s' has been verified: username/password match\n", mbox.Username)
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
 	}
+
+	var ok bool
+	current, ok = commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command '%s'\n\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	command_args = flag.Args()[1:]
+	fset := flag.NewFlagSet(flag.Arg(0), flag.ExitOnError)
+
+	defer c.close()
+	current.run(c, fset)
 }
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/bioothod/wd2/dbfs"
+	"log"
+	"path"
+)
+
+func main() {
+	dbfs_params := flag.String("dbfs", "", "mysql dbfs data parameters:\n" +
+		"	user@unix(/path/to/socket)/dbname?charset=utf8\n" +
+		"	user:password@tcp(localhost:5555)/dbname?charset=utf8\n" +
+		"	user:password@/dbname\n" +
+		"	user:password@tcp([de:ad:be:ef::ca:fe]:80)/dbname")
+	owner := flag.String("owner", "", "user who owns shared folder")
+	spath := flag.String("path", "", "shared folder in the owner's namespace")
+	name := flag.String("name", "", "share name, grantees see the folder as /Shared/<owner>/<name>, default is the last path component")
+	grantee_user := flag.String("user", "", "grant access to this user")
+	grantee_group := flag.String("group", "", "grant access to this group")
+	access := flag.String("access", dbfs.AccessRead, "access level: " + dbfs.AccessRead + " or " + dbfs.AccessReadWrite)
+	grant := flag.Bool("grant", false, "share folder")
+	revoke := flag.Bool("revoke", false, "revoke previously granted share")
+	list := flag.Bool("list", false, "list folders shared by the owner")
+	flag.Parse()
+
+	if *dbfs_params == "" {
+		log.Fatalf("You must provide dbfs parameters")
+	}
+	if *owner == "" {
+		log.Fatalf("You must provide owner of the shared folders")
+	}
+	if !*grant && !*revoke && !*list {
+		log.Fatalf("You must specify action: grant, revoke or list")
+	}
+
+	fs, err := dbfs.NewDbFSWithoutBucket("mysql", *dbfs_params)
+	if err != nil {
+		log.Fatalf("Failed to initialize dbfs database: %v", err)
+	}
+	defer fs.Close()
+
+	if *list {
+		shares, err := fs.ListSharesOwner(context.Background(), *owner)
+		if err != nil {
+			log.Fatalf("Failed to list shares of user '%s': %v", *owner, err)
+		}
+
+		for _, s := range shares {
+			fmt.Printf("%s\n", s.String())
+		}
+		return
+	}
+
+	s := &dbfs.Share {
+		Owner: *owner,
+		Path: path.Clean("/" + *spath),
+		Name: *name,
+		Access: *access,
+	}
+
+	if *grantee_user != "" && *grantee_group != "" {
+		log.Fatalf("You must provide either user or group, not both")
+	}
+	if *grantee_user != "" {
+		s.Grantee = *grantee_user
+		s.GranteeType = dbfs.GranteeUser
+	} else if *grantee_group != "" {
+		s.Grantee = *grantee_group
+		s.GranteeType = dbfs.GranteeGroup
+	} else {
+		log.Fatalf("You must provide user or group the folder is shared with")
+	}
+
+	if s.Name == "" {
+		s.Name = path.Base(s.Path)
+		if s.Path == "/" {
+			s.Name = s.Owner
+		}
+	}
+
+	if *revoke {
+		err = fs.DeleteShare(context.Background(), s)
+		if err != nil {
+			log.Fatalf("Failed to revoke share: %v", err)
+		}
+
+		fmt.Printf("Share has been revoked: %s\n", s.String())
+		return
+	}
+
+	u := &dbfs.DbFSUser {
+		Username: s.Owner,
+		FS: fs,
+	}
+
+	// grantees are confined to the real directory, symbolic links must not be stored in the share
+	s.Path, err = u.ResolvePath(context.Background(), s.Owner, s.Path, true)
+	if err != nil {
+		log.Fatalf("Failed to resolve shared folder '%s' of user '%s': %v", *spath, s.Owner, err)
+	}
+
+	fi, err := u.Stat(context.Background(), s.Path)
+	if err != nil {
+		log.Fatalf("Failed to stat shared folder '%s' of user '%s': %v", s.Path, s.Owner, err)
+	}
+	if !fi.IsDir() {
+		log.Fatalf("Shared path '%s' of user '%s' is not a directory", s.Path, s.Owner)
+	}
+
+	err = fs.InsertShare(context.Background(), s)
+	if err != nil {
+		log.Fatalf("Failed to grant share: %v", err)
+	}
+
+	fmt.Printf("Folder has been shared: %s\n", s.String())
+}